@@ -7,14 +7,13 @@ import (
 	"math/rand"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/hedzr/lb"
-	"github.com/hedzr/lb/lbapi"
 	"github.com/hedzr/lb/pkg/logger"
+	"github.com/hedzr/lb/proxy"
 )
 
 var port = 8103
@@ -31,15 +30,6 @@ func (DebugTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	return http.DefaultTransport.RoundTrip(r)
 }
 
-type ProxyPeer struct {
-	*httputil.ReverseProxy
-	url    string
-	weight int
-}
-
-func (p ProxyPeer) String() string { return p.url }
-func (p ProxyPeer) Weight() int    { return p.weight }
-
 func main() {
 	logger.SetLevel(logger.DebugLevel)
 
@@ -63,21 +53,15 @@ func main() {
 	var b = lb.New(lb.WeightedRoundRobin)
 	for _, p := range ports {
 		urlTarget := fmt.Sprintf("%s://ds1.service.local:%v", "http", p)
-		target, err := url.Parse(urlTarget)
+		peer, err := proxy.NewPeer(urlTarget, nextInRange(1, 10))
 		if err != nil {
 			logger.Fatalf("err: %v", err)
 		}
-		logger.Printf("forwarding to -> %s\n", target)
-		proxy := httputil.NewSingleHostReverseProxy(target)
-		proxy.Transport = DebugTransport{}
-		b.Add(&ProxyPeer{proxy, urlTarget, nextInRange(1, 10)})
+		logger.Printf("forwarding to -> %s (weight %v)\n", peer, peer.Weight())
+		b.Add(peer)
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		req.Host = req.URL.Host
-		peer, _ := b.Next(lbapi.DummyFactor)
-		peer.(*ProxyPeer).ServeHTTP(w, req)
-	})
+	http.Handle("/", proxy.New(b, proxy.WithTransport(DebugTransport{})))
 
 	fmt.Printf("Server started at port %v...\n", port)
 	err := http.ListenAndServe(fmt.Sprintf(":%v", port), nil)
@@ -6,13 +6,13 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"strconv"
 
-	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb"
+	"github.com/hedzr/lb/httpfactor"
 	"github.com/hedzr/lb/pkg/logger"
-	"github.com/hedzr/lb/rr"
+	"github.com/hedzr/lb/proxy"
 )
 
 var port = 8103
@@ -29,15 +29,6 @@ func (DebugTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	return http.DefaultTransport.RoundTrip(r)
 }
 
-type ProxyPeer struct {
-	*httputil.ReverseProxy
-	url    string
-	weight int
-}
-
-func (p ProxyPeer) String() string { return p.String() }
-func (p ProxyPeer) Weight() int    { return p.weight }
-
 func main() {
 	logger.SetLevel(logger.DebugLevel)
 
@@ -53,24 +44,22 @@ func main() {
 		ports = []int{8111, 8112}
 	}
 
-	var b = rr.New()
+	// a client sticks to one backend as long as the peers are unchanged
+	var b = lb.New(lb.ConsistentHash)
 	for _, p := range ports {
 		urlTarget := fmt.Sprintf("%s://ds1.service.local:%v", "http", p)
-		target, err := url.Parse(urlTarget)
+		peer, err := proxy.NewPeer(urlTarget, 1)
 		if err != nil {
 			logger.Fatalf("err: %v", err)
 		}
-		logger.Printf("forwarding to -> %s\n", target)
-		proxy := httputil.NewSingleHostReverseProxy(target)
-		proxy.Transport = DebugTransport{}
-		b.Add(&ProxyPeer{proxy, urlTarget, 1})
+		logger.Printf("forwarding to -> %s\n", peer)
+		b.Add(peer)
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		req.Host = req.URL.Host
-		peer, _ := b.Next(lbapi.DummyFactor)
-		peer.(*ProxyPeer).ServeHTTP(w, req)
-	})
+	http.Handle("/", proxy.New(b,
+		proxy.WithTransport(DebugTransport{}),
+		proxy.WithExtractor(httpfactor.ClientIP("127.0.0.1", "::1")),
+	))
 
 	fmt.Printf("Server started at port %v...\n", port)
 	err := http.ListenAndServe(fmt.Sprintf(":%v", port), nil)
@@ -0,0 +1,323 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package admin provides an embeddable HTTP API to inspect and
+// control live balancers.
+//
+//	GET  /algorithms           the registered algorithms
+//	GET  /balancers            all balancers, with their peers
+//	GET  /balancers/{name}     a balancer, with its peers
+//	POST /balancers/{name}/add      {"peer": "10.0.0.9:80", "weight": 1}
+//	POST /balancers/{name}/remove   {"peer": "10.0.0.9:80"}
+//	POST /balancers/{name}/drain    {"peer": "10.0.0.9:80"}
+//	POST /balancers/{name}/undrain  {"peer": "10.0.0.9:80"}
+//	POST /balancers/{name}/weight   {"peer": "10.0.0.9:80", "weight": 5}
+//
+// The POSTs need "Authorization: Bearer <token>", see WithToken;
+// without a token they are refused. Draining needs a health.New
+// balancer in the chain, and changing a weight needs a weighted
+// round-robin balancer, both are found through lbapi.Wrapper.
+//
+// Example:
+//
+//	a := admin.New(admin.WithToken(os.Getenv("LB_ADMIN_TOKEN")))
+//	a.Register("api", b)
+//	http.Handle("/admin/", http.StripPrefix("/admin", a))
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hedzr/lb"
+	"github.com/hedzr/lb/config"
+	"github.com/hedzr/lb/health"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+)
+
+// New makes an admin handler.
+func New(opts ...Opt) *Handler {
+	h := &Handler{balancers: make(map[string]lbapi.Balancer)}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Opt is a type prototype for New Handler
+type Opt func(h *Handler)
+
+// WithToken sets the bearer token of the POSTs.
+func WithToken(token string) Opt {
+	return func(h *Handler) {
+		h.token = token
+	}
+}
+
+// Handler is the admin http.Handler.
+type Handler struct {
+	token     string
+	mu        sync.RWMutex
+	balancers map[string]lbapi.Balancer
+}
+
+// Register adds a balancer by name.
+func (h *Handler) Register(name string, b lbapi.Balancer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.balancers[name] = b
+}
+
+// Unregister removes a balancer.
+func (h *Handler) Unregister(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.balancers, name)
+}
+
+// BalancerView is the JSON view of a balancer.
+type BalancerView struct {
+	Name      string     `json:"name"`
+	Algorithm string     `json:"algorithm,omitempty"`
+	Count     int        `json:"count"`
+	Peers     []PeerView `json:"peers"`
+}
+
+// PeerView is the JSON view of a peer. The effective and current
+// weights are those of a weighted round-robin balancer, the picks
+// are counted by a balancer made with lbapi.WithPickCounts.
+type PeerView struct {
+	Peer      string `json:"peer"`
+	Weight    *int   `json:"weight,omitempty"`
+	Effective *int   `json:"effective,omitempty"`
+	Current   *int   `json:"current,omitempty"`
+	Picks     int64  `json:"picks"`
+	Healthy   bool   `json:"healthy"`
+}
+
+// actionRequest is the body of a POST.
+type actionRequest struct {
+	Peer   string `json:"peer"`
+	Weight *int   `json:"weight"`
+}
+
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+var errNotFound = &statusError{http.StatusNotFound, "not found"}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var result interface{}
+	var err error = errNotFound
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "algorithms":
+		result, err = lb.Algorithms(), nil
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "balancers":
+		result, err = h.views(), nil
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "balancers":
+		if b, ok := h.balancer(parts[1]); ok {
+			result, err = view(parts[1], b), nil
+		}
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "balancers":
+		if err = h.authorize(r); err == nil {
+			result, err = h.act(r, parts[1], parts[2])
+		}
+	case len(parts) >= 1 && (parts[0] == "algorithms" || parts[0] == "balancers"):
+		err = &statusError{http.StatusMethodNotAllowed, "method not allowed"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusInternalServerError
+		var se *statusError
+		if errors.As(err, &se) {
+			status = se.status
+		}
+		w.WriteHeader(status)
+		result = map[string]string{"error": err.Error()}
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handler) authorize(r *http.Request) error {
+	if h.token == "" {
+		return &statusError{http.StatusForbidden, "control is disabled, no token configured"}
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(h.token)) != 1 {
+		return &statusError{http.StatusUnauthorized, "unauthorized"}
+	}
+	return nil
+}
+
+func (h *Handler) balancer(name string) (b lbapi.Balancer, ok bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	b, ok = h.balancers[name]
+	return
+}
+
+func (h *Handler) views() (views []BalancerView) {
+	h.mu.RLock()
+	names := make([]string, 0, len(h.balancers))
+	for name := range h.balancers {
+		names = append(names, name)
+	}
+	h.mu.RUnlock()
+	sort.Strings(names)
+
+	views = make([]BalancerView, 0, len(names))
+	for _, name := range names {
+		if b, ok := h.balancer(name); ok {
+			views = append(views, view(name, b))
+		}
+	}
+	return
+}
+
+func view(name string, b lbapi.Balancer) BalancerView {
+	v := BalancerView{Name: name, Count: b.Count(), Peers: []PeerView{}}
+	healthy := func(lbapi.Peer) bool { return true }
+	if hs, ok := findFeature[healthState](b); ok {
+		healthy = func(p lbapi.Peer) bool { return hs.State(p).Healthy }
+	} else if ha, ok := findFeature[lbapi.HealthAware](b); ok {
+		healthy = ha.Healthy
+	}
+	snapshot, ok := lbapi.Inspect(b)
+	if !ok {
+		for _, p := range peers(b) {
+			snapshot.Peers = append(snapshot.Peers, lbapi.PeerState{Peer: p})
+		}
+	}
+	v.Algorithm = snapshot.Algorithm
+
+	for i := range snapshot.Peers {
+		ps := &snapshot.Peers[i]
+		p := ps.Peer
+		pv := PeerView{Peer: p.String(), Picks: ps.Picks, Healthy: healthy(p)}
+		if snapshot.Algorithm == "weighted-round-robin" {
+			pv.Weight, pv.Effective, pv.Current = &ps.Weight, &ps.Effective, &ps.Current
+		} else if wp, ok := p.(lbapi.Weighted); ok {
+			weight := wp.Weight()
+			pv.Weight = &weight
+		}
+		v.Peers = append(v.Peers, pv)
+	}
+	return v
+}
+
+type weightSetter interface {
+	SetNodeWeight(node lbapi.WeightedPeer, newWeight int)
+}
+
+// healthState is a health.Balancer, its State changes nothing.
+type healthState interface {
+	State(peer lbapi.Peer) health.State
+}
+
+type healthSetter interface {
+	SetHealthy(peer lbapi.Peer, healthy bool)
+}
+
+// chain returns b and the balancers wrapped by it.
+func chain(b lbapi.Balancer) (list []lbapi.Balancer) {
+	for b != nil {
+		list = append(list, b)
+		w, ok := b.(lbapi.Wrapper)
+		if !ok {
+			break
+		}
+		b = w.Unwrap()
+	}
+	return
+}
+
+func peers(b lbapi.Balancer) []lbapi.Peer {
+	if pl, ok := findFeature[lbapi.PeerLister](b); ok {
+		return pl.Peers()
+	}
+	return nil
+}
+
+func find(b lbapi.Balancer, name string) lbapi.Peer {
+	for _, p := range peers(b) {
+		if p.String() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (h *Handler) act(r *http.Request, name, action string) (result interface{}, err error) {
+	b, ok := h.balancer(name)
+	if !ok {
+		return nil, errNotFound
+	}
+	var req actionRequest
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil || req.Peer == "" {
+		return nil, &statusError{http.StatusBadRequest, "want a JSON body with the peer"}
+	}
+
+	peer := find(b, req.Peer)
+	if action == "add" {
+		if peer != nil {
+			return nil, &statusError{http.StatusConflict, "peer exists"}
+		}
+		weight := 1
+		if req.Weight != nil {
+			weight = *req.Weight
+		}
+		b.Add(config.NewPeer(req.Peer, weight, nil, ""))
+	} else if peer == nil {
+		return nil, &statusError{http.StatusNotFound, "no such peer"}
+	}
+
+	switch action {
+	case "add":
+	case "remove":
+		b.Remove(peer)
+	case "drain", "undrain":
+		hs, ok := findFeature[healthSetter](b)
+		if !ok {
+			return nil, &statusError{http.StatusConflict, "the balancer has no health control"}
+		}
+		hs.SetHealthy(peer, action == "undrain")
+	case "weight":
+		ws, ok := findFeature[weightSetter](b)
+		wp, weighted := peer.(lbapi.WeightedPeer)
+		if !ok || !weighted || req.Weight == nil || *req.Weight < 0 {
+			return nil, &statusError{http.StatusConflict, "want a weighted balancer, a weighted peer and a weight"}
+		}
+		if s, ok := peer.(interface{ SetWeight(weight int) }); ok {
+			s.SetWeight(*req.Weight)
+		}
+		ws.SetNodeWeight(wp, *req.Weight)
+	default:
+		return nil, errNotFound
+	}
+
+	logger.Infof("[admin] %s %s %s from %s", name, action, req.Peer, r.RemoteAddr)
+	return view(name, b), nil
+}
+
+// findFeature returns the first balancer in the chain of b which
+// implements T.
+func findFeature[T any](b lbapi.Balancer) (t T, ok bool) {
+	for _, x := range chain(b) {
+		if t, ok = x.(T); ok {
+			return
+		}
+	}
+	return
+}
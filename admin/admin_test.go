@@ -0,0 +1,136 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb"
+	"github.com/hedzr/lb/admin"
+	"github.com/hedzr/lb/config"
+	"github.com/hedzr/lb/health"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/metrics"
+	"github.com/hedzr/lb/wrr"
+)
+
+func do(t *testing.T, h http.Handler, method, path, token, body string, out interface{}) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil {
+		if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdmin(t *testing.T) {
+	b := metrics.New().Wrap("api", health.New(wrr.New(lb.WithPeers(
+		config.NewPeer("10.0.0.1:80", 3, nil, ""),
+		config.NewPeer("10.0.0.2:80", 1, nil, ""),
+	))))
+	a := admin.New(admin.WithToken("s3cret"))
+	a.Register("api", b)
+
+	var algorithms []string
+	if do(t, a, "GET", "/algorithms", "", "", &algorithms) != 200 || !strings.Contains(strings.Join(algorithms, ","), "weighted-round-robin") {
+		t.Fatalf("bad algorithms: %v", algorithms)
+	}
+
+	b.Next(lbapi.DummyFactor)
+	var v admin.BalancerView
+	if do(t, a, "GET", "/balancers/api", "", "", &v) != 200 || v.Count != 2 || len(v.Peers) != 2 {
+		t.Fatalf("bad view: %+v", v)
+	}
+	if p := v.Peers[0]; p.Peer != "10.0.0.1:80" || *p.Weight != 3 || *p.Effective != 3 || *p.Current != -1 || !p.Healthy {
+		t.Fatalf("bad peer view: %+v", p)
+	}
+	var all []admin.BalancerView
+	if do(t, a, "GET", "/balancers", "", "", &all) != 200 || len(all) != 1 {
+		t.Fatalf("bad views: %+v", all)
+	}
+
+	// the control needs the token
+	if code := do(t, a, "POST", "/balancers/api/remove", "", `{"peer": "10.0.0.1:80"}`, nil); code != 401 {
+		t.Fatalf("want 401, got %v", code)
+	}
+	if code := do(t, admin.New(), "POST", "/balancers/api/remove", "x", `{"peer": "10.0.0.1:80"}`, nil); code != 403 {
+		t.Fatalf("want 403 without a token, got %v", code)
+	}
+
+	if code := do(t, a, "POST", "/balancers/api/add", "s3cret", `{"peer": "10.0.0.3:80", "weight": 2}`, &v); code != 200 || v.Count != 3 {
+		t.Fatalf("add: %v %+v", code, v)
+	}
+	if code := do(t, a, "POST", "/balancers/api/add", "s3cret", `{"peer": "10.0.0.3:80"}`, nil); code != 409 {
+		t.Fatalf("want 409 for a dup, got %v", code)
+	}
+	if code := do(t, a, "POST", "/balancers/api/weight", "s3cret", `{"peer": "10.0.0.2:80", "weight": 5}`, &v); code != 200 || *v.Peers[1].Weight != 5 {
+		t.Fatalf("weight: %v %+v", code, v.Peers[1])
+	}
+	if code := do(t, a, "POST", "/balancers/api/drain", "s3cret", `{"peer": "10.0.0.1:80"}`, &v); code != 200 || v.Peers[0].Healthy {
+		t.Fatalf("drain: %v %+v", code, v.Peers[0])
+	}
+	for i := 0; i < 20; i++ {
+		if p, _ := b.Next(lbapi.DummyFactor); p.String() == "10.0.0.1:80" {
+			t.Fatal("the drained peer is picked")
+		}
+	}
+	if code := do(t, a, "POST", "/balancers/api/undrain", "s3cret", `{"peer": "10.0.0.1:80"}`, &v); code != 200 || !v.Peers[0].Healthy {
+		t.Fatalf("undrain: %v %+v", code, v.Peers[0])
+	}
+	if code := do(t, a, "POST", "/balancers/api/remove", "s3cret", `{"peer": "10.0.0.1:80"}`, &v); code != 200 || v.Count != 2 {
+		t.Fatalf("remove: %v %+v", code, v)
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/balancers/none", "", 404},
+		{"POST", "/balancers/api/remove", `{"peer": "10.0.0.9:80"}`, 404},
+		{"POST", "/balancers/api/explode", `{"peer": "10.0.0.2:80"}`, 404},
+		{"POST", "/balancers/api/remove", `{}`, 400},
+		{"DELETE", "/balancers/api", "", 405},
+	} {
+		if code := do(t, a, c.method, c.path, "s3cret", c.body, nil); code != c.code {
+			t.Fatalf("%s %s: want %v, got %v", c.method, c.path, c.code, code)
+		}
+	}
+}
+
+func TestAdminViewReadOnly(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := health.New(wrr.New(lb.WithPeers(config.NewPeer("10.0.0.1:80", 1, nil, ""))),
+		health.WithThreshold(1), health.WithCooldown(10*time.Second), health.WithClock(func() time.Time { return now }))
+	a := admin.New()
+	a.Register("api", b)
+	b.Feedback(config.NewPeer("10.0.0.1:80", 1, nil, ""), time.Millisecond, errors.New("boom"))
+
+	var changes int
+	b.Subscribe(func(e lbapi.Event) {
+		if e.Type == lbapi.HealthChanged {
+			changes++
+		}
+	})
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 2; i++ {
+		var v admin.BalancerView
+		if do(t, a, "GET", "/balancers/api", "", "", &v) != 200 || !v.Peers[0].Healthy {
+			t.Fatalf("the cooldown is over: %+v", v)
+		}
+	}
+	if changes != 0 {
+		t.Fatalf("a GET should not change the health, got %v events", changes)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package canary rolls a new version out progressively, by shifting
+// the weight from a stable constraint peer of a versioning balancer
+// to a canary one step by step.
+//
+// Each step holds its share of the canary for an interval. The
+// error rate and latency of the canary are consulted at each Check,
+// and the canary is rolled back to 0% once a threshold is exceeded.
+// The weights are changed together through SetNodeWeights, so that
+// the smooth weighted round-robin state is kept and no pick sees the
+// canary and the stable weights of different steps.
+//
+// Example:
+//
+//	stable, next := version.NewConstrainablePeer("^2.x", 100), version.NewConstrainablePeer("^3.x", 0)
+//	b := version.New(version.WithConstrainedPeers(stable, next))
+//	c := canary.New(b, stable, next,
+//	    canary.WithSteps(5, 25, 50, 100),
+//	    canary.WithInterval(10*time.Minute),
+//	    canary.WithSignal(func() canary.Sample { return canarySample() }),
+//	    canary.WithThresholds(0.01, 300*time.Millisecond),
+//	)
+//	go c.Run(ctx, 10*time.Second)
+package canary
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+)
+
+// New makes a Controller shifting the weight of b from stable to
+// canary. b must have SetNodeWeights, as version.New and wrr.New do,
+// or wrap such a balancer (lbapi.Wrapper). A balancer having only
+// SetNodeWeight is told the two weights one after the other, the
+// picks in between see their sum away from the total. The constraint peers must
+// be lbapi.WeightedPeer, as version.NewConstrainablePeer makes.
+func New(b lbapi.Balancer, stable, canary lbapi.Constrainable, opts ...Opt) *Controller {
+	c := &Controller{
+		b:        b,
+		stable:   stable,
+		canary:   canary,
+		steps:    []int{5, 10, 25, 50, 100},
+		interval: 5 * time.Minute,
+		total:    100,
+		now:      time.Now,
+		state:    State{Step: -1},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Opt is a type prototype for New Controller
+type Opt func(c *Controller)
+
+// WithSteps sets the percents of the traffic sent to the canary at
+// each step, ascending, 5, 10, 25, 50 and 100 by default.
+func WithSteps(percents ...int) Opt {
+	return func(c *Controller) {
+		c.steps = percents
+	}
+}
+
+// WithInterval sets how long each step is held, 5 minutes by
+// default.
+func WithInterval(d time.Duration) Opt {
+	return func(c *Controller) {
+		c.interval = d
+	}
+}
+
+// WithTotal sets the sum of the weights of stable and canary, 100
+// by default. A step of p percents weighs the canary total*p/100.
+func WithTotal(weight int) Opt {
+	return func(c *Controller) {
+		c.total = weight
+	}
+}
+
+// WithSignal sets the source of the error rate and latency of the
+// canary, it's consulted at each Check.
+func WithSignal(fn Signal) Opt {
+	return func(c *Controller) {
+		c.signal = fn
+	}
+}
+
+// WithThresholds sets the error rate (from 0 to 1) and the latency
+// which roll the canary back once exceeded. A zero one is not
+// checked.
+func WithThresholds(maxErrorRate float64, maxLatency time.Duration) Opt {
+	return func(c *Controller) {
+		c.maxErrorRate, c.maxLatency = maxErrorRate, maxLatency
+	}
+}
+
+// WithClock sets the clock, time.Now by default.
+func WithClock(now func() time.Time) Opt {
+	return func(c *Controller) {
+		c.now = now
+	}
+}
+
+// Signal returns the recent health of the canary.
+type Signal func() Sample
+
+// Sample is the health of the canary, such as the error rate and
+// the p99 latency of the last minute.
+type Sample struct {
+	ErrorRate float64
+	Latency   time.Duration
+}
+
+// Phase is the phase of a rollout.
+type Phase int
+
+const (
+	// Pending is the phase before Start.
+	Pending Phase = iota
+	// Progressing is the phase of the steps.
+	Progressing
+	// Promoted is the phase after the last step was held.
+	Promoted
+	// RolledBack is the phase after a threshold was exceeded, or
+	// Rollback was called. The canary gets no traffic.
+	RolledBack
+)
+
+var phaseNames = [...]string{"Pending", "Progressing", "Promoted", "RolledBack"}
+
+func (p Phase) String() string {
+	if p >= 0 && int(p) < len(phaseNames) {
+		return phaseNames[p]
+	}
+	return "Phase(" + strconv.Itoa(int(p)) + ")"
+}
+
+// State is the state of a rollout.
+type State struct {
+	Phase Phase
+	// Step is the index of the current step, -1 before Start.
+	Step int
+	// Percent is the share of the canary.
+	Percent int
+	// Since is when the current step or phase began.
+	Since time.Time
+	// Reason tells why the canary was rolled back.
+	Reason string
+}
+
+// Controller is a progressive canary rollout. All methods are safe
+// for concurrent use.
+type Controller struct {
+	b              lbapi.Balancer
+	stable, canary lbapi.Constrainable
+	steps          []int
+	interval       time.Duration
+	total          int
+	signal         Signal
+	maxErrorRate   float64
+	maxLatency     time.Duration
+	now            func() time.Time
+
+	mu    sync.Mutex
+	state State
+}
+
+// State returns the state of the rollout.
+func (c *Controller) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Start enters the first step. It does nothing once started.
+func (c *Controller) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state.Phase == Pending && len(c.steps) > 0 {
+		c.state.Phase = Progressing
+		c.enter(0)
+	}
+}
+
+// Check consults the signal and rolls the canary back if a threshold
+// is exceeded, else it enters the next step once the current one has
+// been held for the interval. After the last step the rollout is
+// promoted, and the weights are left as they are.
+func (c *Controller) Check() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state.Phase != Progressing {
+		return c.state
+	}
+
+	if c.signal != nil {
+		s := c.signal()
+		switch {
+		case c.maxErrorRate > 0 && s.ErrorRate > c.maxErrorRate:
+			c.rollback("error rate " + strconv.FormatFloat(s.ErrorRate*100, 'f', 2, 64) + "% exceeded")
+			return c.state
+		case c.maxLatency > 0 && s.Latency > c.maxLatency:
+			c.rollback("latency " + s.Latency.String() + " exceeded")
+			return c.state
+		}
+	}
+
+	if now := c.now(); now.Sub(c.state.Since) >= c.interval {
+		if next := c.state.Step + 1; next < len(c.steps) {
+			c.enter(next)
+		} else {
+			c.state.Phase, c.state.Since = Promoted, now
+			logger.Infof("[canary] %v promoted", c.canary)
+		}
+	}
+	return c.state
+}
+
+// Rollback sends all traffic back to stable, unless the rollout is
+// promoted already.
+func (c *Controller) Rollback(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state.Phase == Pending || c.state.Phase == Progressing {
+		c.rollback(reason)
+	}
+}
+
+// Run starts the rollout and checks it every poll, until it's
+// promoted or rolled back, or ctx is done.
+func (c *Controller) Run(ctx context.Context, poll time.Duration) State {
+	c.Start()
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		if st := c.Check(); st.Phase != Progressing {
+			return st
+		}
+		select {
+		case <-ctx.Done():
+			return c.State()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Controller) enter(step int) {
+	percent := c.steps[step]
+	c.state.Step, c.state.Percent, c.state.Since = step, percent, c.now()
+	c.setWeights(c.total * percent / 100)
+	logger.Infof("[canary] %v: step %d, %d%%", c.canary, step, percent)
+}
+
+func (c *Controller) rollback(reason string) {
+	c.state.Phase, c.state.Percent, c.state.Since, c.state.Reason = RolledBack, 0, c.now(), reason
+	c.setWeights(0)
+	logger.Warnf("[canary] %v rolled back: %v", c.canary, reason)
+}
+
+func (c *Controller) setWeights(canary int) {
+	type weightsSetter interface {
+		SetNodeWeights(nodes []lbapi.WeightedPeer, weights []int)
+	}
+	type weightSetter interface {
+		SetNodeWeight(node lbapi.WeightedPeer, newWeight int)
+	}
+	stable, ok1 := c.stable.(lbapi.WeightedPeer)
+	next, ok2 := c.canary.(lbapi.WeightedPeer)
+	if !ok1 || !ok2 {
+		logger.Errorf("[canary] the constraint peers are not weighted")
+		return
+	}
+	for b := interface{}(c.b); b != nil; {
+		if ws, ok := b.(weightsSetter); ok {
+			ws.SetNodeWeights([]lbapi.WeightedPeer{stable, next}, []int{c.total - canary, canary})
+			return
+		}
+		if ws, ok := b.(weightSetter); ok {
+			ws.SetNodeWeight(stable, c.total-canary)
+			ws.SetNodeWeight(next, canary)
+			return
+		}
+		w, ok := b.(lbapi.Wrapper)
+		if !ok {
+			break
+		}
+		b = w.Unwrap()
+	}
+	logger.Errorf("[canary] the balancer has no SetNodeWeights")
+}
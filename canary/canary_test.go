@@ -0,0 +1,99 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package canary_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb/canary"
+	"github.com/hedzr/lb/health"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/rr"
+	"github.com/hedzr/lb/version"
+)
+
+func TestController(t *testing.T) {
+	v2, v3 := version.NewBackendFactor("2.4.0", "172.16.0.7:3500"), version.NewBackendFactor("3.0.0", "172.16.0.8:3500")
+	bf := version.NewBackendsFactor(rr.New)
+	bf.AddPeers(v2, v3)
+
+	newRollout := func(sample *canary.Sample, now *time.Time) (lbapi.Balancer, *canary.Controller) {
+		stable, next := version.NewConstrainablePeer("^2.x", 20), version.NewConstrainablePeer("^3.x", 0)
+		b := health.New(version.New(version.WithConstrainedPeers(stable, next)))
+		c := canary.New(b, stable, next,
+			canary.WithSteps(10, 50, 100),
+			canary.WithInterval(time.Minute),
+			canary.WithTotal(20),
+			canary.WithSignal(func() canary.Sample { return *sample }),
+			canary.WithThresholds(0.05, 200*time.Millisecond),
+			canary.WithClock(func() time.Time { return *now }),
+		)
+		return b, c
+	}
+	share := func(b lbapi.Balancer) int {
+		var n int
+		for i := 0; i < 20; i++ {
+			if p, _ := b.Next(bf); p == v3 {
+				n++
+			}
+		}
+		return n * 5
+	}
+
+	t.Run("promoted", func(t *testing.T) {
+		now, sample := time.Unix(1000, 0), canary.Sample{ErrorRate: 0.01, Latency: 50 * time.Millisecond}
+		b, c := newRollout(&sample, &now)
+		if st := c.State(); st.Phase != canary.Pending || st.Step != -1 || share(b) != 0 {
+			t.Fatalf("bad state before Start: %+v", st)
+		}
+
+		c.Start()
+		for _, want := range []struct {
+			after   time.Duration
+			percent int
+			phase   canary.Phase
+		}{
+			{0, 10, canary.Progressing},
+			{30 * time.Second, 10, canary.Progressing},
+			{30 * time.Second, 50, canary.Progressing},
+			{time.Minute, 100, canary.Progressing},
+			{59 * time.Second, 100, canary.Progressing},
+			{time.Second, 100, canary.Promoted},
+		} {
+			now = now.Add(want.after)
+			st := c.Check()
+			if st.Phase != want.phase || st.Percent != want.percent {
+				t.Fatalf("expecting %v at %v%%, got %+v", want.phase, want.percent, st)
+			}
+			if got := share(b); got != want.percent {
+				t.Fatalf("the canary gets %v%%, expecting %v%%", got, want.percent)
+			}
+		}
+	})
+
+	t.Run("rolled back", func(t *testing.T) {
+		now, sample := time.Unix(1000, 0), canary.Sample{}
+		b, c := newRollout(&sample, &now)
+		c.Start()
+		now = now.Add(time.Minute)
+		if st := c.Check(); st.Percent != 50 || share(b) != 50 {
+			t.Fatalf("bad state: %+v", st)
+		}
+
+		sample.Latency = time.Second
+		now = now.Add(time.Second)
+		if st := c.Check(); st.Phase != canary.RolledBack || st.Percent != 0 || st.Reason == "" {
+			t.Fatalf("expecting a rollback, got %+v", st)
+		}
+		if got := share(b); got != 0 {
+			t.Fatalf("the rolled back canary gets %v%%", got)
+		}
+
+		sample.Latency = 0
+		now = now.Add(time.Hour)
+		if st := c.Check(); st.Phase != canary.RolledBack || share(b) != 0 {
+			t.Fatalf("a rolled back canary should stay so: %+v", st)
+		}
+	})
+}
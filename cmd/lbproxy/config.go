@@ -0,0 +1,131 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hedzr/lb"
+)
+
+// Config is the configuration file of lbproxy.
+//
+//	{
+//	  "shutdown_timeout": "30s",
+//	  "listeners": [
+//	    {
+//	      "name": "redis",
+//	      "listen": ":6380",
+//	      "algorithm": "consistent-hash",
+//	      "backends": [{"addr": "10.0.0.1:6379"}, {"addr": "10.0.0.2:6379", "weight": 2}],
+//	      "max_conns": 1000,
+//	      "idle_timeout": "5m",
+//	      "dial_timeout": "3s"
+//	    },
+//	    {
+//	      "name": "dns",
+//	      "network": "udp",
+//	      "listen": ":53",
+//	      "algorithm": "consistent-hash",
+//	      "backends": [{"addr": "10.0.0.1:53"}, {"addr": "10.0.0.2:53"}],
+//	      "flow_timeout": "30s"
+//	    }
+//	  ]
+//	}
+type Config struct {
+	ShutdownTimeout Duration         `json:"shutdown_timeout"`
+	Listeners       []ListenerConfig `json:"listeners"`
+}
+
+// ListenerConfig describes one listening port and its backends.
+type ListenerConfig struct {
+	Name        string          `json:"name"`
+	Network     string          `json:"network"` // "tcp" (default) or "udp"
+	Listen      string          `json:"listen"`
+	Algorithm   string          `json:"algorithm"`
+	Backends    []BackendConfig `json:"backends"`
+	MaxConns    int             `json:"max_conns"`
+	IdleTimeout Duration        `json:"idle_timeout"`
+	DialTimeout Duration        `json:"dial_timeout"`
+	FlowTimeout Duration        `json:"flow_timeout"` // udp only
+}
+
+// BackendConfig is a "host:port" backend with optional weight.
+type BackendConfig struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+}
+
+// Duration is a time.Duration in the form of "300ms", "1m30s".
+type Duration time.Duration
+
+// UnmarshalJSON accepts a duration string or a number of seconds.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		dd, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(dd)
+	default:
+		return fmt.Errorf("invalid duration: %s", b)
+	}
+	return nil
+}
+
+func loadConfig(path string) (cfg *Config, err error) {
+	var b []byte
+	if b, err = os.ReadFile(path); err != nil {
+		return
+	}
+	cfg = &Config{ShutdownTimeout: Duration(30 * time.Second)}
+	if err = json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		if l.Name == "" {
+			l.Name = l.Listen
+		}
+		if l.Listen == "" {
+			return nil, fmt.Errorf("%s: listeners[%d]: listen is required", path, i)
+		}
+		if len(l.Backends) == 0 {
+			return nil, fmt.Errorf("%s: listeners[%d]: no backends", path, i)
+		}
+		if l.Algorithm == "" {
+			l.Algorithm = lb.RoundRobin
+		} else if _, ok := lb.Lookup(l.Algorithm); !ok {
+			return nil, fmt.Errorf("%s: listeners[%d]: unknown algorithm %q, want one of %s", path, i, l.Algorithm, strings.Join(lb.Algorithms(), ", "))
+		}
+		switch l.Network {
+		case "":
+			l.Network = "tcp"
+		case "tcp", "udp":
+		default:
+			return nil, fmt.Errorf("%s: listeners[%d]: unknown network %q", path, i, l.Network)
+		}
+	}
+	return
+}
+
+// backend is a lbapi.WeightedPeer, keyed by its address.
+type backend struct {
+	addr   string
+	weight int
+}
+
+func (b *backend) String() string { return b.addr }
+func (b *backend) Key() string    { return b.addr }
+func (b *backend) Weight() int    { return b.weight }
@@ -0,0 +1,42 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lbproxy.json")
+	_ = os.WriteFile(path, []byte(`{
+  "listeners": [
+    {"listen": ":6380", "backends": [{"addr": "10.0.0.1:6379"}], "idle_timeout": "5m", "dial_timeout": 3}
+  ]
+}`), 0o600)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := cfg.Listeners[0]
+	if l.Name != ":6380" || l.Algorithm != "round-robin" ||
+		time.Duration(l.IdleTimeout) != 5*time.Minute || time.Duration(l.DialTimeout) != 3*time.Second ||
+		time.Duration(cfg.ShutdownTimeout) != 30*time.Second {
+		t.Fatalf("bad config: %+v", cfg)
+	}
+
+	_ = os.WriteFile(path, []byte(`{"listeners": [{"listen": ":6380"}]}`), 0o600)
+	if _, err = loadConfig(path); err == nil {
+		t.Fatal("a listener without backends should be rejected")
+	}
+
+	_ = os.WriteFile(path, []byte(`{"listeners": [{"listen": ":6380", "algorithm": "round-robbin", "backends": [{"addr": "10.0.0.1:6379"}]}]}`), 0o600)
+	if _, err = loadConfig(path); err == nil || !strings.Contains(err.Error(), "listeners[0]: unknown algorithm") {
+		t.Fatalf("an unknown algorithm should be rejected: %v", err)
+	}
+}
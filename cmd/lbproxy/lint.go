@@ -0,0 +1,101 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/version"
+)
+
+// LintConfig is the input of the lint-versions subcommand, the
+// constraints of a versioning balancer and the backends to check
+// them against.
+//
+//	{
+//	  "constraints": [{"constraint": "<= 1.1.x", "weight": 2}, {"constraint": "^1.2.x", "weight": 4}],
+//	  "backends": [{"addr": "10.0.0.1:8111", "version": "1.1.5"}, {"addr": "10.0.0.2:8111", "version": "1.2.0", "weight": 2}]
+//	}
+type LintConfig struct {
+	Constraints []ConstraintConfig       `json:"constraints"`
+	Backends    []VersionedBackendConfig `json:"backends"`
+}
+
+// ConstraintConfig is a version constraint with optional weight, 1
+// if unset. A weight of 0 parks the constraint, such as a canary at
+// 0%.
+type ConstraintConfig struct {
+	Constraint string `json:"constraint"`
+	Weight     *int   `json:"weight"`
+}
+
+// VersionedBackendConfig is a backend of a version, with optional
+// weight, 1 if unset.
+type VersionedBackendConfig struct {
+	Addr    string `json:"addr"`
+	Version string `json:"version"`
+	Weight  *int   `json:"weight"`
+}
+
+// lintVersions runs "lbproxy lint-versions -config versions.json",
+// see version.Lint. It writes the report to out and returns the
+// exit code: 0 for no problems, 1 for problems, 2 for a bad input.
+func lintVersions(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("lint-versions", flag.ContinueOnError)
+	fs.SetOutput(out)
+	path := fs.String("config", "versions.json", "the constraints and the backends")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cs, backends, err := loadLintConfig(*path)
+	if err != nil {
+		fmt.Fprintf(out, "lbproxy: %v\n", err)
+		return 2
+	}
+	r := version.Lint(cs, backends)
+	fmt.Fprint(out, r)
+	if !r.OK() {
+		return 1
+	}
+	return 0
+}
+
+func loadLintConfig(path string) (cs []lbapi.Constrainable, backends []version.VersioningBackendFactor, err error) {
+	var b []byte
+	if b, err = os.ReadFile(path); err != nil {
+		return
+	}
+	var cfg LintConfig
+	if err = json.Unmarshal(b, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, c := range cfg.Constraints {
+		vc, err := semver.NewConstraint(c.Constraint)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: constraints[%d]: %w", path, i, err)
+		}
+		cs = append(cs, version.NewConstrainablePeerFromObj(vc, weightOr1(c.Weight)))
+	}
+	for i, be := range cfg.Backends {
+		if _, err := semver.NewVersion(be.Version); err != nil {
+			return nil, nil, fmt.Errorf("%s: backends[%d]: %w", path, i, err)
+		}
+		backends = append(backends, version.NewWeightedBackendFactor(be.Version, be.Addr, weightOr1(be.Weight)))
+	}
+	return
+}
+
+// weightOr1 returns the weight, or 1 if unset.
+func weightOr1(weight *int) int {
+	if weight == nil {
+		return 1
+	}
+	return *weight
+}
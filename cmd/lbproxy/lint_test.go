@@ -0,0 +1,44 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintVersions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "versions.json")
+	_ = os.WriteFile(path, []byte(`{
+  "constraints": [{"constraint": "<= 1.1.x", "weight": 2}, {"constraint": "^1.1.x", "weight": 4}],
+  "backends": [{"addr": "10.0.0.1:8111", "version": "1.1.5"}, {"addr": "10.0.0.2:8111", "version": "1.2.0", "weight": 2}]
+}`), 0o600)
+
+	var out strings.Builder
+	if code := lintVersions([]string{"-config", path}, &out); code != 1 {
+		t.Fatalf("bad exit code %v:\n%s", code, &out)
+	}
+	if s := out.String(); !strings.Contains(s, "overlap: 10.0.0.1:8111 - 1.1.5") || !strings.Contains(s, "share: 10.0.0.2:8111 - 1.2.0 gets 44.44%") {
+		t.Fatalf("bad report:\n%s", s)
+	}
+
+	// a parked canary gets no traffic
+	_ = os.WriteFile(path, []byte(`{
+  "constraints": [{"constraint": "^2.x"}, {"constraint": "^3.x", "weight": 0}],
+  "backends": [{"addr": "10.0.0.1:8111", "version": "2.1.0"}, {"addr": "10.0.0.2:8111", "version": "3.0.0"}]
+}`), 0o600)
+	out.Reset()
+	if code := lintVersions([]string{"-config", path}, &out); code != 0 || !strings.Contains(out.String(), "share: 10.0.0.2:8111 - 3.0.0 gets 0.00%") ||
+		!strings.Contains(out.String(), "share: 10.0.0.1:8111 - 2.1.0 gets 100.00%") {
+		t.Fatalf("bad report of a parked canary, %v:\n%s", code, &out)
+	}
+
+	_ = os.WriteFile(path, []byte(`{"constraints": [{"constraint": "^1.x"}], "backends": [{"addr": "10.0.0.1:8111", "version": "1.x.y"}]}`), 0o600)
+	out.Reset()
+	if code := lintVersions([]string{"-config", path}, &out); code != 2 || !strings.Contains(out.String(), "backends[0]") {
+		t.Fatalf("a bad version should be rejected, %v:\n%s", code, &out)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// lbproxy is a layer-4 TCP/UDP proxy built on the balancers of hedzr/lb.
+//
+// Usage:
+//
+//	lbproxy -config lbproxy.json
+//	lbproxy lint-versions -config versions.json
+//
+// Each listener accepts TCP connections and splices them to a
+// backend picked by the configured algorithm (any name registered
+// by lb.Register, such as "round-robin" or "consistent-hash",
+// where the client IP is the hashing key). A UDP listener keeps
+// each flow on one backend, see udpproxy. On SIGINT/SIGTERM the
+// listeners are closed and the live connections are drained until
+// shutdown_timeout.
+//
+// The lint-versions subcommand checks the version constraints of a
+// versioning balancer against its backends, see LintConfig and
+// version.Lint.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hedzr/lb"
+	"github.com/hedzr/lb/tcpproxy"
+	"github.com/hedzr/lb/udpproxy"
+)
+
+var configArg = flag.String("config", "lbproxy.json", "the config file")
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "lint-versions" {
+		os.Exit(lintVersions(os.Args[2:], os.Stdout))
+	}
+	flag.Parse()
+
+	cfg, err := loadConfig(*configArg)
+	if err != nil {
+		log.Fatalf("lbproxy: %v", err)
+	}
+
+	var proxies []*tcpproxy.Proxy
+	var forwarders []*udpproxy.Proxy
+	var wg sync.WaitGroup
+	for _, lc := range cfg.Listeners {
+		b := lb.New(lc.Algorithm)
+		for _, be := range lc.Backends {
+			weight := be.Weight
+			if weight <= 0 {
+				weight = 1
+			}
+			b.Add(&backend{addr: be.Addr, weight: weight})
+		}
+
+		if lc.Network == "udp" {
+			f := udpproxy.New(b, udpproxy.WithFlowTimeout(time.Duration(lc.FlowTimeout)))
+			pc, err := net.ListenPacket("udp", lc.Listen)
+			if err != nil {
+				log.Fatalf("lbproxy: %v: %v", lc.Name, err)
+			}
+			log.Printf("lbproxy: %v listening at udp %v, %v backends by %v", lc.Name, pc.LocalAddr(), len(lc.Backends), lc.Algorithm)
+
+			forwarders = append(forwarders, f)
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				if err := f.Serve(pc); err != nil && err != udpproxy.ErrProxyClosed {
+					log.Printf("lbproxy: %v: %v", name, err)
+				}
+			}(lc.Name)
+			continue
+		}
+
+		opts := []tcpproxy.Opt{
+			tcpproxy.WithMaxConns(lc.MaxConns),
+			tcpproxy.WithIdleTimeout(time.Duration(lc.IdleTimeout)),
+		}
+		if lc.DialTimeout > 0 {
+			opts = append(opts, tcpproxy.WithDialTimeout(time.Duration(lc.DialTimeout)))
+		}
+		p := tcpproxy.New(b, opts...)
+
+		ln, err := net.Listen("tcp", lc.Listen)
+		if err != nil {
+			log.Fatalf("lbproxy: %v: %v", lc.Name, err)
+		}
+		log.Printf("lbproxy: %v listening at tcp %v, %v backends by %v", lc.Name, ln.Addr(), len(lc.Backends), lc.Algorithm)
+
+		proxies = append(proxies, p)
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := p.Serve(ln); err != nil && err != tcpproxy.ErrProxyClosed {
+				log.Printf("lbproxy: %v: %v", name, err)
+			}
+		}(lc.Name)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	log.Printf("lbproxy: shutting down, draining live connections...")
+
+	for _, f := range forwarders {
+		_ = f.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	for _, p := range proxies {
+		wg.Add(1)
+		go func(p *tcpproxy.Proxy) {
+			defer wg.Done()
+			if err := p.Shutdown(ctx); err != nil {
+				log.Printf("lbproxy: live connections closed forcibly: %v", err)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,270 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package config builds a live balancer tree from a declarative
+// JSON description.
+//
+// Example:
+//
+//	{
+//	  "algorithm": "weighted-round-robin",
+//	  "peers": [
+//	    {"addr": "10.0.0.1:8111", "weight": 3, "labels": {"zone": "a"}, "version": "1.2.0"},
+//	    {"addr": "10.0.0.2:8111", "weight": 1},
+//	    {"name": "canary", "weight": 1, "group": {
+//	      "algorithm": "consistent-hash",
+//	      "options": {"replica": 16},
+//	      "peers": [{"addr": "10.0.1.1:8111"}, {"addr": "10.0.1.2:8111"}]
+//	    }}
+//	  ]
+//	}
+//
+// The algorithm is any name registered by lb.Register. A peer is one
+// of an address, a version constraint (for lb.VersioningWRR) or a
+// nested group, which is balanced by its own algorithm just like
+// wrandom.NewPeer.
+//
+//	b, err := config.Load("lb.json")
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/hedzr/lb"
+	"github.com/hedzr/lb/hash"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/version"
+)
+
+// Spec describes a balancer and its peers.
+type Spec struct {
+	Algorithm string     `json:"algorithm"`
+	Options   *Options   `json:"options,omitempty"`
+	Peers     []PeerSpec `json:"peers"`
+}
+
+// Options are the algorithm specific options.
+type Options struct {
+	// Replica is the virtual nodes count of each peer for
+	// lb.ConsistentHash, see hash.WithReplica.
+	Replica int `json:"replica,omitempty"`
+}
+
+// PeerSpec describes a peer. Exactly one of Addr, Constraint and
+// Group must be set. Weight is 1 if it's not set, an explicit 0
+// parks the peer.
+type PeerSpec struct {
+	Addr       string            `json:"addr,omitempty"`
+	Constraint string            `json:"constraint,omitempty"`
+	Group      *Spec             `json:"group,omitempty"`
+	Name       string            `json:"name,omitempty"` // group name
+	Weight     *int              `json:"weight,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Version    string            `json:"version,omitempty"`
+}
+
+// Error is a validation error, Path points at the offending field,
+// such as "peers[2].group.peers[0].addr".
+type Error struct {
+	Path string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return e.Msg
+	}
+	return e.Path + ": " + e.Msg
+}
+
+// Load reads a JSON file and builds the balancer.
+func Load(path string) (lbapi.Balancer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+// Parse builds the balancer from JSON data.
+func Parse(data []byte) (lbapi.Balancer, error) {
+	spec, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return spec.build(), nil
+}
+
+// Decode parses JSON data into a Spec and validates it. Unknown
+// fields are rejected.
+func Decode(data []byte) (spec *Spec, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	spec = new(Spec)
+	if err = dec.Decode(spec); err != nil {
+		return nil, err
+	}
+	if err = spec.Validate(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Validate checks the whole tree and returns all the problems
+// found, each as an *Error.
+func (s *Spec) Validate() error {
+	var errs []error
+	s.validate("", &errs)
+	return errors.Join(errs...)
+}
+
+func (s *Spec) validate(path string, errs *[]error) {
+	fail := func(field, format string, args ...interface{}) {
+		*errs = append(*errs, &Error{Path: join(path, field), Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if s.Algorithm == "" {
+		fail("algorithm", "required")
+	} else if _, ok := lb.Lookup(s.Algorithm); !ok {
+		fail("algorithm", "unknown algorithm %q", s.Algorithm)
+	}
+	if s.Options != nil && s.Options.Replica != 0 {
+		if s.Algorithm != lb.ConsistentHash {
+			fail("options.replica", "only valid for %q", lb.ConsistentHash)
+		} else if s.Options.Replica < 0 {
+			fail("options.replica", "must be positive")
+		}
+	}
+	if len(s.Peers) == 0 {
+		fail("peers", "no peers")
+	}
+
+	seen := make(map[string]int)
+	for i := range s.Peers {
+		p := &s.Peers[i]
+		pp := fmt.Sprintf("peers[%d]", i)
+		kinds := 0
+		for _, set := range []bool{p.Addr != "", p.Constraint != "", p.Group != nil} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			fail(pp, "exactly one of addr, constraint and group is required")
+			continue
+		}
+		if p.Weight != nil && *p.Weight < 0 {
+			fail(pp+".weight", "must not be negative")
+		}
+		if p.Name != "" && p.Group == nil {
+			fail(pp+".name", "only valid for a group")
+		}
+
+		if id := p.id(); id != "" {
+			if j, dup := seen[id]; dup {
+				fail(pp, "duplicated with peers[%d]", j)
+			} else {
+				seen[id] = i
+			}
+		}
+
+		switch {
+		case p.Addr != "":
+			if p.Version != "" {
+				if _, err := semver.NewVersion(p.Version); err != nil {
+					fail(pp+".version", "%v", err)
+				}
+			}
+		case p.Constraint != "":
+			if _, err := semver.NewConstraint(p.Constraint); err != nil {
+				fail(pp+".constraint", "%v", err)
+			}
+			if p.Version != "" || len(p.Labels) > 0 {
+				fail(pp, "a constraint peer takes no version or labels")
+			}
+		default:
+			if p.Version != "" || len(p.Labels) > 0 {
+				fail(pp, "a group peer takes no version or labels")
+			}
+			p.Group.validate(join(path, pp+".group"), errs)
+		}
+	}
+}
+
+func (p *PeerSpec) id() string {
+	switch {
+	case p.Addr != "":
+		return "addr:" + p.Addr
+	case p.Constraint != "":
+		return "constraint:" + p.Constraint
+	}
+	if p.Name != "" {
+		return "group:" + p.Name
+	}
+	return "" // an unnamed group is never a duplicate
+}
+
+func join(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// Build makes the balancer tree of a validated Spec.
+func Build(s *Spec) (lbapi.Balancer, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s.build(), nil
+}
+
+func (s *Spec) build() lbapi.Balancer {
+	b := s.balancer()
+	for i := range s.Peers {
+		b.Add(s.Peers[i].build(i))
+	}
+	return b
+}
+
+// balancer makes an empty balancer of the algorithm and options.
+func (s *Spec) balancer() lbapi.Balancer {
+	gen, _ := lb.Lookup(s.Algorithm)
+	var opts []lbapi.Opt
+	if s.Options != nil && s.Options.Replica > 0 {
+		opts = append(opts, hash.WithReplica(s.Options.Replica))
+	}
+	return gen(opts...)
+}
+
+func (p *PeerSpec) build(index int) lbapi.Peer {
+	switch {
+	case p.Addr != "":
+		return NewPeer(p.Addr, p.weight(), p.Labels, p.Version)
+	case p.Constraint != "":
+		return version.NewConstrainablePeer(p.Constraint, p.weight())
+	}
+	return NewGroup(p.groupName(index), p.weight(), p.Group.build())
+}
+
+func (p *PeerSpec) groupName(index int) string {
+	if p.Name == "" {
+		return fmt.Sprintf("group-%d", index)
+	}
+	return p.Name
+}
+
+func (p *PeerSpec) weight() int {
+	if p.Weight == nil {
+		return 1
+	}
+	return *p.Weight
+}
@@ -0,0 +1,141 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package config_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hedzr/lb/config"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/version"
+)
+
+const tree = `{
+  "algorithm": "weighted-round-robin",
+  "peers": [
+    {"addr": "10.0.0.1:8111", "weight": 3, "labels": {"zone": "a"}, "version": "1.2.0"},
+    {"addr": "10.0.0.2:8111", "weight": 1},
+    {"name": "canary", "weight": 1, "group": {
+      "algorithm": "consistent-hash",
+      "options": {"replica": 16},
+      "peers": [{"addr": "10.0.1.1:8111"}, {"addr": "10.0.1.2:8111"}]
+    }}
+  ]
+}`
+
+func TestParse(t *testing.T) {
+	b, err := config.Parse([]byte(tree))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Count() != 3 {
+		t.Fatalf("want 3 peers, got %v", b.Count())
+	}
+
+	sum := make(map[string]int)
+	for i := 0; i < 500; i++ {
+		p, _ := b.Next(lbapi.FactorString("user-1"))
+		sum[p.String()]++
+	}
+	if sum["10.0.0.1:8111"] != 300 || sum["10.0.0.2:8111"] != 100 {
+		t.Fatalf("bad distribution: %v", sum)
+	}
+	if sum["10.0.1.1:8111"]+sum["10.0.1.2:8111"] != 100 || sum["10.0.1.1:8111"]*sum["10.0.1.2:8111"] != 0 {
+		t.Fatalf("the hashing group should stick to one peer: %v", sum)
+	}
+}
+
+func TestParseZeroWeight(t *testing.T) {
+	b, err := config.Parse([]byte(`{
+  "algorithm": "weighted-round-robin",
+  "peers": [{"addr": "10.0.0.1:8111"}, {"addr": "10.0.0.2:8111", "weight": 0}]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := lbapi.Inspect(b)
+	if len(s.Peers) != 2 || s.Peers[0].Weight != 1 || s.Peers[1].Weight != 0 {
+		t.Fatalf("an explicit weight of 0 should be kept: %+v", s.Peers)
+	}
+	for i := 0; i < 10; i++ {
+		if p, _ := b.Next(lbapi.DummyFactor); p.String() != "10.0.0.1:8111" {
+			t.Fatalf("the parked peer is picked")
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.json")
+	_ = os.WriteFile(path, []byte(`{
+  "algorithm": "versioning-wrr",
+  "peers": [{"constraint": "^1.2.x", "weight": 4}, {"constraint": "^2.x", "weight": 1}]
+}`), 0o600)
+	b, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		c, _ := b.Next(lbapi.DummyFactor)
+		sum[c.String()]++
+	}
+	if sum["^1.2.x"] != 40 || sum["^2.x"] != 10 {
+		t.Fatalf("bad distribution: %v", sum)
+	}
+
+	// a versioned peer can be checked by the constraints
+	c := version.NewConstrainablePeer("^1.2.x", 1)
+	if !c.Check(config.NewPeer("10.0.0.1:8111", 1, nil, "v1.2.5")) || c.Check(config.NewPeer("10.0.0.2:8111", 1, nil, "2.0")) {
+		t.Fatal("bad version of config.Peer")
+	}
+
+	if _, err = config.Load(filepath.Join(t.TempDir(), "none.json")); err == nil {
+		t.Fatal("missing file should fail")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	_, err := config.Parse([]byte(`{
+  "algorithm": "round-robin",
+  "options": {"replica": 8},
+  "peers": [
+    {"addr": "10.0.0.1:8111", "version": "x.y"},
+    {"addr": "10.0.0.1:8111"},
+    {"addr": "10.0.0.3:8111", "constraint": "^1.x"},
+    {"name": "g", "weight": -1, "group": {"algorithm": "nope", "peers": [{"constraint": "!!"}]}}
+  ]
+}`))
+	if err == nil {
+		t.Fatal("invalid config should be rejected")
+	}
+
+	want := []string{
+		"options.replica",
+		"peers[0].version",
+		"peers[1]",
+		"peers[2]",
+		"peers[3].weight",
+		"peers[3].group.algorithm",
+		"peers[3].group.peers[0].constraint",
+	}
+	var paths []string
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var ce *config.Error
+		if !errors.As(e, &ce) {
+			t.Fatalf("not a config.Error: %v", e)
+		}
+		paths = append(paths, ce.Path)
+	}
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Fatalf("bad error paths:\n got: %v\nwant: %v\n%v", paths, want, err)
+	}
+
+	if _, err = config.Parse([]byte(`{"algorithm": "random", "peers": [{"adr": "x"}]}`)); err == nil {
+		t.Fatal("unknown field should be rejected")
+	}
+}
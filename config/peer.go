@@ -0,0 +1,78 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package config
+
+import (
+	"sync/atomic"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/hedzr/lb/lbapi"
+)
+
+// NewPeer makes an address peer. ver can be empty, or a semver
+// such as "1.2.3" or "v1.2.3".
+//
+// A Peer is a lbapi.WeightedPeer and lbapi.Labeled, keyed by the
+// address. With a version,
+// it also satisfies version.VersioningBackendFactor, so it can be
+// checked by the constraints of a versioning balancer.
+func NewPeer(addr string, weight int, labels map[string]string, ver string) *Peer {
+	p := &Peer{addr: addr, weight: int64(weight), labels: labels}
+	if ver != "" {
+		p.version, _ = semver.NewVersion(ver)
+	}
+	return p
+}
+
+// Peer is an address peer built from a PeerSpec.
+type Peer struct {
+	addr    string
+	weight  int64 // atomic, see SetWeight
+	labels  map[string]string
+	version *semver.Version
+}
+
+func (p *Peer) String() string              { return p.addr }
+func (p *Peer) Key() string                 { return p.addr }
+func (p *Peer) Weight() int                 { return int(atomic.LoadInt64(&p.weight)) }
+func (p *Peer) Labels() map[string]string   { return p.labels }
+func (p *Peer) Version() *semver.Version    { return p.version }
+func (p *Peer) DeepEqual(b lbapi.Peer) bool { return b != nil && p.addr == b.String() }
+
+// SetWeight changes the weight in place. A weighted round-robin
+// balancer holding the peer must be told by its SetNodeWeight too.
+func (p *Peer) SetWeight(weight int) { atomic.StoreInt64(&p.weight, int64(weight)) }
+
+// Factor returns the version string, or the address if there is
+// no version.
+func (p *Peer) Factor() string {
+	if p.version != nil {
+		return p.version.String()
+	}
+	return p.addr
+}
+
+// NewGroup wraps a balancer as a weighted peer, so that it can be
+// nested into another balancer.
+func NewGroup(name string, weight int, b lbapi.Balancer) *Group {
+	return &Group{name: name, weight: int64(weight), Balancer: b}
+}
+
+// Group is a named, weighted and balanced peer, keyed by the name.
+type Group struct {
+	lbapi.Balancer
+	name   string
+	weight int64 // atomic, see SetWeight
+}
+
+func (g *Group) String() string              { return g.name }
+func (g *Group) Key() string                 { return g.name }
+func (g *Group) Weight() int                 { return int(atomic.LoadInt64(&g.weight)) }
+func (g *Group) DeepEqual(b lbapi.Peer) bool { return b != nil && g.name == b.String() }
+
+// Unwrap implements lbapi.Wrapper, so that the nested balancer can
+// be inspected.
+func (g *Group) Unwrap() lbapi.Balancer { return g.Balancer }
+
+// SetWeight changes the weight in place, see Peer.SetWeight.
+func (g *Group) SetWeight(weight int) { atomic.StoreInt64(&g.weight, int64(weight)) }
@@ -0,0 +1,289 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+)
+
+// NewReloader loads the config file at path and keeps the built
+// balancer in sync with later changes of the file, see Reload and
+// Watch.
+//
+// Example:
+//
+//	r, err := config.NewReloader("lb.json", config.WithOnDrain(func(p lbapi.Peer) {
+//	    log.Printf("draining %v", p)
+//	}))
+//	go r.Watch(ctx, 5*time.Second)
+//	b := r.Balancer() // the same live balancer all along
+func NewReloader(path string, opts ...ReloaderOpt) (r *Reloader, err error) {
+	r = &Reloader{path: path}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r.root = newNode(spec)
+	r.sum = sha256.Sum256(data)
+	return
+}
+
+// ReloaderOpt is a type prototype for NewReloader
+type ReloaderOpt func(r *Reloader)
+
+// WithOnDrain sets the callback for the peers removed by a reload.
+// A removed peer gets no new traffic, the callback can be used to
+// wait for or close its live connections.
+func WithOnDrain(fn func(peer lbapi.Peer)) ReloaderOpt {
+	return func(r *Reloader) {
+		r.onDrain = fn
+	}
+}
+
+// WithOnError sets the callback for the failed reloads. The live
+// balancer is left unchanged by a failed reload.
+func WithOnError(fn func(err error)) ReloaderOpt {
+	return func(r *Reloader) {
+		r.onError = fn
+	}
+}
+
+// Reloader is a balancer built from a config file which follows
+// the changes of the file.
+type Reloader struct {
+	path    string
+	root    *node
+	sum     [sha256.Size]byte
+	onDrain func(peer lbapi.Peer)
+	onError func(err error)
+	mu      sync.Mutex
+}
+
+// node is a live balancer and the spec it was built from.
+type node struct {
+	spec   *Spec
+	b      lbapi.Balancer
+	peers  map[string]lbapi.Peer
+	groups map[string]*node
+}
+
+func newNode(spec *Spec) *node {
+	n := &node{
+		spec:   spec,
+		b:      spec.balancer(),
+		peers:  make(map[string]lbapi.Peer),
+		groups: make(map[string]*node),
+	}
+	var add []lbapi.Peer
+	for i := range spec.Peers {
+		add = append(add, n.build(&spec.Peers[i], i))
+	}
+	n.b.Add(add...)
+	return n
+}
+
+// Balancer returns the live balancer.
+func (r *Reloader) Balancer() lbapi.Balancer { return r.root.b }
+
+// Reload reads the config file again and applies the differences
+// to the live balancer:
+//
+//   - the new peers are added,
+//   - the removed peers are removed and passed to the drain callback,
+//   - a changed weight is updated in place, through SetNodeWeight
+//     for a weighted round-robin balancer, so that its smooth state
+//     is kept,
+//   - a peer with changed labels or version is replaced,
+//   - a nested group with a changed algorithm or options is replaced,
+//     else its peers are reconciled recursively.
+//
+// The changes of a balancer are applied at once, see lbapi.Updater.
+// The unchanged peers are untouched, so the round-robin counter and
+// the positions on a consistent-hash ring are kept. The algorithm
+// of the top level balancer cannot be changed by a reload.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if bytes.Equal(sum[:], r.sum[:]) {
+		return nil
+	}
+
+	spec, err := Decode(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.path, err)
+	}
+	if !sameBalancer(spec, r.root.spec) {
+		return fmt.Errorf("%s: %w", r.path, &Error{Path: "algorithm", Msg: "cannot be changed by reloading"})
+	}
+
+	r.root.apply(spec, r.drain)
+	r.sum = sum
+	logger.Infof("[config] %s reloaded", r.path)
+	return nil
+}
+
+func (r *Reloader) drain(peer lbapi.Peer) {
+	if r.onDrain != nil {
+		r.onDrain(peer)
+	}
+}
+
+// Watch polls the config file every interval and reloads it when
+// its modification time or size changed, until ctx is done. The
+// failures are logged and passed to the error callback.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	// the first tick always reloads, Reload skips an unchanged content
+	var lastMod time.Time
+	var lastSize int64 = -1
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(r.path)
+			if err != nil {
+				r.fail(err)
+				continue
+			}
+			if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+				continue
+			}
+			if err = r.Reload(); err != nil {
+				r.fail(err)
+			}
+			lastMod, lastSize = fi.ModTime(), fi.Size()
+		}
+	}
+}
+
+func (r *Reloader) fail(err error) {
+	logger.Errorf("[config] reloading failed: %v", err)
+	if r.onError != nil {
+		r.onError(err)
+	}
+}
+
+// sameBalancer tells whether two specs make the same kind of
+// balancer, so that one can be reconciled into the other.
+func sameBalancer(a, b *Spec) bool {
+	return a.Algorithm == b.Algorithm && reflect.DeepEqual(a.Options, b.Options)
+}
+
+// build makes the peer of ps and keeps it, the caller adds it to
+// the balancer.
+func (n *node) build(ps *PeerSpec, index int) (p lbapi.Peer) {
+	key := ps.key(index)
+	if ps.Group != nil {
+		g := newNode(ps.Group)
+		p = NewGroup(ps.groupName(index), ps.weight(), g.b)
+		n.groups[key] = g
+	} else {
+		p = ps.build(index)
+	}
+	n.peers[key] = p
+	return
+}
+
+// forget drops the peer of key and returns it, the caller removes
+// it from the balancer.
+func (n *node) forget(key string) (p lbapi.Peer) {
+	p = n.peers[key]
+	delete(n.peers, key)
+	delete(n.groups, key)
+	return
+}
+
+func (n *node) apply(spec *Spec, drain func(lbapi.Peer)) {
+	olds := make(map[string]*PeerSpec)
+	for i := range n.spec.Peers {
+		olds[n.spec.Peers[i].key(i)] = &n.spec.Peers[i]
+	}
+
+	var add, remove, drained []lbapi.Peer
+	wanted := make(map[string]bool)
+	for i := range spec.Peers {
+		ps := &spec.Peers[i]
+		key := ps.key(i)
+		wanted[key] = true
+
+		old, ok := olds[key]
+		switch {
+		case !ok:
+			add = append(add, n.build(ps, i))
+		case !reflect.DeepEqual(old.Labels, ps.Labels) || old.Version != ps.Version ||
+			ps.Group != nil && !sameBalancer(old.Group, ps.Group):
+			// replaced, the address keeps serving
+			remove = append(remove, n.forget(key))
+			add = append(add, n.build(ps, i))
+		default:
+			if ps.Group != nil {
+				n.groups[key].apply(ps.Group, drain)
+			}
+			if old.weight() != ps.weight() {
+				n.setWeight(n.peers[key], ps.weight())
+			}
+		}
+	}
+
+	for key := range olds {
+		if !wanted[key] {
+			p := n.forget(key)
+			remove = append(remove, p)
+			drained = append(drained, p)
+		}
+	}
+
+	lbapi.Update(n.b, add, remove)
+	for _, p := range drained {
+		drain(p)
+	}
+	n.spec = spec
+}
+
+func (n *node) setWeight(p lbapi.Peer, weight int) {
+	if ws, ok := p.(interface{ SetWeight(weight int) }); ok {
+		ws.SetWeight(weight)
+	}
+	if wb, ok := n.b.(interface {
+		SetNodeWeight(node lbapi.WeightedPeer, newWeight int)
+	}); ok {
+		if wp, ok := p.(lbapi.WeightedPeer); ok {
+			wb.SetNodeWeight(wp, weight)
+		}
+	}
+}
+
+// key identifies a peer across reloads.
+func (p *PeerSpec) key(index int) string {
+	if id := p.id(); id != "" {
+		return id
+	}
+	return fmt.Sprintf("group:#%d", index)
+}
@@ -0,0 +1,169 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package config_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb/config"
+	"github.com/hedzr/lb/lbapi"
+)
+
+func writeConfig(t *testing.T, path, data string) {
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func picks(b lbapi.Balancer, n int, factor lbapi.Factor) map[string]int {
+	sum := make(map[string]int)
+	for i := 0; i < n; i++ {
+		p, _ := b.Next(factor)
+		sum[p.String()]++
+	}
+	return sum
+}
+
+func TestReloadWeights(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.json")
+	writeConfig(t, path, `{"algorithm": "weighted-round-robin", "peers": [
+  {"addr": "a", "weight": 1}, {"addr": "b", "weight": 1}, {"addr": "c", "weight": 1}]}`)
+
+	var drained []string
+	r, err := config.NewReloader(path, config.WithOnDrain(func(p lbapi.Peer) { drained = append(drained, p.String()) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := r.Balancer()
+	if sum := picks(b, 300, lbapi.DummyFactor); sum["a"] != 100 || sum["b"] != 100 || sum["c"] != 100 {
+		t.Fatalf("bad distribution: %v", sum)
+	}
+
+	writeConfig(t, path, `{"algorithm": "weighted-round-robin", "peers": [
+  {"addr": "a", "weight": 3}, {"addr": "b", "weight": 1}, {"addr": "d", "weight": 1}]}`)
+	if err = r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Balancer() != b || b.Count() != 3 {
+		t.Fatalf("the live balancer should be kept and reconciled, count = %v", b.Count())
+	}
+	if sum := picks(b, 500, lbapi.DummyFactor); sum["a"] != 300 || sum["b"] != 100 || sum["d"] != 100 {
+		t.Fatalf("bad distribution after reloading: %v", sum)
+	}
+	if strings.Join(drained, ",") != "c" {
+		t.Fatalf("c should be drained, got %v", drained)
+	}
+}
+
+func TestReloadKeepsState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.json")
+	writeConfig(t, path, `{"algorithm": "round-robin", "peers": [{"addr": "a"}, {"addr": "b"}, {"addr": "c"}]}`)
+	r, err := config.NewReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := r.Balancer()
+	if p, _ := b.Next(lbapi.DummyFactor); p.String() != "a" {
+		t.Fatalf("want a, got %v", p)
+	}
+
+	writeConfig(t, path, `{"algorithm": "round-robin", "peers": [{"addr": "a"}, {"addr": "b"}, {"addr": "c"}, {"addr": "d"}]}`)
+	if err = r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := b.Next(lbapi.DummyFactor); p.String() != "b" {
+		t.Fatalf("the round-robin counter should be kept, got %v", p)
+	}
+
+	// the algorithm cannot be changed, and the balancer is left unchanged
+	writeConfig(t, path, `{"algorithm": "random", "peers": [{"addr": "a"}]}`)
+	if err = r.Reload(); err == nil {
+		t.Fatal("changing the algorithm should be rejected")
+	}
+	writeConfig(t, path, `{"algorithm": "round-robin", "peers": []}`)
+	if err = r.Reload(); err == nil {
+		t.Fatal("invalid config should be rejected")
+	}
+	if b.Count() != 4 {
+		t.Fatalf("a failed reload should not change the balancer, count = %v", b.Count())
+	}
+}
+
+func TestReloadHashRing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.json")
+	writeConfig(t, path, `{"algorithm": "weighted-round-robin", "peers": [
+  {"name": "g", "group": {"algorithm": "consistent-hash", "peers": [{"addr": "a"}, {"addr": "b"}, {"addr": "c"}]}}]}`)
+	r, err := config.NewReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := r.Balancer()
+
+	before := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		f := lbapi.FactorString(strings.Repeat("k", i%7) + string(rune('a'+i%26)) + string(rune('0'+i%10)))
+		p, _ := b.Next(f)
+		before[f.Factor()] = p.String()
+	}
+
+	writeConfig(t, path, `{"algorithm": "weighted-round-robin", "peers": [
+  {"name": "g", "group": {"algorithm": "consistent-hash", "peers": [{"addr": "a"}, {"addr": "b"}]}}]}`)
+	if err = r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for f, was := range before {
+		p, _ := b.Next(lbapi.FactorString(f))
+		if was != "c" && p.String() != was {
+			t.Fatalf("%q moved from %v to %v", f, was, p)
+		}
+		if p.String() == "c" {
+			t.Fatalf("%q still goes to the removed peer", f)
+		}
+	}
+}
+
+func TestReloadWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.json")
+	writeConfig(t, path, `{"algorithm": "round-robin", "peers": [{"addr": "a"}]}`)
+	var mu sync.Mutex
+	var failures int
+	r, err := config.NewReloader(path, config.WithOnError(func(error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures++
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	writeConfig(t, path, `{"algorithm": "round-robin", "peers": [{"addr": "a"}, {"addr": "bb"}]}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for r.Balancer().Count() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.Balancer().Count() != 2 {
+		t.Fatal("the change should be picked up")
+	}
+
+	writeConfig(t, path, `{"algorithm": "round-robin"`)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := failures
+		mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the broken config should be reported")
+}
@@ -0,0 +1,178 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package dialer provides a load-balancing DialContext for TCP
+// clients.
+//
+// The peers of the balancer are "host:port" addresses. The addr
+// passed to DialContext is ignored, so the dialer can be plugged
+// into any client taking a dial function, such as database
+// drivers, grpc.WithContextDialer or Redis clients.
+//
+// Example:
+//
+//	b := lb.New(lb.LeastConnections)
+//	b.Add(addr1, addr2) // any lbapi.Peer whose String() is "host:port"
+//	d := dialer.New(b)
+//	conn, err := grpc.Dial("my-service", grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+//	    return d.DialContext(ctx, "tcp", addr)
+//	}), ...)
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+)
+
+// New makes a Dialer which connects to the peers picked from b.
+// The factor is taken from the context, see lbapi.ContextWithFactor.
+//
+// The open connections of each peer are tracked, and reported to b
+// if it implements lbapi.ConnAware (see leastconn.New). The outcome
+// of each dial is reported if b implements lbapi.FeedbackAware (see
+// health.New).
+func New(b lbapi.Balancer, opts ...Opt) *Dialer {
+	d := &Dialer{
+		lb:     b,
+		dialer: &net.Dialer{},
+		open:   make(map[string]int),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Opt is a type prototype for New Dialer
+type Opt func(d *Dialer)
+
+// WithDialer sets the underlying net.Dialer, which controls the
+// timeout and keep-alive of each connection attempt.
+func WithDialer(nd *net.Dialer) Opt {
+	return func(d *Dialer) {
+		d.dialer = nd
+	}
+}
+
+// Dialer dials the peers of a balancer.
+type Dialer struct {
+	lb     lbapi.Balancer
+	dialer *net.Dialer
+	open   map[string]int // of the peers with open connections
+	rw     sync.RWMutex
+}
+
+// ErrNoPeer is returned when no peer could be picked.
+var ErrNoPeer = errors.New("dialer: no available peer")
+
+// DialContext connects to a peer picked from the balancer. If the
+// connection is refused or timed out, the next peer is tried,
+// excluding the ones already failed. At most as many picks as
+// there are peers are made.
+//
+// addr is not used to find the target.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	factor := lbapi.FactorFromContext(ctx)
+
+	var failed map[string]bool
+	err = ErrNoPeer
+	for i, n := 0, d.lb.Count(); i < n; i++ {
+		peer, _ := d.lb.Next(factor)
+		if peer == nil {
+			break
+		}
+		target := peer.String()
+		if failed[target] {
+			continue
+		}
+
+		var c net.Conn
+		start := time.Now()
+		c, err = d.dialer.DialContext(ctx, network, target)
+		if fa, ok := d.lb.(lbapi.FeedbackAware); ok && ctx.Err() == nil {
+			fa.Feedback(peer, time.Since(start), err)
+		}
+		if err == nil {
+			return d.track(peer, c), nil
+		}
+		if ctx.Err() != nil || !isRetryable(err) {
+			return
+		}
+
+		logger.Warnf("[dialer] dialing %v failed: %v", target, err)
+		if failed == nil {
+			failed = make(map[string]bool)
+		}
+		failed[target] = true
+	}
+	return
+}
+
+// Open returns the number of open connections to peer.
+func (d *Dialer) Open(peer lbapi.Peer) int {
+	d.rw.RLock()
+	defer d.rw.RUnlock()
+	return d.open[peer.String()]
+}
+
+func (d *Dialer) track(peer lbapi.Peer, c net.Conn) net.Conn {
+	d.rw.Lock()
+	d.open[peer.String()]++
+	d.rw.Unlock()
+	if ca, ok := d.lb.(lbapi.ConnAware); ok {
+		ca.Acquire(peer)
+	}
+	return &trackedConn{Conn: c, d: d, peer: peer}
+}
+
+// release drops the counter of peer with its last connection, so
+// that the peers gone through discovery are not kept.
+func (d *Dialer) release(peer lbapi.Peer) {
+	key := peer.String()
+	d.rw.Lock()
+	if d.open[key] <= 1 {
+		delete(d.open, key)
+	} else {
+		d.open[key]--
+	}
+	d.rw.Unlock()
+	if ca, ok := d.lb.(lbapi.ConnAware); ok {
+		ca.Release(peer)
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	d    *Dialer
+	peer lbapi.Peer
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.d.release(c.peer) })
+	return c.Conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the connection if it
+// supports half-close (as *net.TCPConn does), else closes it.
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// isRetryable tells whether the peer refused or did not answer.
+func isRetryable(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
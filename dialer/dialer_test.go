@@ -0,0 +1,127 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package dialer_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/hedzr/lb/dialer"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/leastconn"
+	"github.com/hedzr/lb/rr"
+)
+
+type exP string
+
+func (s exP) String() string { return string(s) }
+
+// serve accepts connections and answers each with name.
+func serve(t *testing.T, name string) (addr exP, closer func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.WriteString(c, name+"\n")
+				_, _ = io.Copy(io.Discard, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+	return exP(ln.Addr().String()), func() { _ = ln.Close() }
+}
+
+func deadAddr(t *testing.T) exP {
+	addr, closer := serve(t, "dead")
+	closer()
+	return addr
+}
+
+func hello(t *testing.T, c net.Conn) string {
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line[:len(line)-1]
+}
+
+func TestDialerFailover(t *testing.T) {
+	good, closer := serve(t, "good")
+	defer closer()
+	dead := deadAddr(t)
+
+	d := dialer.New(rr.New(func(b lbapi.Balancer) { b.Add(dead, good) }))
+	for i := 0; i < 4; i++ {
+		c, err := d.DialContext(context.Background(), "tcp", "my-service:6379")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hello(t, c); got != "good" {
+			t.Fatalf("want good, got %q", got)
+		}
+		_ = c.Close()
+	}
+
+	d = dialer.New(rr.New(func(b lbapi.Balancer) { b.Add(dead) }))
+	if _, err := d.DialContext(context.Background(), "tcp", ""); err == nil {
+		t.Fatal("dialing the dead peer should fail")
+	}
+	if _, err := dialer.New(rr.New()).DialContext(context.Background(), "tcp", ""); err != dialer.ErrNoPeer {
+		t.Fatalf("want ErrNoPeer, got %v", err)
+	}
+}
+
+func TestDialerLeastConn(t *testing.T) {
+	a1, c1 := serve(t, "s1")
+	defer c1()
+	a2, c2 := serve(t, "s2")
+	defer c2()
+
+	d := dialer.New(leastconn.New(func(b lbapi.Balancer) { b.Add(a1, a2) }))
+
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		c, err := d.DialContext(context.Background(), "tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	if d.Open(a1) != 2 || d.Open(a2) != 2 {
+		t.Fatalf("connections should be spread: %v/%v", d.Open(a1), d.Open(a2))
+	}
+
+	// close the ones to s1, then the next ones should go to s1
+	for _, c := range conns {
+		if hello(t, c) == "s1" {
+			_ = c.Close()
+			_ = c.Close() // double close must not be counted twice
+		}
+	}
+	if d.Open(a1) != 0 {
+		t.Fatalf("want 0 open to s1, got %v", d.Open(a1))
+	}
+	for i := 0; i < 2; i++ {
+		c, err := d.DialContext(context.Background(), "tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hello(t, c); got != "s1" {
+			t.Fatalf("least connections should pick s1, got %q", got)
+		}
+		defer c.Close()
+	}
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
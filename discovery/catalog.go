@@ -0,0 +1,228 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/hedzr/lb/config"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+	"github.com/hedzr/lb/version"
+)
+
+// NewCatalog makes a provider which watches the healthy instances
+// of a service through a Consul style HTTP catalog, such as
+// "http://127.0.0.1:8500".
+//
+// It long-polls /v1/health/service/<service>?passing=1 with the
+// blocking query index, so the changes are sent as soon as the
+// catalog has them. Each instance becomes a peer "address:port"
+// where:
+//
+//   - the tags become the labels, "key=value" or "tag" (with an
+//     empty value),
+//   - Weights.Passing becomes the weight,
+//   - Meta.version, if any, becomes the version, the peer is then a
+//     version.VersioningBackendFactor for the versioning balancer.
+func NewCatalog(baseURL, service string, opts ...CatalogOpt) *Catalog {
+	c := &Catalog{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		service: service,
+		client:  http.DefaultClient,
+		wait:    5 * time.Minute,
+		backoff: time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// CatalogOpt is a type prototype for NewCatalog
+type CatalogOpt func(c *Catalog)
+
+// WithHTTPClient sets the client for the catalog API.
+func WithHTTPClient(client *http.Client) CatalogOpt {
+	return func(c *Catalog) {
+		c.client = client
+	}
+}
+
+// WithWait sets the longest time a blocking query waits for a
+// change, 5 minutes by default. It's rounded up to whole seconds.
+func WithWait(d time.Duration) CatalogOpt {
+	return func(c *Catalog) {
+		c.wait = d
+	}
+}
+
+// WithBackoff sets the pause after a failed query, 1 second by
+// default.
+func WithBackoff(d time.Duration) CatalogOpt {
+	return func(c *Catalog) {
+		c.backoff = d
+	}
+}
+
+// Catalog is a Consul style catalog provider.
+type Catalog struct {
+	baseURL string
+	service string
+	client  *http.Client
+	wait    time.Duration
+	backoff time.Duration
+}
+
+// catalogEntry is the part of a /v1/health/service entry we need.
+type catalogEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+// Watch sends the healthy instances, and again each time they are
+// changed. A failed query keeps the last peers.
+func (c *Catalog) Watch(ctx context.Context) <-chan []lbapi.Peer {
+	ch := make(chan []lbapi.Peer)
+	go func() {
+		defer close(ch)
+		var index uint64
+		var last string
+		first := true
+		for ctx.Err() == nil {
+			peers, next, err := c.Query(ctx, index)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Warnf("[discovery] catalog %s: %v", c.service, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(c.backoff):
+				}
+				continue
+			}
+
+			// the index must grow, else start over as the catalog says;
+			// it's at least 1 so that the next query always blocks
+			if next < index {
+				next = 0
+			}
+			if next < 1 {
+				next = 1
+			}
+			index = next
+			if fp := fingerprint(peers); fp != last || first {
+				last, first = fp, false
+				select {
+				case ch <- peers:
+				case <-ctx.Done():
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// Query does one blocking query, which returns once the catalog
+// index is past index or the wait time is up. index 0 returns at
+// once.
+func (c *Catalog) Query(ctx context.Context, index uint64) (peers []lbapi.Peer, next uint64, err error) {
+	q := url.Values{"passing": {"1"}}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		// whole seconds, at least one: "0s" would not block
+		q.Set("wait", fmt.Sprintf("%ds", (c.wait+time.Second-1)/time.Second))
+	}
+	u := fmt.Sprintf("%s/v1/health/service/%s?%s", c.baseURL, url.PathEscape(c.service), q.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+
+	var entries []catalogEntry
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return
+	}
+	next, _ = strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	for _, e := range entries {
+		peers = append(peers, e.peer())
+	}
+	return
+}
+
+func (e *catalogEntry) peer() lbapi.Peer {
+	host := e.Service.Address
+	if host == "" {
+		host = e.Node.Address
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(e.Service.Port))
+
+	labels := make(map[string]string, len(e.Service.Tags))
+	for _, tag := range e.Service.Tags {
+		k, v, _ := strings.Cut(tag, "=")
+		labels[k] = v
+	}
+	weight := e.Service.Weights.Passing
+	if weight == 0 {
+		weight = 1
+	}
+
+	if ver := e.Service.Meta["version"]; ver != "" {
+		if _, err := semver.NewVersion(ver); err != nil {
+			logger.Warnf("[discovery] %s: bad version %q, taken as unversioned: %v", addr, ver, err)
+			return config.NewPeer(addr, weight, labels, "")
+		}
+		return &versionedPeer{
+			VersioningBackendFactor: version.NewWeightedBackendFactor(ver, addr, weight),
+			addr:                    addr,
+			labels:                  labels,
+		}
+	}
+	return config.NewPeer(addr, weight, labels, "")
+}
+
+// versionedPeer is a discovered instance with a version.
+type versionedPeer struct {
+	version.VersioningBackendFactor
+	addr   string
+	labels map[string]string
+}
+
+func (p *versionedPeer) String() string            { return p.addr }
+func (p *versionedPeer) Key() string               { return p.addr }
+func (p *versionedPeer) Labels() map[string]string { return p.labels }
+func (p *versionedPeer) Weight() int               { return p.VersioningBackendFactor.(lbapi.Weighted).Weight() }
+
+// SetWeight changes the weight in place, see
+// version.BackendsFactor.SetWeight.
+func (p *versionedPeer) SetWeight(weight int) {
+	p.VersioningBackendFactor.(interface{ SetWeight(weight int) }).SetWeight(weight)
+}
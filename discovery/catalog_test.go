@@ -0,0 +1,201 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package discovery_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb/discovery"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/rr"
+	"github.com/hedzr/lb/version"
+)
+
+// fakeCatalog serves /v1/health/service/<name> with the blocking
+// query semantics of Consul.
+type fakeCatalog struct {
+	mu      sync.Mutex
+	changed chan struct{}
+	index   uint64
+	entries []map[string]interface{}
+}
+
+func (c *fakeCatalog) set(entries ...map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index++
+	c.entries = entries
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeCatalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/web" || r.URL.Query().Get("passing") == "" {
+		http.NotFound(w, r)
+		return
+	}
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+
+	c.mu.Lock()
+	if index > 0 && index >= c.index {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+		c.mu.Lock()
+	}
+	defer c.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	_ = json.NewEncoder(w).Encode(c.entries)
+}
+
+func instance(addr string, port int, ver string, tags ...string) map[string]interface{} {
+	svc := map[string]interface{}{"Address": addr, "Port": port, "Tags": tags, "Weights": map[string]int{"Passing": 1}}
+	if ver != "" {
+		svc["Meta"] = map[string]string{"version": ver}
+	}
+	return map[string]interface{}{"Node": map[string]string{"Address": "10.9.9.9"}, "Service": svc}
+}
+
+func TestCatalog(t *testing.T) {
+	cat := &fakeCatalog{changed: make(chan struct{})}
+	cat.set(
+		instance("172.16.0.6", 3500, "1.1", "zone=a"),
+		instance("172.16.0.7", 3500, "1.3", "zone=b", "canary"),
+	)
+	srv := httptest.NewServer(cat)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := discovery.NewCatalog(srv.URL, "web", discovery.WithWait(time.Second)).Watch(ctx)
+
+	peers := <-ch
+	if names(peers) != "172.16.0.6:3500,172.16.0.7:3500" {
+		t.Fatalf("bad peers: %v", names(peers))
+	}
+	for _, p := range peers {
+		if p.String() == "172.16.0.7:3500" {
+			labels := p.(lbapi.Labeled).Labels()
+			if _, ok := labels["canary"]; !ok || labels["zone"] != "b" {
+				t.Fatalf("bad labels: %v", labels)
+			}
+		}
+	}
+
+	// a change is sent at once by the blocking query
+	start := time.Now()
+	cat.set(
+		instance("172.16.0.7", 3500, "1.3", "zone=b", "canary"),
+		instance("172.16.0.8", 3500, "2.0"),
+		instance("", 3500, "3.13"),
+	)
+	peers = <-ch
+	if names(peers) != "10.9.9.9:3500,172.16.0.7:3500,172.16.0.8:3500" || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("bad peers: %v in %v", names(peers), time.Since(start))
+	}
+
+	// the live versions feed the versioning balancer
+	bf := version.NewBackendsFactor(rr.New)
+	for _, p := range peers {
+		bf.AddPeers(p.(version.VersioningBackendFactor))
+	}
+	b := version.New(version.WithConstrainedPeers(version.NewConstrainablePeer("^2.x", 1)))
+	if p, _ := b.Next(bf); p == nil || p.String() != "172.16.0.8:3500" {
+		t.Fatalf("want the 2.x backend, got %v", p)
+	}
+}
+
+func TestCatalogErrors(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if _, _, err := discovery.NewCatalog(srv.URL, "web").Query(context.Background(), 0); err == nil {
+		t.Fatal("a failed query should fail")
+	}
+}
+
+func TestCatalogBadVersion(t *testing.T) {
+	cat := &fakeCatalog{changed: make(chan struct{})}
+	cat.set(instance("172.16.0.6", 3500, "latest"), instance("172.16.0.7", 3500, "2.1"))
+	srv := httptest.NewServer(cat)
+	defer srv.Close()
+
+	peers, _, err := discovery.NewCatalog(srv.URL, "web").Query(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf := version.NewBackendsFactor(rr.New)
+	for _, p := range peers {
+		if vp, ok := p.(version.VersioningBackendFactor); ok {
+			bf.AddPeers(vp)
+		}
+	}
+	b := version.New(version.WithConstrainedPeers(version.NewConstrainablePeer(">= 0.0.0", 1)))
+	for i := 0; i < 4; i++ {
+		if p, _ := b.Next(bf); p == nil || p.String() != "172.16.0.7:3500" {
+			t.Fatalf("want the versioned backend, got %v", p)
+		}
+	}
+}
+
+// TestCatalogNoIndex checks a catalog without X-Consul-Index is not
+// queried in a busy loop.
+func TestCatalogNoIndex(t *testing.T) {
+	var mu sync.Mutex
+	var queries int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries++
+		mu.Unlock()
+		if wait, err := time.ParseDuration(r.URL.Query().Get("wait")); err == nil {
+			select {
+			case <-time.After(wait):
+			case <-r.Context().Done():
+			}
+		}
+		_, _ = w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	for range discovery.NewCatalog(srv.URL, "web", discovery.WithWait(time.Second)).Watch(ctx) {
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if queries > 2 {
+		t.Fatalf("%v queries without blocking", queries)
+	}
+}
+
+func TestCatalogSubSecondWait(t *testing.T) {
+	waits := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case waits <- r.URL.Query().Get("wait"):
+		default:
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		_, _ = w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	if _, _, err := discovery.NewCatalog(srv.URL, "web", discovery.WithWait(200*time.Millisecond)).Query(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if wait := <-waits; wait != "1s" {
+		t.Fatalf("a sub-second wait should be rounded up to 1s, got %q", wait)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package discovery keeps the peers of a balancer in sync with a
+// service discovery source.
+//
+// A Provider watches a source and sends the full peer list every
+// time it changes; a Syncer applies each list to a balancer by
+// adding the new peers and removing the gone ones, the unchanged
+// peers are left untouched.
+//
+// Example:
+//
+//	b := wrr.New()
+//	p := discovery.NewDNS("_http._tcp.example.com", discovery.WithSRV())
+//	go discovery.NewSyncer(b).Run(ctx, p)
+package discovery
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+)
+
+// Provider is a source of peers.
+type Provider interface {
+	// Watch sends the full peer list at first and then every time it
+	// changes, the channel is closed once ctx is done.
+	Watch(ctx context.Context) <-chan []lbapi.Peer
+}
+
+// NewSyncer makes a Syncer for b.
+func NewSyncer(b lbapi.Balancer, opts ...SyncerOpt) *Syncer {
+	s := &Syncer{lb: b, peers: make(map[string]lbapi.Peer)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// SyncerOpt is a type prototype for NewSyncer
+type SyncerOpt func(s *Syncer)
+
+// WithOnChange sets the callback for the peers added to and removed
+// from the balancer by an update.
+func WithOnChange(fn func(added, removed []lbapi.Peer)) SyncerOpt {
+	return func(s *Syncer) {
+		s.onChange = fn
+	}
+}
+
+// Syncer keeps a balancer in sync with the updates of a Provider.
+//
+// The peers are identified by String(). A peer with the same address
+// but a different weight, labels or version is replaced. The peers not added by the
+// Syncer are left alone. Each update is applied at once to a
+// balancer implementing lbapi.Updater, so that Next never sees a
+// half applied one.
+type Syncer struct {
+	lb       lbapi.Balancer
+	onChange func(added, removed []lbapi.Peer)
+	mu       sync.Mutex
+	peers    map[string]lbapi.Peer
+}
+
+// Run applies the updates of p until ctx is done.
+func (s *Syncer) Run(ctx context.Context, p Provider) {
+	for peers := range p.Watch(ctx) {
+		s.Apply(peers)
+	}
+}
+
+// Apply makes the peers of the balancer the given list.
+func (s *Syncer) Apply(peers []lbapi.Peer) (added, removed []lbapi.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[string]lbapi.Peer, len(peers))
+	for _, p := range peers {
+		wanted[p.String()] = p
+	}
+	for key, old := range s.peers {
+		if p, ok := wanted[key]; !ok || signature(p) != signature(old) {
+			delete(s.peers, key)
+			removed = append(removed, old)
+		}
+	}
+	for _, p := range peers {
+		key := p.String()
+		if _, ok := s.peers[key]; !ok {
+			s.peers[key] = p
+			added = append(added, p)
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		lbapi.Update(s.lb, added, removed)
+	}
+
+	if (len(added) > 0 || len(removed) > 0) && s.onChange != nil {
+		s.onChange(added, removed)
+	}
+	return
+}
+
+// signature is the address, weight, version and labels of a peer.
+func signature(p lbapi.Peer) string {
+	sig := p.String()
+	if w, ok := p.(lbapi.Weighted); ok {
+		sig += "/" + strconv.Itoa(w.Weight())
+	}
+	if v, ok := p.(interface{ Version() *semver.Version }); ok && v.Version() != nil {
+		sig += "@" + v.Version().String()
+	}
+	if l, ok := p.(lbapi.Labeled); ok {
+		labels := make([]string, 0, len(l.Labels()))
+		for k, v := range l.Labels() {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		sig += "{" + strings.Join(labels, ",") + "}"
+	}
+	return sig
+}
+
+// fingerprint identifies a peer list regardless of its order.
+func fingerprint(peers []lbapi.Peer) string {
+	keys := make([]string, 0, len(peers))
+	for _, p := range peers {
+		keys = append(keys, signature(p))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// poll calls fetch every interval and sends the changed lists. A
+// failed fetch is logged and the last list is kept.
+func poll(ctx context.Context, name string, interval time.Duration, fetch func(ctx context.Context) ([]lbapi.Peer, error)) <-chan []lbapi.Peer {
+	ch := make(chan []lbapi.Peer)
+	go func() {
+		defer close(ch)
+		var last string
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for first := true; ; first = false {
+			if !first {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+
+			peers, err := fetch(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Warnf("[discovery] %s: %v", name, err)
+				continue
+			}
+			if fp := fingerprint(peers); fp != last || first {
+				last = fp
+				select {
+				case ch <- peers:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
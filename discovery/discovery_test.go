@@ -0,0 +1,246 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package discovery_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb/discovery"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/wrr"
+)
+
+func names(peers []lbapi.Peer) string {
+	var s []string
+	for _, p := range peers {
+		s = append(s, p.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func TestSyncer(t *testing.T) {
+	b := wrr.New()
+	var changes int
+	s := discovery.NewSyncer(b, discovery.WithOnChange(func(added, removed []lbapi.Peer) { changes++ }))
+
+	peers, _ := discovery.ParseList([]byte("# x\na:1 3\nb:1\n\nc:1 1\n"))
+	added, removed := s.Apply(peers)
+	if names(added) != "a:1,b:1,c:1" || len(removed) != 0 || b.Count() != 3 {
+		t.Fatalf("bad first apply: %v / %v", added, removed)
+	}
+
+	peers, _ = discovery.ParseList([]byte("a:1 3\nc:1 2\nd:1"))
+	added, removed = s.Apply(peers)
+	if names(added) != "c:1,d:1" || names(removed) != "b:1,c:1" || b.Count() != 3 {
+		t.Fatalf("bad update: %v / %v", added, removed)
+	}
+	if added, removed = s.Apply(peers); len(added)+len(removed) != 0 || changes != 2 {
+		t.Fatalf("no change expected: %v / %v", added, removed)
+	}
+
+	sum := make(map[string]int)
+	for i := 0; i < 600; i++ {
+		p, _ := b.Next(lbapi.DummyFactor)
+		sum[p.String()]++
+	}
+	if sum["a:1"] != 300 || sum["c:1"] != 200 || sum["d:1"] != 100 {
+		t.Fatalf("bad distribution: %v", sum)
+	}
+
+	if _, err := discovery.ParseList([]byte("a:1 x")); err == nil {
+		t.Fatal("bad weight should fail")
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+	_ = os.WriteFile(path, []byte("a:1\nb:1\n"), 0o600)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := discovery.NewFile(path, 10*time.Millisecond).Watch(ctx)
+	if got := names(<-ch); got != "a:1,b:1" {
+		t.Fatalf("bad peers: %v", got)
+	}
+	_ = os.WriteFile(path, []byte("b:1\nc:1\n"), 0o600)
+	if got := names(<-ch); got != "b:1,c:1" {
+		t.Fatalf("bad peers: %v", got)
+	}
+	cancel()
+	for range ch {
+	}
+}
+
+// fakeDNS is a tiny in-process DNS server answering A and SRV
+// queries from a table.
+type fakeDNS struct {
+	pc  net.PacketConn
+	mu  sync.Mutex
+	a   map[string][]net.IP
+	srv map[string][]net.SRV
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDNS{pc: pc, a: make(map[string][]net.IP), srv: make(map[string][]net.SRV)}
+	t.Cleanup(func() { _ = pc.Close() })
+	go d.serve()
+	return d
+}
+
+func (d *fakeDNS) set(fn func(d *fakeDNS)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fn(d)
+}
+
+func (d *fakeDNS) resolver() *net.Resolver {
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "udp", d.pc.LocalAddr().String())
+	}}
+}
+
+func (d *fakeDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := d.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := d.answer(buf[:n]); resp != nil {
+			_, _ = d.pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (d *fakeDNS) answer(q []byte) []byte {
+	if len(q) < 12 {
+		return nil
+	}
+	var labels []string
+	i := 12
+	for i < len(q) && q[i] != 0 {
+		l := int(q[i])
+		labels = append(labels, string(q[i+1:i+1+l]))
+		i += 1 + l
+	}
+	i++ // the root label
+	qtype := binary.BigEndian.Uint16(q[i:])
+	question := q[12 : i+4]
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	var answers [][]byte
+	d.mu.Lock()
+	switch qtype {
+	case 1: // A
+		for _, ip := range d.a[name] {
+			answers = append(answers, record(1, ip.To4()))
+		}
+	case 33: // SRV
+		for _, s := range d.srv[name] {
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata, s.Priority)
+			binary.BigEndian.PutUint16(rdata[2:], s.Weight)
+			binary.BigEndian.PutUint16(rdata[4:], s.Port)
+			for _, l := range strings.Split(strings.TrimSuffix(s.Target, "."), ".") {
+				rdata = append(append(rdata, byte(len(l))), l...)
+			}
+			answers = append(answers, record(33, append(rdata, 0)))
+		}
+	}
+	d.mu.Unlock()
+
+	resp := make([]byte, 12, 512)
+	copy(resp, q[:2])                            // id
+	binary.BigEndian.PutUint16(resp[2:], 0x8580) // response, authoritative, no error
+	binary.BigEndian.PutUint16(resp[4:], 1)      // questions
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	resp = append(resp, question...)
+	for _, a := range answers {
+		resp = append(resp, a...)
+	}
+	return resp
+}
+
+func record(typ uint16, rdata []byte) []byte {
+	r := []byte{0xc0, 12} // the name of the question
+	r = binary.BigEndian.AppendUint16(r, typ)
+	r = binary.BigEndian.AppendUint16(r, 1) // IN
+	r = binary.BigEndian.AppendUint32(r, 0) // ttl
+	r = binary.BigEndian.AppendUint16(r, uint16(len(rdata)))
+	return append(r, rdata...)
+}
+
+func TestDNS(t *testing.T) {
+	d := newFakeDNS(t)
+	d.set(func(d *fakeDNS) {
+		d.a["web.test"] = []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := discovery.NewDNS("web.test.", discovery.WithPort(8080), discovery.WithResolver(d.resolver()), discovery.WithInterval(10*time.Millisecond))
+	ch := p.Watch(ctx)
+	if got := names(<-ch); got != "10.0.0.1:8080,10.0.0.2:8080" {
+		t.Fatalf("bad peers: %v", got)
+	}
+
+	d.set(func(d *fakeDNS) {
+		d.a["web.test"] = []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}
+	})
+	if got := names(<-ch); got != "10.0.0.2:8080,10.0.0.3:8080" {
+		t.Fatalf("bad peers: %v", got)
+	}
+}
+
+func TestDNS_SRV(t *testing.T) {
+	d := newFakeDNS(t)
+	d.set(func(d *fakeDNS) {
+		d.srv["_http._tcp.web.test"] = []net.SRV{
+			{Target: "a.web.test.", Port: 8001, Priority: 10, Weight: 3},
+			{Target: "b.web.test.", Port: 8002, Priority: 10, Weight: 1},
+			{Target: "backup.web.test.", Port: 8003, Priority: 20, Weight: 1},
+		}
+	})
+
+	b := wrr.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := discovery.NewDNS("_http._tcp.web.test.", discovery.WithSRV(), discovery.WithResolver(d.resolver()))
+	peers, err := p.Lookup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discovery.NewSyncer(b).Apply(peers)
+	if b.Count() != 2 {
+		t.Fatalf("only the lowest priority should be used: %v", names(peers))
+	}
+
+	sum := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		p, _ := b.Next(lbapi.DummyFactor)
+		sum[p.String()]++
+	}
+	if sum["a.web.test:8001"] != 300 || sum["b.web.test:8002"] != 100 {
+		t.Fatalf("bad distribution: %v", sum)
+	}
+
+	d.set(func(d *fakeDNS) { d.srv["_http._tcp.web.test"] = d.srv["_http._tcp.web.test"][2:] })
+	if peers, _ = p.Lookup(ctx); names(peers) != "backup.web.test:8003" {
+		t.Fatalf("the backup should come into use: %v", names(peers))
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hedzr/lb/config"
+	"github.com/hedzr/lb/lbapi"
+)
+
+// NewDNS makes a provider which resolves name every interval (30s
+// by default).
+//
+// By default name is a host whose A/AAAA records become the peers
+// "ip:port", see WithPort. With WithSRV, name is a SRV name such as
+// "_http._tcp.example.com" whose records become the weighted peers
+// "target:port"; only the records of the lowest priority are used,
+// the others are the backups which come into use once it is gone.
+func NewDNS(name string, opts ...DNSOpt) *DNS {
+	d := &DNS{name: name, port: "80", interval: 30 * time.Second, resolver: net.DefaultResolver}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// DNSOpt is a type prototype for NewDNS
+type DNSOpt func(d *DNS)
+
+// WithPort sets the port of the A/AAAA peers, "80" by default.
+func WithPort(port int) DNSOpt {
+	return func(d *DNS) {
+		d.port = strconv.Itoa(port)
+	}
+}
+
+// WithSRV looks up the SRV records instead of A/AAAA.
+func WithSRV() DNSOpt {
+	return func(d *DNS) {
+		d.srv = true
+	}
+}
+
+// WithResolver sets the resolver, net.DefaultResolver by default.
+func WithResolver(r *net.Resolver) DNSOpt {
+	return func(d *DNS) {
+		d.resolver = r
+	}
+}
+
+// WithInterval sets how often the name is resolved.
+func WithInterval(interval time.Duration) DNSOpt {
+	return func(d *DNS) {
+		d.interval = interval
+	}
+}
+
+// DNS is a DNS based provider.
+type DNS struct {
+	name     string
+	port     string
+	srv      bool
+	interval time.Duration
+	resolver *net.Resolver
+}
+
+// Watch sends the resolved peers, and again each time the records
+// are changed. A failed lookup keeps the last peers.
+func (d *DNS) Watch(ctx context.Context) <-chan []lbapi.Peer {
+	return poll(ctx, d.name, d.interval, d.Lookup)
+}
+
+// Lookup resolves the peers once.
+func (d *DNS) Lookup(ctx context.Context) (peers []lbapi.Peer, err error) {
+	if d.srv {
+		return d.lookupSRV(ctx)
+	}
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, d.name)
+	if err != nil {
+		return
+	}
+	for _, a := range addrs {
+		peers = append(peers, config.NewPeer(net.JoinHostPort(a.IP.String(), d.port), 1, nil, ""))
+	}
+	return
+}
+
+func (d *DNS) lookupSRV(ctx context.Context) (peers []lbapi.Peer, err error) {
+	_, srvs, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return
+	}
+	// LookupSRV sorts the records by priority
+	for _, s := range srvs {
+		if s.Priority != srvs[0].Priority {
+			break
+		}
+		weight := int(s.Weight)
+		if weight == 0 {
+			weight = 1 // RFC 2782: a small chance only, when all are 0
+		}
+		addr := net.JoinHostPort(strings.TrimSuffix(s.Target, "."), strconv.Itoa(int(s.Port)))
+		peers = append(peers, config.NewPeer(addr, weight, nil, ""))
+	}
+	return
+}
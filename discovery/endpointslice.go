@@ -0,0 +1,381 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hedzr/lb/config"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+)
+
+// The labels of an EndpointSlice peer.
+const (
+	LabelZone     = "zone"      // the zone of the endpoint
+	LabelForZones = "for-zones" // the zone hints, comma separated
+	LabelNode     = "node"      // the node name
+)
+
+// NewEndpointSlicesReader makes a provider which reads Kubernetes
+// EndpointSlice JSON from r, such as os.Stdin or a recorded watch.
+//
+// r is a stream of JSON values, each one of:
+//
+//   - a watch event, {"type": "ADDED|MODIFIED|DELETED", "object": {...}},
+//   - an EndpointSlice,
+//   - an EndpointSliceList, {"items": [...]}.
+//
+// A bare slice is an upsert. The ready endpoints become the peers
+// "address:port", the serving but terminating ones are removed from
+// the peers and passed to the drain callback, see WithOnDrain.
+func NewEndpointSlicesReader(r io.Reader, opts ...EndpointSliceOpt) *EndpointSlices {
+	return newEndpointSlices(func(context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(r), nil
+	}, opts)
+}
+
+// NewEndpointSlicesFile makes a provider which reads the EndpointSlice
+// JSON file at path once, see NewEndpointSlicesReader.
+func NewEndpointSlicesFile(path string, opts ...EndpointSliceOpt) *EndpointSlices {
+	return newEndpointSlices(func(context.Context) (io.ReadCloser, error) {
+		return os.Open(path)
+	}, opts)
+}
+
+// NewEndpointSlicesWatch makes a provider which follows a watch
+// endpoint over HTTP, such as
+//
+//	https://k8s/apis/discovery.k8s.io/v1/namespaces/default/endpointslices?watch=1&labelSelector=kubernetes.io%2Fservice-name%3Dweb
+//
+// Each time the stream is (re)opened, the slices are listed first,
+// without watch, and the list replaces the known slices at once: the
+// ones deleted while the stream was down are dropped, and the others
+// are never. The watch then resumes from the resourceVersion of the
+// list. The stream is reopened after the backoff once it ends.
+func NewEndpointSlicesWatch(url string, opts ...EndpointSliceOpt) *EndpointSlices {
+	var s *EndpointSlices
+	s = newEndpointSlices(func(ctx context.Context) (io.ReadCloser, error) {
+		list, err := s.get(ctx, url, "")
+		if err != nil {
+			return nil, err
+		}
+		defer list.Close()
+		data, err := io.ReadAll(list)
+		if err != nil {
+			return nil, err
+		}
+		var m sliceMessage
+		if err = json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		if m.Items == nil {
+			data = []byte(`{"items": []}`) // no slices is still a list
+		}
+
+		watch, err := s.get(ctx, url, m.Metadata.ResourceVersion)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), watch), watch}, nil
+	}, opts)
+	s.reopen = true
+	return s
+}
+
+// get lists the slices of the watch url without a resourceVersion,
+// else it watches them from the resourceVersion.
+func (s *EndpointSlices) get(ctx context.Context, watchURL, resourceVersion string) (io.ReadCloser, error) {
+	u, err := url.Parse(watchURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	if resourceVersion == "" {
+		q.Del("watch")
+	} else {
+		q.Set("watch", "1")
+		q.Set("resourceVersion", resourceVersion)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New(watchURL + ": " + resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func newEndpointSlices(open func(ctx context.Context) (io.ReadCloser, error), opts []EndpointSliceOpt) *EndpointSlices {
+	s := &EndpointSlices{open: open, client: http.DefaultClient, backoff: time.Second}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// EndpointSliceOpt is a type prototype for the EndpointSlices providers
+type EndpointSliceOpt func(s *EndpointSlices)
+
+// WithPortName picks the port by name, the first port of a slice by
+// default.
+func WithPortName(name string) EndpointSliceOpt {
+	return func(s *EndpointSlices) {
+		s.portName = name
+	}
+}
+
+// WithOnDrain sets the callback for the endpoints which start
+// terminating while still serving. They get no new traffic, the
+// callback can be used to finish their live connections.
+func WithOnDrain(fn func(peer lbapi.Peer)) EndpointSliceOpt {
+	return func(s *EndpointSlices) {
+		s.onDrain = fn
+	}
+}
+
+// WithWatchClient sets the HTTP client of NewEndpointSlicesWatch,
+// which carries the credentials of the API server.
+func WithWatchClient(client *http.Client) EndpointSliceOpt {
+	return func(s *EndpointSlices) {
+		s.client = client
+	}
+}
+
+// WithReconnect sets the pause before NewEndpointSlicesWatch reopens
+// the stream, 1 second by default.
+func WithReconnect(backoff time.Duration) EndpointSliceOpt {
+	return func(s *EndpointSlices) {
+		s.backoff = backoff
+	}
+}
+
+// EndpointSlices is a Kubernetes EndpointSlice provider.
+type EndpointSlices struct {
+	open     func(ctx context.Context) (io.ReadCloser, error)
+	reopen   bool
+	portName string
+	onDrain  func(peer lbapi.Peer)
+	client   *http.Client
+	backoff  time.Duration
+}
+
+// endpointSlice is the part of a discovery.k8s.io/v1 EndpointSlice
+// we need.
+type endpointSlice struct {
+	Metadata struct {
+		Namespace       string `json:"namespace"`
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port *int   `json:"port"`
+	} `json:"ports"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Serving     *bool `json:"serving"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		NodeName string  `json:"nodeName"`
+		Zone     *string `json:"zone"`
+		Hints    *struct {
+			ForZones []struct {
+				Name string `json:"name"`
+			} `json:"forZones"`
+		} `json:"hints"`
+	} `json:"endpoints"`
+}
+
+// sliceMessage is any one of a watch event, a slice and a list.
+type sliceMessage struct {
+	endpointSlice
+	Type   string          `json:"type"`
+	Object *endpointSlice  `json:"object"`
+	Items  []endpointSlice `json:"items"`
+}
+
+// sliceState is the known slices and the draining endpoints.
+type sliceState struct {
+	slices   map[string]*endpointSlice
+	draining map[string]bool
+}
+
+// Watch sends the ready endpoints after each change.
+func (s *EndpointSlices) Watch(ctx context.Context) <-chan []lbapi.Peer {
+	ch := make(chan []lbapi.Peer)
+	go func() {
+		defer close(ch)
+		st := &sliceState{slices: make(map[string]*endpointSlice), draining: make(map[string]bool)}
+		var last string
+		first := true
+		for {
+			err := s.read(ctx, st, func(peers []lbapi.Peer) bool {
+				if fp := fingerprint(peers); fp != last || first {
+					last, first = fp, false
+					select {
+					case ch <- peers:
+					case <-ctx.Done():
+						return false
+					}
+				}
+				return true
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logger.Warnf("[discovery] endpointslices: %v", err)
+			}
+			if !s.reopen {
+				<-ctx.Done()
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.backoff):
+			}
+		}
+	}()
+	return ch
+}
+
+func (s *EndpointSlices) read(ctx context.Context, st *sliceState, send func([]lbapi.Peer) bool) error {
+	rc, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dec := json.NewDecoder(rc)
+	for {
+		var m sliceMessage
+		if err = dec.Decode(&m); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if m.Type == "ERROR" {
+			// such as 410 Gone for a too old resourceVersion, list again
+			return errors.New("watch error")
+		}
+		st.apply(&m)
+		if !send(s.peers(st)) {
+			return nil
+		}
+	}
+}
+
+func (st *sliceState) apply(m *sliceMessage) {
+	switch {
+	case m.Object != nil:
+		if m.Type == "DELETED" {
+			delete(st.slices, m.Object.key())
+		} else if m.Type == "ADDED" || m.Type == "MODIFIED" {
+			st.slices[m.Object.key()] = m.Object
+		}
+	case m.Items != nil:
+		// a list is all the slices
+		st.slices = make(map[string]*endpointSlice, len(m.Items))
+		for i := range m.Items {
+			st.slices[m.Items[i].key()] = &m.Items[i]
+		}
+	default:
+		st.slices[m.endpointSlice.key()] = &m.endpointSlice
+	}
+}
+
+func (es *endpointSlice) key() string { return es.Metadata.Namespace + "/" + es.Metadata.Name }
+
+// peers builds the peers of the ready endpoints, and drains the
+// serving ones which start terminating.
+func (s *EndpointSlices) peers(st *sliceState) (peers []lbapi.Peer) {
+	seen := make(map[string]bool)
+	draining := make(map[string]bool)
+	for _, es := range st.slices {
+		port := -1
+		for _, p := range es.Ports {
+			if p.Port != nil && (s.portName == "" || p.Name == s.portName) {
+				port = *p.Port
+				break
+			}
+		}
+		if port < 0 {
+			continue
+		}
+
+		for _, ep := range es.Endpoints {
+			if len(ep.Addresses) == 0 {
+				continue
+			}
+			// the first address is the one to use, the others are
+			// the same endpoint
+			addr := net.JoinHostPort(ep.Addresses[0], strconv.Itoa(port))
+			if seen[addr] {
+				continue
+			}
+			c := ep.Conditions
+			ready := c.Ready == nil || *c.Ready
+			serving := ready
+			if c.Serving != nil {
+				serving = *c.Serving
+			}
+			terminating := c.Terminating != nil && *c.Terminating
+
+			labels := make(map[string]string)
+			if ep.Zone != nil {
+				labels[LabelZone] = *ep.Zone
+			}
+			if ep.Hints != nil && len(ep.Hints.ForZones) > 0 {
+				var zones []string
+				for _, z := range ep.Hints.ForZones {
+					zones = append(zones, z.Name)
+				}
+				labels[LabelForZones] = strings.Join(zones, ",")
+			}
+			if ep.NodeName != "" {
+				labels[LabelNode] = ep.NodeName
+			}
+			peer := config.NewPeer(addr, 1, labels, "")
+
+			switch {
+			case terminating && serving:
+				draining[addr] = true
+				if !st.draining[addr] && s.onDrain != nil {
+					s.onDrain(peer)
+				}
+			case ready && !terminating:
+				seen[addr] = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+	st.draining = draining
+	return
+}
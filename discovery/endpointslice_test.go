@@ -0,0 +1,165 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package discovery_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb/discovery"
+	"github.com/hedzr/lb/lbapi"
+)
+
+func TestEndpointSlicesFile(t *testing.T) {
+	var drained []string
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := discovery.NewEndpointSlicesFile("testdata/endpointslices.json",
+		discovery.WithPortName("http"),
+		discovery.WithOnDrain(func(p lbapi.Peer) { drained = append(drained, p.String()) }),
+	).Watch(ctx)
+
+	peers := <-ch
+	if names(peers) != "10.1.0.1:8080,10.1.0.4:8080" {
+		t.Fatalf("bad peers: %v", names(peers))
+	}
+	if len(drained) != 1 || drained[0] != "10.1.0.2:8080" {
+		t.Fatalf("the terminating endpoint should be drained: %v", drained)
+	}
+	for _, p := range peers {
+		labels := p.(lbapi.Labeled).Labels()
+		if p.String() == "10.1.0.1:8080" && (labels[discovery.LabelZone] != "us-east-1a" ||
+			labels[discovery.LabelForZones] != "us-east-1a" || labels[discovery.LabelNode] != "node-a") {
+			t.Fatalf("bad labels: %v", labels)
+		}
+	}
+}
+
+func TestEndpointSlicesReader(t *testing.T) {
+	data, err := os.ReadFile("testdata/endpointslices-watch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var drained []string
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := discovery.NewEndpointSlicesReader(bytes.NewReader(data),
+		discovery.WithOnDrain(func(p lbapi.Peer) { drained = append(drained, p.String()) }),
+	).Watch(ctx)
+
+	for _, want := range []string{
+		"10.1.0.1:8080,10.1.0.2:8080",
+		"10.1.0.1:8080",
+		"10.1.0.1:8080,10.1.0.3:8080",
+		"10.1.0.3:8080",
+	} {
+		if got := names(<-ch); got != want {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+	if len(drained) != 1 || drained[0] != "10.1.0.2:8080" {
+		t.Fatalf("the terminating endpoint should be drained once: %v", drained)
+	}
+}
+
+func TestEndpointSlicesWatch(t *testing.T) {
+	const a1 = `{"metadata": {"name": "a"}, "ports": [{"port": 80}], "endpoints": [{"addresses": ["10.1.0.1"]}]}`
+	lists := []string{
+		`{"metadata": {"resourceVersion": "7"}}`,
+		`{"metadata": {"resourceVersion": "7"}, "items": [` + a1 + `]}`,
+	}
+	events := []string{
+		`{"type": "ADDED", "object": ` + a1 + `}`,
+		`{"type": "MODIFIED", "object": {"metadata": {"name": "a"}, "ports": [{"port": 80}], "endpoints": [{"addresses": ["10.1.0.2"]}]}}`,
+	}
+	var mu sync.Mutex
+	var conns int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Query().Get("watch") != "1" {
+			// the list before each watch
+			conns++
+			if conns <= len(lists) {
+				_, _ = w.Write([]byte(lists[conns-1]))
+			} else {
+				http.NotFound(w, r)
+			}
+			return
+		}
+		if rv := r.URL.Query().Get("resourceVersion"); rv != "7" {
+			t.Errorf("the watch should resume from the list, got %q", rv)
+		}
+		// one event per connection, then the stream ends
+		if conns <= len(events) {
+			_, _ = w.Write([]byte(events[conns-1] + "\n"))
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := discovery.NewEndpointSlicesWatch(srv.URL+"/apis/discovery.k8s.io/v1/endpointslices?watch=1",
+		discovery.WithReconnect(10*time.Millisecond)).Watch(ctx)
+	for _, want := range []string{"", "10.1.0.1:80", "10.1.0.2:80"} {
+		if got := names(<-ch); got != want {
+			t.Fatalf("want %q, got %q", want, got)
+		}
+	}
+}
+
+// TestEndpointSlicesWatchStartOver checks the slices are listed each
+// time the stream is reopened: a slice deleted while it was down is
+// dropped, and the endpoints of the others are never.
+func TestEndpointSlicesWatchStartOver(t *testing.T) {
+	const (
+		a  = `{"metadata": {"name": "a"}, "ports": [{"port": 80}], "endpoints": [{"addresses": ["10.1.0.1"]}]}`
+		b  = `{"metadata": {"name": "b"}, "ports": [{"port": 80}], "endpoints": [{"addresses": ["10.1.0.2"]}]}`
+		b3 = `{"metadata": {"name": "b"}, "ports": [{"port": 80}], "endpoints": [{"addresses": ["10.1.0.3"]}]}`
+	)
+	streams := []struct{ list, watch string }{
+		{`{"items": [` + a + `, ` + b + `]}`, `{"type": "MODIFIED", "object": ` + b3 + `}`},
+		{`{"items": [` + a + `, ` + b3 + `]}`, ``},
+		{`{"items": [` + a + `]}`, ``},
+	}
+	var mu sync.Mutex
+	var lists, watches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Query().Get("watch") != "1" {
+			lists++
+			if lists <= len(streams) {
+				_, _ = w.Write([]byte(streams[lists-1].list))
+			} else {
+				_, _ = w.Write([]byte(streams[len(streams)-1].list))
+			}
+			return
+		}
+		watches++
+		if watches <= len(streams) {
+			_, _ = w.Write([]byte(streams[watches-1].watch + "\n"))
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := discovery.NewEndpointSlicesWatch(srv.URL, discovery.WithReconnect(10*time.Millisecond)).Watch(ctx)
+	for _, want := range []string{"10.1.0.1:80,10.1.0.2:80", "10.1.0.1:80,10.1.0.3:80", "10.1.0.1:80"} {
+		got := names(<-ch)
+		if !strings.Contains(got, "10.1.0.1:80") {
+			t.Fatalf("the endpoints of a should never be dropped, got %v", got)
+		}
+		if got != want {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hedzr/lb/config"
+	"github.com/hedzr/lb/lbapi"
+)
+
+// Static is a fixed peer list.
+type Static []lbapi.Peer
+
+// Watch sends the list once.
+func (s Static) Watch(ctx context.Context) <-chan []lbapi.Peer {
+	ch := make(chan []lbapi.Peer)
+	go func() {
+		defer close(ch)
+		select {
+		case ch <- s:
+			<-ctx.Done()
+		case <-ctx.Done():
+		}
+	}()
+	return ch
+}
+
+// NewFile makes a provider which reads the peers from a text file,
+// one "addr [weight]" per line, and polls it for changes every
+// interval. Blank lines and lines starting with "#" are ignored.
+//
+//	# backends
+//	10.0.0.1:8111 3
+//	10.0.0.2:8111
+func NewFile(path string, interval time.Duration) *File {
+	return &File{path: path, interval: interval}
+}
+
+// File is a peer list file.
+type File struct {
+	path     string
+	interval time.Duration
+}
+
+// Watch sends the peers of the file, and again each time they are
+// changed.
+func (f *File) Watch(ctx context.Context) <-chan []lbapi.Peer {
+	return poll(ctx, f.path, f.interval, func(context.Context) ([]lbapi.Peer, error) {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		return ParseList(data)
+	})
+}
+
+// ParseList parses the "addr [weight]" lines of a peer list file.
+func ParseList(data []byte) (peers []lbapi.Peer, err error) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		weight := 1
+		switch len(fields) {
+		case 1:
+		case 2:
+			if weight, err = strconv.Atoi(fields[1]); err != nil || weight < 0 {
+				return nil, fmt.Errorf("line %d: bad weight %q", line, fields[1])
+			}
+		default:
+			return nil, fmt.Errorf("line %d: want \"addr [weight]\"", line)
+		}
+		peers = append(peers, config.NewPeer(fields[0], weight, nil, ""))
+	}
+	return peers, sc.Err()
+}
@@ -7,7 +7,10 @@ import (
 	"hash/crc32"
 	"sort"
 	"sync"
+	"sync/atomic"
 
+	"github.com/hedzr/lb/internal/observer"
+	"github.com/hedzr/lb/internal/peerset"
 	"github.com/hedzr/lb/lbapi"
 )
 
@@ -16,8 +19,6 @@ func New(opts ...lbapi.Opt) lbapi.Balancer {
 	return (&hashS{
 		hasher:  crc32.ChecksumIEEE,
 		replica: 32,
-		keys:    make(map[uint32]lbapi.Peer),
-		peers:   make(map[lbapi.Peer]bool),
 	}).init(opts...)
 }
 
@@ -48,12 +49,31 @@ type Hasher func(data []byte) uint32
 type hashS struct {
 	hasher   Hasher
 	replica  int
-	hashRing []uint32
-	keys     map[uint32]lbapi.Peer
-	peers    map[lbapi.Peer]bool
-	rw       sync.RWMutex
+	ring     atomic.Pointer[ring]
+	index    peerset.Index[*member]
+	mu       sync.Mutex // for the writers of ring and index
+	counting atomic.Bool
+	obs      observer.Set
 }
 
+// ring is immutable, a writer publishes a modified copy.
+type ring struct {
+	nodes   []vnode // sorted by hash
+	members []*member
+}
+
+type member struct {
+	peer  lbapi.Peer
+	picks int64
+}
+
+type vnode struct {
+	hash uint32
+	m    *member
+}
+
+var emptyRing = &ring{}
+
 func (s *hashS) init(opts ...lbapi.Opt) *hashS {
 	for _, opt := range opts {
 		opt(s)
@@ -61,6 +81,13 @@ func (s *hashS) init(opts ...lbapi.Opt) *hashS {
 	return s
 }
 
+func (s *hashS) load() *ring {
+	if r := s.ring.Load(); r != nil {
+		return r
+	}
+	return emptyRing
+}
+
 func (s *hashS) Next(factor lbapi.Factor) (next lbapi.Peer, c lbapi.Constrainable) {
 	var hash uint32
 	if h, ok := factor.(lbapi.FactorHashable); ok {
@@ -76,96 +103,166 @@ func (s *hashS) Next(factor lbapi.Factor) (next lbapi.Peer, c lbapi.Constrainabl
 		} else if nested, ok := next.(lbapi.BalancerLite); ok {
 			next, c = nested.Next(factor)
 		}
+		if next != nil && s.obs.Active() {
+			s.obs.Emit(lbapi.Event{Type: lbapi.Picked, Peer: next, Factor: factor, Constraint: c})
+		}
 	}
 
 	return
 }
 
+// Subscribe implements lbapi.Observable.
+func (s *hashS) Subscribe(fn lbapi.Observer) (unsubscribe func()) { return s.obs.Subscribe(fn) }
+
 func (s *hashS) miniNext(hash uint32) (next lbapi.Peer) {
-	s.rw.RLock()
-	defer s.rw.RUnlock()
+	nodes := s.load().nodes
+	if len(nodes) == 0 {
+		return
+	}
 
-	ix := sort.Search(len(s.hashRing), func(i int) bool {
-		return s.hashRing[i] >= hash
+	ix := sort.Search(len(nodes), func(i int) bool {
+		return nodes[i].hash >= hash
 	})
 
-	if ix == len(s.hashRing) {
+	if ix == len(nodes) {
 		ix = 0
 	}
 
-	hashValue := s.hashRing[ix]
-	if p, ok := s.keys[hashValue]; ok {
-		if _, ok = s.peers[p]; ok {
-			next = p
-		}
+	m := nodes[ix].m
+	if s.counting.Load() {
+		atomic.AddInt64(&m.picks, 1)
 	}
+	return m.peer
+}
 
+// CountPicks implements lbapi.PickCounter.
+func (s *hashS) CountPicks(on bool) { s.counting.Store(on) }
+
+// Peers implements lbapi.PeerLister, the peers are sorted by
+// String() as a ring keeps no order.
+func (s *hashS) Peers() (peers []lbapi.Peer) {
+	for _, m := range sortedMembers(s.load()) {
+		peers = append(peers, m.peer)
+	}
+	return
+}
+
+func sortedMembers(r *ring) []*member {
+	members := append([]*member(nil), r.members...)
+	sort.Slice(members, func(i, j int) bool { return members[i].peer.String() < members[j].peer.String() })
+	return members
+}
+
+// Inspect implements lbapi.Inspectable, the peers are sorted as
+// Peers does.
+func (s *hashS) Inspect() (snapshot lbapi.Snapshot) {
+	r := s.load()
+	vnodes := make(map[*member]int)
+	for _, n := range r.nodes {
+		vnodes[n.m]++
+	}
+	snapshot.Algorithm = "consistent-hash"
+	snapshot.RingSize = len(r.nodes)
+	for _, m := range sortedMembers(r) {
+		ps := lbapi.PeerState{Peer: m.peer, Picks: atomic.LoadInt64(&m.picks), VirtualNodes: vnodes[m], Children: lbapi.Children(m.peer)}
+		snapshot.Peers = append(snapshot.Peers, ps)
+		snapshot.Picks += ps.Picks
+	}
 	return
 }
 
 func (s *hashS) Count() int {
-	s.rw.RLock()
-	defer s.rw.RUnlock()
-	return len(s.peers)
+	return len(s.load().members)
 }
 
 func (s *hashS) Add(peers ...lbapi.Peer) {
-	s.rw.Lock()
-	defer s.rw.Unlock()
-
-	for _, p := range peers {
-		s.peers[p] = true
-		for i := 0; i < s.replica; i++ {
-			hash := s.hasher(s.peerToBinaryID(p, i))
-			s.hashRing = append(s.hashRing, hash)
-			s.keys[hash] = p
-		}
-	}
+	s.Update(peers, nil)
+}
 
-	sort.Slice(s.hashRing, func(i, j int) bool {
-		return s.hashRing[i] < s.hashRing[j]
-	})
+// Update implements lbapi.Updater, the ring is sorted once.
+func (s *hashS) Update(add, remove []lbapi.Peer) {
+	s.obs.Changed(s.update(func(members []*member, mk func(lbapi.Peer) *member) ([]*member, []lbapi.Peer, []lbapi.Peer) {
+		return s.index.Update(members, add, remove, mk)
+	}))
 }
 
-func (s *hashS) peerToBinaryID(p lbapi.Peer, replica int) []byte {
-	str := fmt.Sprintf("%v-%05d", p, replica)
-	return []byte(str)
+// Replace implements lbapi.Updater, the ring is sorted once.
+func (s *hashS) Replace(peers ...lbapi.Peer) {
+	s.obs.Changed(s.update(func(members []*member, mk func(lbapi.Peer) *member) ([]*member, []lbapi.Peer, []lbapi.Peer) {
+		return s.index.Replace(members, peers, mk)
+	}))
 }
 
-func (s *hashS) Remove(peer lbapi.Peer) {
-	s.rw.Lock()
-	defer s.rw.Unlock()
+// update applies a change of the members made by fn, and publishes
+// the new ring. The virtual nodes of the kept members are kept, the
+// new ones are merged in.
+func (s *hashS) update(fn func(members []*member, mk func(lbapi.Peer) *member) ([]*member, []lbapi.Peer, []lbapi.Peer)) (added, removed []lbapi.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if _, ok := s.peers[peer]; ok {
-		delete(s.peers, peer)
+	var nodes []vnode
+	mk := func(p lbapi.Peer) *member {
+		m := &member{peer: p}
+		for i := 0; i < s.replica; i++ {
+			nodes = append(nodes, vnode{hash: s.hasher(s.peerToBinaryID(p, i)), m: m})
+		}
+		return m
 	}
 
-	var keys []uint32
-	var km = make(map[uint32]bool)
-	for i, p := range s.keys {
-		if p == peer {
-			keys = append(keys, i)
-			km[i] = true
-		}
+	old := s.load()
+	members, added, removed := fn(old.members, mk)
+	if added == nil && removed == nil {
+		return
 	}
 
-	for _, key := range keys {
-		delete(s.keys, key)
+	kept := old.nodes
+	if removed != nil {
+		live := make(map[*member]bool, len(members))
+		for _, m := range members {
+			live[m] = true
+		}
+		kept = make([]vnode, 0, len(old.nodes))
+		for _, n := range old.nodes {
+			if live[n.m] {
+				kept = append(kept, n)
+			}
+		}
 	}
 
-	var vn []uint32
-	for _, x := range s.hashRing {
-		if _, ok := km[x]; !ok {
-			vn = append(vn, x)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].hash < nodes[j].hash
+	})
+	s.ring.Store(&ring{nodes: merge(kept, nodes), members: members})
+	return
+}
+
+// merge merges two sorted rings into a new one, a hash collision
+// is kept by the node of a.
+func merge(a, b []vnode) []vnode {
+	nodes := make([]vnode, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].hash < a[0].hash {
+			nodes, b = append(nodes, b[0]), b[1:]
+		} else {
+			nodes, a = append(nodes, a[0]), a[1:]
 		}
 	}
-	s.hashRing = vn
+	return append(append(nodes, a...), b...)
+}
+
+func (s *hashS) peerToBinaryID(p lbapi.Peer, replica int) []byte {
+	str := fmt.Sprintf("%v-%05d", p, replica)
+	return []byte(str)
+}
+
+func (s *hashS) Remove(peer lbapi.Peer) {
+	s.Update(nil, []lbapi.Peer{peer})
 }
 
 func (s *hashS) Clear() {
-	s.rw.Lock()
-	defer s.rw.Unlock()
-	s.hashRing = nil
-	s.keys = make(map[uint32]lbapi.Peer)
-	s.peers = make(map[lbapi.Peer]bool)
+	s.mu.Lock()
+	s.index.Clear()
+	s.ring.Store(emptyRing)
+	s.mu.Unlock()
+	s.obs.Emit(lbapi.Event{Type: lbapi.Cleared})
 }
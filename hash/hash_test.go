@@ -4,6 +4,7 @@ package hash_test
 
 import (
 	"hash/crc32"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -140,3 +141,51 @@ func TestHash2(t *testing.T) {
 
 	lb.Clear()
 }
+
+func TestHash_Events(t *testing.T) {
+	lb := hash.New()
+	counts := make(map[lbapi.EventType]int)
+	lb.(lbapi.Observable).Subscribe(func(e lbapi.Event) { counts[e.Type]++ })
+
+	lb.Add(exP("172.16.0.7:3500"), exP("172.16.0.8:3500"))
+	lb.Add(exP("172.16.0.8:3500"))
+	for _, f := range factors {
+		lb.Next(f)
+	}
+	lb.Remove(exP("172.16.0.7:3500"))
+	lb.Remove(exP("172.16.0.9:3500"))
+
+	if counts[lbapi.PeerAdded] != 2 || counts[lbapi.Picked] != len(factors) || counts[lbapi.PeerRemoved] != 1 {
+		t.Fatalf("bad events: %v", counts)
+	}
+}
+
+func TestHash_Inspect(t *testing.T) {
+	lb := hash.New(hash.WithReplica(8), lbapi.WithPickCounts())
+	lb.Add(exP("172.16.0.9:3500"), exP("172.16.0.7:3500"))
+	for _, f := range factors {
+		lb.Next(f)
+	}
+
+	s := lb.(lbapi.Inspectable).Inspect()
+	if s.Algorithm != "consistent-hash" || s.RingSize != 16 || s.Picks != int64(len(factors)) {
+		t.Fatalf("bad snapshot: %+v", s)
+	}
+	if s.Peers[0].Peer != exP("172.16.0.7:3500") || s.Peers[0].VirtualNodes != 8 || s.Peers[1].VirtualNodes != 8 {
+		t.Fatalf("bad peer states: %+v", s.Peers)
+	}
+}
+
+func BenchmarkHash_Next(b *testing.B) {
+	lb := hash.New()
+	for i := 0; i < 16; i++ {
+		lb.Add(exP("172.16.0." + strconv.Itoa(i) + ":3500"))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lb.Next(factors[1])
+		}
+	})
+}
@@ -0,0 +1,304 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package health ejects the failing peers of a balancer passively,
+// from the outcome of the requests sent to them.
+//
+// The outcomes come through lbapi.FeedbackAware, which proxy.New,
+// transport.New and the like call for each request. A peer failing
+// a number of times in a row is ejected for a cooldown, then it is
+// given traffic again and ejected at once if the next request fails
+// too. The health transitions are sent as lbapi.HealthChanged events.
+//
+// Example:
+//
+//	b := health.New(rr.New(lb.WithPeers(peers...)), health.WithThreshold(3))
+//	b.Subscribe(func(e lbapi.Event) {
+//	    if e.Type == lbapi.HealthChanged {
+//	        log.Printf("%v healthy: %v", e.Peer, e.Healthy)
+//	    }
+//	})
+//	p := proxy.New(b)
+package health
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hedzr/lb/internal/observer"
+	"github.com/hedzr/lb/lbapi"
+)
+
+// New wraps b with passive health checking.
+func New(b lbapi.Balancer, opts ...Opt) *Balancer {
+	s := &Balancer{
+		Balancer:  b,
+		threshold: 5,
+		cooldown:  30 * time.Second,
+		now:       time.Now,
+		peers:     make(map[string]*state),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Opt is a type prototype for New Balancer
+type Opt func(s *Balancer)
+
+// WithThreshold sets how many failures in a row eject a peer, 5
+// by default.
+func WithThreshold(n int) Opt {
+	return func(s *Balancer) {
+		s.threshold = n
+	}
+}
+
+// WithCooldown sets how long an ejected peer gets no traffic, 30
+// seconds by default.
+func WithCooldown(d time.Duration) Opt {
+	return func(s *Balancer) {
+		s.cooldown = d
+	}
+}
+
+// WithClock sets the clock, time.Now by default.
+func WithClock(now func() time.Time) Opt {
+	return func(s *Balancer) {
+		s.now = now
+	}
+}
+
+// Balancer is a balancer which skips the unhealthy peers. It is an
+// lbapi.HealthAware, lbapi.FeedbackAware and lbapi.Observable.
+type Balancer struct {
+	lbapi.Balancer
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	peers map[string]*state
+	obs   observer.Set
+}
+
+type state struct {
+	failures int
+	ejected  bool
+	until    time.Time // zero for a peer set unhealthy by SetHealthy
+}
+
+// Next picks the next healthy peer. If all peers are unhealthy, the
+// picks are not filtered, so that traffic still flows somewhere. An
+// ejected peer picked once its cooldown is over is on probation.
+func (s *Balancer) Next(factor lbapi.Factor) (next lbapi.Peer, c lbapi.Constrainable) {
+	var first lbapi.Peer
+	var firstC lbapi.Constrainable
+	for i, n := 0, s.Count(); i < n || i == 0; i++ {
+		if next, c = s.Balancer.Next(factor); next == nil {
+			return
+		}
+		if s.admit(next) {
+			return
+		}
+		if first == nil {
+			first, firstC = next, c
+		}
+	}
+	return first, firstC
+}
+
+// Healthy implements lbapi.HealthAware. An ejected peer is healthy
+// once its cooldown is over. It changes no state: the peer is put
+// on probation by Next or Feedback.
+func (s *Balancer) Healthy(peer lbapi.Peer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.peers[peer.String()]
+	return st == nil || !st.ejected || s.expired(st)
+}
+
+// State is the health of a peer, see Balancer.State.
+type State struct {
+	// Healthy is what Healthy returns.
+	Healthy bool
+	// Failures is the number of failures in a row.
+	Failures int
+	// Until is when the ejection of an unhealthy peer ends, it's zero
+	// for a peer set unhealthy by SetHealthy.
+	Until time.Time
+}
+
+// State returns the health of peer. Like Healthy, it changes no
+// state, so it suits a read-only view such as the admin API.
+func (s *Balancer) State(peer lbapi.Peer) State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.peers[peer.String()]
+	if st == nil {
+		return State{Healthy: true}
+	}
+	if !st.ejected || s.expired(st) {
+		return State{Healthy: true, Failures: st.failures}
+	}
+	return State{Failures: st.failures, Until: st.until}
+}
+
+// admit tells whether peer is healthy as Healthy does, and puts an
+// ejected one on probation once its cooldown is over.
+func (s *Balancer) admit(peer lbapi.Peer) bool {
+	s.mu.Lock()
+	st := s.peers[peer.String()]
+	probation := st != nil && s.probation(st)
+	healthy := st == nil || !st.ejected
+	s.mu.Unlock()
+
+	if probation {
+		s.emit(peer, true)
+	}
+	return healthy
+}
+
+func (s *Balancer) expired(st *state) bool {
+	return st.ejected && !st.until.IsZero() && !s.now().Before(st.until)
+}
+
+// probation puts an ejected peer whose cooldown is over on
+// probation, where the next failure ejects it again.
+func (s *Balancer) probation(st *state) bool {
+	if !s.expired(st) {
+		return false
+	}
+	st.ejected, st.failures = false, s.threshold-1
+	return true
+}
+
+// Feedback implements lbapi.FeedbackAware, and passes the outcome
+// on to the wrapped balancer.
+func (s *Balancer) Feedback(peer lbapi.Peer, latency time.Duration, err error) {
+	if fa, ok := s.Balancer.(lbapi.FeedbackAware); ok {
+		fa.Feedback(peer, latency, err)
+	}
+
+	s.mu.Lock()
+	st := s.state(peer)
+	probation := s.probation(st)
+	changed := false
+	if err == nil {
+		st.failures = 0
+		if st.ejected && !st.until.IsZero() {
+			st.ejected, changed = false, true
+		}
+	} else if st.failures++; !st.ejected && st.failures >= s.threshold {
+		st.ejected, st.until, changed = true, s.now().Add(s.cooldown), true
+	}
+	healthy := !st.ejected
+	s.mu.Unlock()
+
+	if probation {
+		s.emit(peer, true)
+	}
+	if changed {
+		s.emit(peer, healthy)
+	}
+}
+
+// SetHealthy marks a peer healthy or unhealthy by hand, such as by
+// an active health checker or an operator. A peer set unhealthy is
+// ejected until it is set healthy again.
+func (s *Balancer) SetHealthy(peer lbapi.Peer, healthy bool) {
+	s.mu.Lock()
+	st := s.state(peer)
+	changed := st.ejected == healthy
+	st.ejected, st.failures, st.until = !healthy, 0, time.Time{}
+	s.mu.Unlock()
+
+	if changed {
+		s.emit(peer, healthy)
+	}
+}
+
+func (s *Balancer) state(peer lbapi.Peer) *state {
+	st := s.peers[peer.String()]
+	if st == nil {
+		st = new(state)
+		s.peers[peer.String()] = st
+	}
+	return st
+}
+
+func (s *Balancer) emit(peer lbapi.Peer, healthy bool) {
+	s.obs.Emit(lbapi.Event{Type: lbapi.HealthChanged, Peer: peer, Healthy: healthy, Time: s.now()})
+}
+
+// Subscribe implements lbapi.Observable, the observer gets the
+// events of the wrapped balancer too.
+func (s *Balancer) Subscribe(fn lbapi.Observer) (unsubscribe func()) {
+	cancel := s.obs.Subscribe(fn)
+	if o, ok := s.Balancer.(lbapi.Observable); ok {
+		inner := o.Subscribe(fn)
+		return func() { cancel(); inner() }
+	}
+	return cancel
+}
+
+// Unwrap implements lbapi.Wrapper.
+func (s *Balancer) Unwrap() lbapi.Balancer { return s.Balancer }
+
+// Acquire implements lbapi.ConnAware for the wrapped balancer.
+func (s *Balancer) Acquire(peer lbapi.Peer) {
+	if ca, ok := s.Balancer.(lbapi.ConnAware); ok {
+		ca.Acquire(peer)
+	}
+}
+
+// Release implements lbapi.ConnAware for the wrapped balancer.
+func (s *Balancer) Release(peer lbapi.Peer) {
+	if ca, ok := s.Balancer.(lbapi.ConnAware); ok {
+		ca.Release(peer)
+	}
+}
+
+// Remove removes a peer and forgets its health.
+func (s *Balancer) Remove(peer lbapi.Peer) {
+	s.Balancer.Remove(peer)
+	s.mu.Lock()
+	delete(s.peers, peer.String())
+	s.mu.Unlock()
+}
+
+// Update implements lbapi.Updater, the removed peers are
+// forgotten.
+func (s *Balancer) Update(add, remove []lbapi.Peer) {
+	lbapi.Update(s.Balancer, add, remove)
+	s.mu.Lock()
+	for _, p := range remove {
+		delete(s.peers, p.String())
+	}
+	s.mu.Unlock()
+}
+
+// Replace implements lbapi.Updater, the peers not in peers are
+// forgotten.
+func (s *Balancer) Replace(peers ...lbapi.Peer) {
+	lbapi.Replace(s.Balancer, peers...)
+	wanted := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		wanted[p.String()] = true
+	}
+	s.mu.Lock()
+	for key := range s.peers {
+		if !wanted[key] {
+			delete(s.peers, key)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// Clear removes all peers and forgets their health.
+func (s *Balancer) Clear() {
+	s.Balancer.Clear()
+	s.mu.Lock()
+	s.peers = make(map[string]*state)
+	s.mu.Unlock()
+}
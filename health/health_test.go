@@ -0,0 +1,119 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package health_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb/health"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/rr"
+)
+
+type exP string
+
+func (s exP) String() string { return string(s) }
+
+func TestEjection(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := health.New(rr.New(), health.WithThreshold(2), health.WithCooldown(10*time.Second),
+		health.WithClock(func() time.Time { return now }))
+	b.Add(exP("a"), exP("b"))
+
+	var events []string
+	b.Subscribe(func(e lbapi.Event) {
+		if e.Type == lbapi.HealthChanged {
+			events = append(events, fmt.Sprintf("%v:%v", e.Peer, e.Healthy))
+		}
+	})
+
+	boom := errors.New("boom")
+	b.Feedback(exP("a"), time.Millisecond, boom)
+	if !b.Healthy(exP("a")) {
+		t.Fatal("one failure should not eject")
+	}
+	b.Feedback(exP("a"), time.Millisecond, boom)
+	if b.Healthy(exP("a")) {
+		t.Fatal("two failures should eject")
+	}
+	if st := b.State(exP("a")); st.Healthy || st.Failures != 2 || !st.Until.Equal(now.Add(10*time.Second)) {
+		t.Fatalf("bad state: %+v", st)
+	}
+	for i := 0; i < 10; i++ {
+		if p, _ := b.Next(lbapi.DummyFactor); p.String() != "b" {
+			t.Fatalf("the ejected peer is picked")
+		}
+	}
+
+	// after the cooldown, a single failure ejects it again
+	now = now.Add(10 * time.Second)
+	if !b.Healthy(exP("a")) || !b.Healthy(exP("a")) {
+		t.Fatal("the cooldown is over")
+	}
+	if len(events) != 1 {
+		t.Fatalf("Healthy should not change the health: %v", events)
+	}
+	b.Feedback(exP("a"), time.Millisecond, boom)
+	if b.Healthy(exP("a")) {
+		t.Fatal("a failure on probation should eject")
+	}
+	now = now.Add(10 * time.Second)
+	b.Feedback(exP("a"), time.Millisecond, nil)
+
+	if got := strings.Join(events, ","); got != "a:false,a:true,a:false,a:true" {
+		t.Fatalf("bad health events: %v", got)
+	}
+}
+
+func TestProbation(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := health.New(rr.New(), health.WithThreshold(1), health.WithCooldown(10*time.Second),
+		health.WithClock(func() time.Time { return now }))
+	b.Add(exP("a"))
+	var events []string
+	b.Subscribe(func(e lbapi.Event) {
+		if e.Type == lbapi.HealthChanged {
+			events = append(events, fmt.Sprintf("%v:%v", e.Peer, e.Healthy))
+		}
+	})
+
+	b.Feedback(exP("a"), time.Millisecond, errors.New("boom"))
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 2; i++ {
+		if p, _ := b.Next(lbapi.DummyFactor); p == nil || p.String() != "a" {
+			t.Fatalf("bad pick: %v", p)
+		}
+	}
+	if got := strings.Join(events, ","); got != "a:false,a:true" {
+		t.Fatalf("the pick should put the peer on probation once: %v", got)
+	}
+}
+
+func TestSetHealthy(t *testing.T) {
+	b := health.New(rr.New(), health.WithCooldown(time.Nanosecond))
+	b.Add(exP("a"), exP("b"))
+
+	b.SetHealthy(exP("a"), false)
+	time.Sleep(time.Millisecond)
+	b.Feedback(exP("a"), time.Millisecond, nil)
+	if b.Healthy(exP("a")) {
+		t.Fatal("a peer set unhealthy stays ejected")
+	}
+
+	// all unhealthy: the picks are not filtered
+	b.SetHealthy(exP("b"), false)
+	if p, _ := b.Next(lbapi.DummyFactor); p == nil {
+		t.Fatal("want a peer anyway")
+	}
+
+	b.SetHealthy(exP("a"), true)
+	b.Remove(exP("b"))
+	b.Add(exP("b"))
+	if !b.Healthy(exP("a")) || !b.Healthy(exP("b")) {
+		t.Fatal("a removed peer should be forgotten")
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package httpfactor builds lbapi.Factor values from an incoming
+// *http.Request, so that consistent hashing, sticky routing and
+// the versioning router can be driven by real request data.
+//
+// Example:
+//
+//	ext := httpfactor.First(
+//	    httpfactor.Cookie("uid"),
+//	    httpfactor.ClientIP("10.0.0.0/8"),
+//	)
+//	b := hash.New(lb.WithPeers(peers...))
+//	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+//	    peer, _ := b.Next(ext.Factor(r))
+//	    ...
+//	})
+package httpfactor
+
+import (
+	"hash/crc32"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/hedzr/lb/lbapi"
+)
+
+// Extractor picks a key out of a request. ok is false if the
+// request does not carry the information the extractor looks for.
+type Extractor func(r *http.Request) (key string, ok bool)
+
+// Factor extracts the key from r and wraps it as a hashable
+// factor. A request without the key yields an empty factor,
+// which is still valid for every stock balancer.
+func (e Extractor) Factor(r *http.Request) lbapi.FactorHashable {
+	key, _ := e(r)
+	return New(key)
+}
+
+// New wraps a key string as a lbapi.FactorHashable. The hash
+// code is crc32.ChecksumIEEE, the default hasher of hash.New.
+func New(key string) lbapi.FactorHashable {
+	return &factorS{key: key, code: crc32.ChecksumIEEE([]byte(key))}
+}
+
+type factorS struct {
+	key  string
+	code uint32
+}
+
+func (f *factorS) Factor() string   { return f.key }
+func (f *factorS) String() string   { return f.key }
+func (f *factorS) HashCode() uint32 { return f.code }
+
+// Header extracts the value of the named request header.
+func Header(name string) Extractor {
+	return func(r *http.Request) (key string, ok bool) {
+		key = r.Header.Get(name)
+		return key, key != ""
+	}
+}
+
+// Cookie extracts the value of the named cookie.
+func Cookie(name string) Extractor {
+	return func(r *http.Request) (key string, ok bool) {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			return c.Value, true
+		}
+		return
+	}
+}
+
+// Path extracts the URL path of a request.
+func Path() Extractor {
+	return func(r *http.Request) (key string, ok bool) {
+		if r.URL == nil {
+			return
+		}
+		return r.URL.Path, true
+	}
+}
+
+// Query extracts the value of the named query parameter.
+func Query(name string) Extractor {
+	return func(r *http.Request) (key string, ok bool) {
+		if r.URL == nil {
+			return
+		}
+		key = r.URL.Query().Get(name)
+		return key, key != ""
+	}
+}
+
+// AcceptParam extracts a parameter of the media types in the Accept
+// header, such as the version of
+// "application/vnd.acme+json;version=2.1". The first media type
+// carrying the parameter wins.
+func AcceptParam(name string) Extractor {
+	return func(r *http.Request) (key string, ok bool) {
+		for _, accept := range r.Header.Values("Accept") {
+			for _, mt := range strings.Split(accept, ",") {
+				if _, params, err := mime.ParseMediaType(mt); err == nil && params[name] != "" {
+					return params[name], true
+				}
+			}
+		}
+		return
+	}
+}
+
+// ClientIP extracts the client address of a request.
+//
+// trusted is a list of proxies (IPs or CIDRs) which are allowed to
+// append to X-Forwarded-For. The chain is walked from right to
+// left starting at the direct peer, and the first address which is
+// not a trusted proxy is the client. With no trusted proxies the
+// header is ignored and the direct peer (r.RemoteAddr) is used,
+// so that a client cannot spoof its identity.
+func ClientIP(trusted ...string) Extractor {
+	var nets []*net.IPNet
+	for _, t := range trusted {
+		if !strings.Contains(t, "/") {
+			if strings.Contains(t, ":") {
+				t += "/128"
+			} else {
+				t += "/32"
+			}
+		}
+		if _, n, err := net.ParseCIDR(t); err == nil {
+			nets = append(nets, n)
+		}
+	}
+
+	isTrusted := func(ip net.IP) bool {
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) (key string, ok bool) {
+		remote := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			remote = host
+		}
+		ip := net.ParseIP(remote)
+		if ip == nil {
+			return remote, remote != ""
+		}
+
+		if isTrusted(ip) {
+			hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop := net.ParseIP(strings.TrimSpace(hops[i]))
+				if hop == nil {
+					break
+				}
+				ip = hop
+				if !isTrusted(hop) {
+					break
+				}
+			}
+		}
+		return ip.String(), true
+	}
+}
+
+// First tries the extractors in order and returns the first key
+// found.
+func First(extractors ...Extractor) Extractor {
+	return func(r *http.Request) (key string, ok bool) {
+		for _, e := range extractors {
+			if key, ok = e(r); ok {
+				return
+			}
+		}
+		return
+	}
+}
+
+// Composite joins the keys of all extractors with sep. ok is true
+// if at least one extractor found its key; missing keys are left
+// empty so that the position of each part stays stable.
+func Composite(sep string, extractors ...Extractor) Extractor {
+	return func(r *http.Request) (key string, ok bool) {
+		parts := make([]string, len(extractors))
+		for i, e := range extractors {
+			if k, found := e(r); found {
+				parts[i], ok = k, true
+			}
+		}
+		return strings.Join(parts, sep), ok
+	}
+}
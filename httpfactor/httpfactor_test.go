@@ -0,0 +1,91 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package httpfactor_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hedzr/lb/hash"
+	"github.com/hedzr/lb/httpfactor"
+)
+
+type exP string
+
+func (s exP) String() string { return string(s) }
+
+func TestClientIP(t *testing.T) {
+	for _, c := range []struct {
+		remote  string
+		xff     string
+		trusted []string
+		want    string
+	}{
+		{"1.2.3.4:5678", "", nil, "1.2.3.4"},
+		{"1.2.3.4:5678", "9.9.9.9", nil, "1.2.3.4"},
+		{"10.0.0.1:5678", "9.9.9.9, 8.8.8.8", []string{"10.0.0.0/8"}, "8.8.8.8"},
+		{"10.0.0.1:5678", "9.9.9.9, 10.0.0.2", []string{"10.0.0.0/8"}, "9.9.9.9"},
+		{"10.0.0.1:5678", "10.0.0.3, 10.0.0.2", []string{"10.0.0.0/8"}, "10.0.0.3"},
+		{"10.0.0.1:5678", "", []string{"10.0.0.1"}, "10.0.0.1"},
+		{"[::1]:80", "2001:db8::1", []string{"::1"}, "2001:db8::1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if got, _ := httpfactor.ClientIP(c.trusted...)(r); got != c.want {
+			t.Errorf("ClientIP(%v) for %q/%q: got %q, want %q", c.trusted, c.remote, c.xff, got, c.want)
+		}
+	}
+}
+
+func TestExtractors(t *testing.T) {
+	r := httptest.NewRequest("GET", "/shop/item/1?tenant=acme", nil)
+	r.Header.Set("X-User", "u1")
+	r.Header.Set("Accept", "text/html, application/vnd.acme+json; version=2.1; q=0.9")
+	r.AddCookie(&http.Cookie{Name: "sid", Value: "s1"})
+
+	for _, c := range []struct {
+		e    httpfactor.Extractor
+		want string
+		ok   bool
+	}{
+		{httpfactor.Header("X-User"), "u1", true},
+		{httpfactor.Header("X-None"), "", false},
+		{httpfactor.Cookie("sid"), "s1", true},
+		{httpfactor.Cookie("none"), "", false},
+		{httpfactor.Path(), "/shop/item/1", true},
+		{httpfactor.Query("tenant"), "acme", true},
+		{httpfactor.AcceptParam("version"), "2.1", true},
+		{httpfactor.AcceptParam("charset"), "", false},
+		{httpfactor.First(httpfactor.Cookie("none"), httpfactor.Header("X-User")), "u1", true},
+		{httpfactor.Composite("|", httpfactor.Query("tenant"), httpfactor.Header("X-None"), httpfactor.Cookie("sid")), "acme||s1", true},
+		{httpfactor.Composite("|", httpfactor.Header("X-None")), "", false},
+	} {
+		if got, ok := c.e(r); got != c.want || ok != c.ok {
+			t.Errorf("got (%q, %v), want (%q, %v)", got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestFactorWithHash(t *testing.T) {
+	b := hash.New()
+	b.Add(exP("172.16.0.7:3500"), exP("172.16.0.8:3500"), exP("172.16.0.9:3500"))
+
+	ext := httpfactor.Header("X-User")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", "u1")
+
+	first, _ := b.Next(ext.Factor(r))
+	for i := 0; i < 10; i++ {
+		if p, _ := b.Next(ext.Factor(r)); p != first {
+			t.Fatalf("same key should stick to %v, but got %v", first, p)
+		}
+	}
+
+	if f := ext.Factor(r); f.Factor() != "u1" || f.HashCode() != httpfactor.New("u1").HashCode() {
+		t.Fatalf("bad factor: %v/%v", f.Factor(), f.HashCode())
+	}
+}
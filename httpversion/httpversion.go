@@ -0,0 +1,233 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package httpversion routes HTTP requests by the API version the
+// client asks for.
+//
+// The requested version is read from a header, a query parameter
+// or a parameter of the Accept media type, and matched against a
+// list of version constraints in order. The first satisfied
+// constraint picks its backends out of a version.BackendsFactor,
+// that is the backends whose Version() satisfies it, balanced by
+// the sub-balancer of the BackendsFactor.
+//
+// Example:
+//
+//	bf := version.NewBackendsFactor(rr.New)
+//	bf.AddPeers(
+//	    version.NewBackendFactor("1.4", "http://10.0.0.1:8111"),
+//	    version.NewBackendFactor("2.1", "http://10.0.0.2:8111"),
+//	)
+//	rt := httpversion.New(bf,
+//	    httpversion.WithConstraints(
+//	        version.NewConstrainablePeer("^1.x", 1),
+//	        version.NewConstrainablePeer("^2.x", 1),
+//	    ),
+//	    httpversion.WithDefault("1.0"),
+//	)
+//	http.Handle("/", rt.Guard(proxy.New(rt, proxy.WithExtractor(rt.Extractor()))))
+//
+// Guard answers the requests for a malformed or unsupported version
+// itself, with 400 Bad Request or 406 Not Acceptable, rather than
+// letting the proxy answer 502 Bad Gateway for no peer.
+package httpversion
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/hedzr/lb/httpfactor"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/version"
+)
+
+// DefaultExtractor reads the X-API-Version header, the version query
+// parameter, or the version parameter of the Accept media type,
+// such as "application/vnd.acme+json;version=2.1".
+var DefaultExtractor = httpfactor.First(
+	httpfactor.Header("X-API-Version"),
+	httpfactor.Query("version"),
+	httpfactor.AcceptParam("version"),
+)
+
+var (
+	// ErrNoVersion is reported for a request without version if
+	// there is no default version.
+	ErrNoVersion = errors.New("httpversion: no version requested")
+	// ErrBadVersion is reported for a version which is not a semver.
+	ErrBadVersion = errors.New("httpversion: bad version")
+	// ErrUnsupportedVersion is reported for a version which satisfies
+	// none of the constraints.
+	ErrUnsupportedVersion = errors.New("httpversion: unsupported version")
+	// ErrNoBackend is reported when no backend satisfies the matched
+	// constraint.
+	ErrNoBackend = errors.New("httpversion: no backend")
+)
+
+// New makes a Router picking the backends of bf.
+func New(bf version.BackendsFactor, opts ...Opt) *Router {
+	rt := &Router{bf: bf, extract: DefaultExtractor}
+	for _, opt := range opts {
+		opt(rt)
+	}
+	return rt
+}
+
+// Opt is a type prototype for New Router
+type Opt func(rt *Router)
+
+// WithConstraints sets the constraints which the requested version
+// is matched against, in order. A request matching none of them is
+// unsupported.
+func WithConstraints(cs ...lbapi.Constrainable) Opt {
+	return func(rt *Router) {
+		rt.constraints = append(rt.constraints, cs...)
+	}
+}
+
+// WithExtractor sets how the requested version is read, the default
+// is DefaultExtractor.
+func WithExtractor(e httpfactor.Extractor) Opt {
+	return func(rt *Router) {
+		rt.extract = e
+	}
+}
+
+// WithDefault sets the version of the requests without one.
+func WithDefault(ver string) Opt {
+	return func(rt *Router) {
+		rt.def = ver
+	}
+}
+
+// Router is a lbapi.Balancer of the backends of a BackendsFactor,
+// whose factor is the requested version. The peers added to it
+// must be version.VersioningBackendFactor, the others are ignored.
+type Router struct {
+	bf          version.BackendsFactor
+	constraints []lbapi.Constrainable
+	extract     httpfactor.Extractor
+	def         string
+}
+
+// Extractor returns the version extractor, for proxy.WithExtractor.
+func (rt *Router) Extractor() httpfactor.Extractor { return rt.extract }
+
+// Version returns the version requested by r, or the default one.
+func (rt *Router) Version(r *http.Request) string {
+	if ver, ok := rt.extract(r); ok {
+		return ver
+	}
+	return rt.def
+}
+
+// Pick returns a backend for the version requested by r, and the
+// matched constraint.
+func (rt *Router) Pick(r *http.Request) (peer lbapi.Peer, c lbapi.Constrainable, err error) {
+	return rt.pick(rt.Version(r))
+}
+
+// Next implements lbapi.BalancerLite, the factor is the requested
+// version. An empty one is the default version.
+func (rt *Router) Next(factor lbapi.Factor) (next lbapi.Peer, c lbapi.Constrainable) {
+	ver := factor.Factor()
+	if ver == "" {
+		ver = rt.def
+	}
+	next, c, _ = rt.pick(ver)
+	return
+}
+
+// Guard wraps next, which is usually the proxy of rt, answering the
+// requests whose version is missing, malformed or unsupported with
+// the status of StatusOf.
+func (rt *Router) Guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := rt.constraint(rt.Version(r)); err != nil {
+			http.Error(w, err.Error(), StatusOf(err))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// StatusOf returns the HTTP status answering a request failed with
+// err by Pick: 400 for a missing or malformed version, 406 for an
+// unsupported one, 502 for no backend.
+func StatusOf(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrNoVersion), errors.Is(err, ErrBadVersion):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnsupportedVersion):
+		return http.StatusNotAcceptable
+	}
+	return http.StatusBadGateway
+}
+
+func (rt *Router) pick(ver string) (peer lbapi.Peer, c lbapi.Constrainable, err error) {
+	if c, err = rt.constraint(ver); err != nil {
+		return nil, nil, err
+	}
+	peer, _, satisfied := rt.bf.ConstrainedBy(c)
+	if !satisfied || peer == nil {
+		return nil, c, fmt.Errorf("%w for %q (%v)", ErrNoBackend, ver, c)
+	}
+	return
+}
+
+// constraint returns the constraint matched by ver.
+func (rt *Router) constraint(ver string) (lbapi.Constrainable, error) {
+	if ver == "" {
+		return nil, ErrNoVersion
+	}
+	v, err := semver.NewVersion(ver)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrBadVersion, ver, err)
+	}
+	c := rt.match(v)
+	if c == nil {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedVersion, ver)
+	}
+	return c, nil
+}
+
+func (rt *Router) match(v *semver.Version) lbapi.Constrainable {
+	for _, c := range rt.constraints {
+		if c.Check(v) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Count returns the number of the backends.
+func (rt *Router) Count() int { return len(rt.bf.Backends()) }
+
+// Add adds the backends to the BackendsFactor.
+func (rt *Router) Add(peers ...lbapi.Peer) { rt.bf.AddPeers(backends(peers)...) }
+
+// Remove removes a backend from the BackendsFactor.
+func (rt *Router) Remove(peer lbapi.Peer) { rt.bf.RemovePeers(backends([]lbapi.Peer{peer})...) }
+
+// Clear removes all backends from the BackendsFactor.
+func (rt *Router) Clear() { rt.bf.SetPeers() }
+
+// Peers implements lbapi.PeerLister.
+func (rt *Router) Peers() (peers []lbapi.Peer) {
+	for _, b := range rt.bf.Backends() {
+		peers = append(peers, b)
+	}
+	return
+}
+
+func backends(peers []lbapi.Peer) (bs []version.VersioningBackendFactor) {
+	for _, p := range peers {
+		if b, ok := p.(version.VersioningBackendFactor); ok {
+			bs = append(bs, b)
+		}
+	}
+	return
+}
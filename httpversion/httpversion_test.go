@@ -0,0 +1,152 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package httpversion_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hedzr/lb/httpversion"
+	"github.com/hedzr/lb/proxy"
+	"github.com/hedzr/lb/rr"
+	"github.com/hedzr/lb/version"
+)
+
+func newRouter(opts ...httpversion.Opt) (*httpversion.Router, []version.VersioningBackendFactor) {
+	backends := []version.VersioningBackendFactor{
+		version.NewBackendFactor("1.4", "http://10.0.0.1:8111"),
+		version.NewBackendFactor("2.1", "http://10.0.0.2:8111"),
+		version.NewBackendFactor("2.3", "http://10.0.0.3:8111"),
+	}
+	bf := version.NewBackendsFactor(rr.New)
+	bf.AddPeers(backends...)
+	opts = append([]httpversion.Opt{httpversion.WithConstraints(
+		version.NewConstrainablePeer("^1.x", 1),
+		version.NewConstrainablePeer(">= 2.0, < 2.2", 1),
+		version.NewConstrainablePeer(">= 2.2, < 3", 1),
+		version.NewConstrainablePeer("^3.x", 1),
+	)}, opts...)
+	return httpversion.New(bf, opts...), backends
+}
+
+func TestPick(t *testing.T) {
+	rt, backends := newRouter(httpversion.WithDefault("1.0"))
+
+	for _, c := range []struct {
+		header, query, accept string
+		want                  version.VersioningBackendFactor
+	}{
+		{header: "1.2", want: backends[0]},
+		{query: "2.1.5", want: backends[1]},
+		{accept: "application/vnd.acme+json; version=2.2", want: backends[2]},
+		{header: "2.0", query: "1", want: backends[1]},
+		{want: backends[0]},
+	} {
+		r := httptest.NewRequest("GET", "/?version="+c.query, nil)
+		if c.header != "" {
+			r.Header.Set("X-API-Version", c.header)
+		}
+		if c.accept != "" {
+			r.Header.Set("Accept", c.accept)
+		}
+		peer, _, err := rt.Pick(r)
+		if err != nil || peer != c.want {
+			t.Errorf("%+v: got %v, %v", c, peer, err)
+		}
+	}
+}
+
+func TestPickErrors(t *testing.T) {
+	rt, _ := newRouter()
+
+	for _, c := range []struct {
+		ver  string
+		want error
+	}{
+		{"", httpversion.ErrNoVersion},
+		{"two", httpversion.ErrBadVersion},
+		{"4.0", httpversion.ErrUnsupportedVersion},
+		{"3.1", httpversion.ErrNoBackend},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.ver != "" {
+			r.Header.Set("X-API-Version", c.ver)
+		}
+		if peer, _, err := rt.Pick(r); !errors.Is(err, c.want) || peer != nil {
+			t.Errorf("%q: got %v, %v; want %v", c.ver, peer, err, c.want)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	serve := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, body)
+		}))
+	}
+	v1, v2 := serve("v1"), serve("v2")
+	defer v1.Close()
+	defer v2.Close()
+
+	rt := httpversion.New(version.NewBackendsFactor(rr.New),
+		httpversion.WithConstraints(version.NewConstrainablePeer("^1.x", 1), version.NewConstrainablePeer("^2.x", 1)),
+		httpversion.WithDefault("1"))
+	rt.Add(version.NewBackendFactor("1.0", v1.URL), version.NewBackendFactor("2.0", v2.URL))
+	if rt.Count() != 2 {
+		t.Fatalf("bad count: %v", rt.Count())
+	}
+	gw := httptest.NewServer(rt.Guard(proxy.New(rt, proxy.WithExtractor(rt.Extractor()))))
+	defer gw.Close()
+
+	for ver, want := range map[string]string{"": "v1", "2.0": "v2", "1.9": "v1"} {
+		req, _ := http.NewRequest("GET", gw.URL, nil)
+		if ver != "" {
+			req.Header.Set("X-API-Version", ver)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("%q: got %q, want %q", ver, body, want)
+		}
+	}
+
+	for ver, want := range map[string]int{"two": http.StatusBadRequest, "3.0": http.StatusNotAcceptable} {
+		req, _ := http.NewRequest("GET", gw.URL, nil)
+		req.Header.Set("X-API-Version", ver)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%q: got status %v, want %v", ver, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestStatusOf(t *testing.T) {
+	rt, _ := newRouter()
+
+	for ver, want := range map[string]int{
+		"":    http.StatusBadRequest,
+		"two": http.StatusBadRequest,
+		"4.0": http.StatusNotAcceptable,
+		"3.1": http.StatusBadGateway,
+		"2.1": http.StatusOK,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if ver != "" {
+			r.Header.Set("X-API-Version", ver)
+		}
+		if _, _, err := rt.Pick(r); httpversion.StatusOf(err) != want {
+			t.Errorf("%q: got status %v for %v, want %v", ver, httpversion.StatusOf(err), err, want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package observer is the subscriber list of the stock balancers,
+// see lbapi.Observable.
+package observer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/lb/lbapi"
+)
+
+// Set is a list of observers. The zero value is ready to use, and
+// Emit costs a single atomic load while nobody subscribes.
+type Set struct {
+	mu   sync.Mutex
+	list atomic.Pointer[[]*entry]
+}
+
+type entry struct {
+	fn lbapi.Observer
+}
+
+// Subscribe implements lbapi.Observable.
+func (s *Set) Subscribe(fn lbapi.Observer) (unsubscribe func()) {
+	e := &entry{fn: fn}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*entry
+	if old := s.list.Load(); old != nil {
+		list = append(list, *old...)
+	}
+	list = append(list, e)
+	s.list.Store(&list)
+
+	var once sync.Once
+	return func() { once.Do(func() { s.remove(e) }) }
+}
+
+func (s *Set) remove(e *entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*entry
+	for _, x := range *s.list.Load() {
+		if x != e {
+			list = append(list, x)
+		}
+	}
+	s.list.Store(&list)
+}
+
+// Active tells whether there is any observer, so that the cost of
+// building an event can be saved.
+func (s *Set) Active() bool {
+	list := s.list.Load()
+	return list != nil && len(*list) > 0
+}
+
+// Emit sends e to all observers, Time is set if it's zero.
+func (s *Set) Emit(e lbapi.Event) {
+	list := s.list.Load()
+	if list == nil || len(*list) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, x := range *list {
+		x.fn(e)
+	}
+}
+
+// Changed sends the PeerRemoved events of removed, and then the
+// PeerAdded events of added.
+func (s *Set) Changed(added, removed []lbapi.Peer) {
+	for _, p := range removed {
+		s.Emit(lbapi.Event{Type: lbapi.PeerRemoved, Peer: p})
+	}
+	for _, p := range added {
+		s.Emit(lbapi.Event{Type: lbapi.PeerAdded, Peer: p})
+	}
+}
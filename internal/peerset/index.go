@@ -0,0 +1,194 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package peerset
+
+import (
+	"sync"
+
+	"github.com/hedzr/lb/lbapi"
+)
+
+// Index maps the peers to their values by the rules of lbapi.Same.
+//
+// A Keyed peer is found by its key, the others by their String():
+// the peers of the same string are compared by DeepEqual, so two
+// DeepEqual peers must have the same string, as the identity string
+// of lbapi.Peer does. Either way it takes O(1). Get is safe for
+// concurrent use, the writers must be serialized. The values must
+// be unique, such as the pointers to the state of each peer.
+type Index[V comparable] struct {
+	m    sync.Map // keyed -> *entry[V], named -> []*entry[V]
+	vals map[V]*entry[V]
+}
+
+type entry[V comparable] struct {
+	key  interface{}
+	peer lbapi.Peer
+	v    V
+}
+
+// keyed is the index key of a lbapi.Keyed peer, and named the one
+// of the peers of a string, so that they never collide.
+type (
+	keyed string
+	named string
+)
+
+func indexKey(peer lbapi.Peer) interface{} {
+	if k, ok := peer.(lbapi.Keyed); ok {
+		return keyed(k.Key())
+	}
+	return named(peer.String())
+}
+
+func (x *Index[V]) lookup(peer lbapi.Peer) *entry[V] {
+	if peer == nil {
+		return nil
+	}
+	found, ok := x.m.Load(indexKey(peer))
+	if !ok {
+		return nil
+	}
+	if e, ok := found.(*entry[V]); ok {
+		return e
+	}
+	for _, e := range found.([]*entry[V]) {
+		if lbapi.Same(e.peer, peer) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Get returns the indexed peer which is the same as peer, and its
+// value.
+func (x *Index[V]) Get(peer lbapi.Peer) (found lbapi.Peer, v V, ok bool) {
+	if e := x.lookup(peer); e != nil {
+		return e.peer, e.v, true
+	}
+	return
+}
+
+// Put indexes peer with v, it must not be indexed already.
+func (x *Index[V]) Put(peer lbapi.Peer, v V) {
+	e := &entry[V]{key: indexKey(peer), peer: peer, v: v}
+	if _, ok := e.key.(keyed); ok {
+		x.m.Store(e.key, e)
+	} else {
+		// the buckets are copied, as Get reads them concurrently
+		bucket, _ := x.m.Load(e.key)
+		list, _ := bucket.([]*entry[V])
+		x.m.Store(e.key, append(list[:len(list):len(list)], e))
+	}
+	if x.vals == nil {
+		x.vals = make(map[V]*entry[V])
+	}
+	x.vals[v] = e
+}
+
+// Delete drops the indexed peer which is the same as peer, and
+// returns it.
+func (x *Index[V]) Delete(peer lbapi.Peer) (found lbapi.Peer, v V, ok bool) {
+	if e := x.lookup(peer); e != nil {
+		x.drop(e)
+		return e.peer, e.v, true
+	}
+	return
+}
+
+func (x *Index[V]) drop(e *entry[V]) {
+	delete(x.vals, e.v)
+	bucket, _ := x.m.Load(e.key)
+	list, ok := bucket.([]*entry[V])
+	if !ok {
+		x.m.Delete(e.key)
+		return
+	}
+	rest := make([]*entry[V], 0, len(list))
+	for _, o := range list {
+		if o != e {
+			rest = append(rest, o)
+		}
+	}
+	if len(rest) == 0 {
+		x.m.Delete(e.key)
+	} else {
+		x.m.Store(e.key, rest)
+	}
+}
+
+// Peer returns the indexed peer of v.
+func (x *Index[V]) Peer(v V) lbapi.Peer {
+	if e, ok := x.vals[v]; ok {
+		return e.peer
+	}
+	return nil
+}
+
+// Update removes the peers of remove, and then indexes the peers
+// of add which are not indexed yet with the values made by mk. olds
+// are the current values in order, vals are the values afterwards:
+// the kept olds followed by the added ones.
+func (x *Index[V]) Update(olds []V, add, remove []lbapi.Peer, mk func(peer lbapi.Peer) V) (vals []V, added, removed []lbapi.Peer) {
+	gone := make(map[V]bool)
+	for _, p := range remove {
+		if q, v, ok := x.Delete(p); ok {
+			gone[v] = true
+			removed = append(removed, q)
+		}
+	}
+	vals = make([]V, 0, len(olds)-len(gone)+len(add))
+	for _, v := range olds {
+		if !gone[v] {
+			vals = append(vals, v)
+		}
+	}
+	for _, p := range add {
+		if _, _, ok := x.Get(p); !ok {
+			v := mk(p)
+			x.Put(p, v)
+			vals = append(vals, v)
+			added = append(added, p)
+		}
+	}
+	return
+}
+
+// Replace makes peers the indexed ones. The peers indexed already
+// keep their values, the others are made by mk. vals are in the
+// order of peers.
+func (x *Index[V]) Replace(olds []V, peers []lbapi.Peer, mk func(peer lbapi.Peer) V) (vals []V, added, removed []lbapi.Peer) {
+	kept := make(map[V]bool, len(peers))
+	vals = make([]V, 0, len(peers))
+	for _, p := range peers {
+		_, v, ok := x.Get(p)
+		if !ok {
+			v = mk(p)
+			x.Put(p, v)
+			added = append(added, p)
+		} else if kept[v] {
+			continue // duplicated
+		}
+		kept[v] = true
+		vals = append(vals, v)
+	}
+	for _, v := range olds {
+		if e, ok := x.vals[v]; ok && !kept[v] {
+			x.drop(e)
+			removed = append(removed, e.peer)
+		}
+	}
+	return
+}
+
+// Clear drops all peers.
+func (x *Index[V]) Clear() {
+	x.m.Range(func(key, _ interface{}) bool {
+		x.m.Delete(key)
+		return true
+	})
+	x.vals = nil
+}
+
+// Len returns the number of the peers, it's for the writers.
+func (x *Index[V]) Len() int { return len(x.vals) }
@@ -0,0 +1,123 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package peerset is the copy-on-write peer list of the stock
+// balancers.
+//
+// The readers (Next) load an immutable Set through an atomic
+// pointer, so they never wait; the writers (Add, Remove, Clear)
+// are serialized, copy the set and publish the new one. The peers
+// are found through an Index.
+package peerset
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/hedzr/lb/lbapi"
+)
+
+// Set is an immutable list of peers and their stats.
+type Set struct {
+	Peers []lbapi.Peer
+	Stats []*Stats // of each peer, shared by the following sets
+}
+
+// Stats are the counters of a peer, updated atomically.
+type Stats struct {
+	Picks int64
+	Conns int64
+}
+
+var empty = &Set{}
+
+// Len returns the number of peers.
+func (s *Set) Len() int { return len(s.Peers) }
+
+// List publishes the Sets. The zero value is an empty list.
+type List struct {
+	cur      atomic.Pointer[Set]
+	index    Index[*Stats]
+	mu       sync.Mutex
+	counting atomic.Bool
+}
+
+// Load returns the current set, never nil.
+func (l *List) Load() *Set {
+	if s := l.cur.Load(); s != nil {
+		return s
+	}
+	return empty
+}
+
+// CountPicks turns the counting of Picked on or off.
+func (l *List) CountPicks(on bool) { l.counting.Store(on) }
+
+// Picked counts a pick of the i-th peer of set, if the picks are
+// counted.
+func (l *List) Picked(set *Set, i int) {
+	if l.counting.Load() {
+		atomic.AddInt64(&set.Stats[i].Picks, 1)
+	}
+}
+
+// StatsOf returns the stats of peer, or nil.
+func (l *List) StatsOf(peer lbapi.Peer) *Stats {
+	_, st, _ := l.index.Get(peer)
+	return st
+}
+
+// Add appends peer unless it's there already.
+func (l *List) Add(peer lbapi.Peer) (added bool) {
+	a, _ := l.Update([]lbapi.Peer{peer}, nil)
+	return len(a) > 0
+}
+
+// Remove removes peer, and returns the removed one.
+func (l *List) Remove(peer lbapi.Peer) (removed lbapi.Peer) {
+	if _, r := l.Update(nil, []lbapi.Peer{peer}); len(r) > 0 {
+		return r[0]
+	}
+	return nil
+}
+
+// Update removes the peers of remove and appends the peers of add
+// as one change, see Index.Update.
+func (l *List) Update(add, remove []lbapi.Peer) (added, removed []lbapi.Peer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var stats []*Stats
+	stats, added, removed = l.index.Update(l.Load().Stats, add, remove, newStats)
+	if len(added) > 0 || len(removed) > 0 {
+		l.publish(stats)
+	}
+	return
+}
+
+// Replace makes peers the list as one change, the peers there
+// already keep their stats.
+func (l *List) Replace(peers []lbapi.Peer) (added, removed []lbapi.Peer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var stats []*Stats
+	stats, added, removed = l.index.Replace(l.Load().Stats, peers, newStats)
+	l.publish(stats)
+	return
+}
+
+func newStats(lbapi.Peer) *Stats { return new(Stats) }
+
+func (l *List) publish(stats []*Stats) {
+	set := &Set{Peers: make([]lbapi.Peer, len(stats)), Stats: stats}
+	for i, st := range stats {
+		set.Peers[i] = l.index.Peer(st)
+	}
+	l.cur.Store(set)
+}
+
+// Clear removes all peers.
+func (l *List) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.index.Clear()
+	l.cur.Store(empty)
+}
@@ -0,0 +1,51 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package urlpeer resolves the target URL of an HTTP peer.
+package urlpeer
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/hedzr/lb/lbapi"
+)
+
+// URLAware could be concreted by a peer which holds its parsed URL.
+type URLAware interface {
+	URL() *url.URL
+}
+
+// Resolver caches the parsed URLs of the peers which only
+// have String().
+type Resolver struct {
+	cache sync.Map // string -> *url.URL
+}
+
+// Resolve returns the target URL of a peer. A peer implementing
+// URLAware is used as is, else its Addr() (such as a version
+// backend) or String() is parsed as an absolute URL.
+func (r *Resolver) Resolve(peer lbapi.Peer) (u *url.URL, err error) {
+	if ua, ok := peer.(URLAware); ok {
+		if u = ua.URL(); u != nil {
+			return
+		}
+	}
+
+	key := peer.String()
+	if a, ok := peer.(interface{ Addr() string }); ok {
+		key = a.Addr()
+	}
+	if v, ok := r.cache.Load(key); ok {
+		return v.(*url.URL), nil
+	}
+
+	if u, err = url.Parse(key); err != nil {
+		return
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("peer %q is not an absolute url", key)
+	}
+	r.cache.Store(key, u)
+	return
+}
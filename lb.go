@@ -5,10 +5,12 @@ package lb
 
 import (
 	"log"
+	"sort"
 	"sync"
 
 	"github.com/hedzr/lb/hash"
 	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/leastconn"
 	"github.com/hedzr/lb/random"
 	"github.com/hedzr/lb/rr"
 	"github.com/hedzr/lb/version"
@@ -32,6 +34,25 @@ func New(algorithm string, opts ...lbapi.Opt) lbapi.Balancer {
 	return nil // unreachable
 }
 
+// Lookup returns the generator registered for algorithm.
+func Lookup(algorithm string) (generator func(opts ...lbapi.Opt) lbapi.Balancer, ok bool) {
+	kbs.RLock()
+	defer kbs.RUnlock()
+	generator, ok = knownBalancers[algorithm]
+	return
+}
+
+// Algorithms returns the registered algorithms, sorted.
+func Algorithms() (algorithms []string) {
+	kbs.RLock()
+	defer kbs.RUnlock()
+	for algorithm := range knownBalancers {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+	return
+}
+
 // WithPeers adds the initial peers.
 func WithPeers(peers ...lbapi.Peer) lbapi.Opt {
 	return func(balancer lbapi.Balancer) {
@@ -68,6 +89,8 @@ const (
 	WeightedRandom = "weighted-random"
 	// VersioningWRR algorithm
 	VersioningWRR = "versioning-wrr"
+	// LeastConnections algorithm
+	LeastConnections = "least-connections"
 )
 
 func init() {
@@ -84,6 +107,8 @@ func init() {
 	knownBalancers[WeightedRandom] = wrandom.New
 
 	knownBalancers[VersioningWRR] = version.New
+
+	knownBalancers[LeastConnections] = leastconn.New
 }
 
 var knownBalancers map[string]func(opts ...lbapi.Opt) lbapi.Balancer
@@ -3,9 +3,14 @@
 package lb_test
 
 import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
 	lb2 "github.com/hedzr/lb"
 	"github.com/hedzr/lb/lbapi"
-	"testing"
 )
 
 type exP struct {
@@ -58,6 +63,219 @@ func Test_Register(t *testing.T) {
 	})
 
 	lb2.New("nil")
+	if _, ok := lb2.Lookup("nil"); !ok {
+		t.Fatal("registered algorithm not found")
+	}
+	if algorithms := strings.Join(lb2.Algorithms(), ","); !strings.Contains(algorithms, "nil,random") {
+		t.Fatalf("bad algorithms: %v", algorithms)
+	}
 
 	lb2.Unregister("nil")
+	if _, ok := lb2.Lookup("nil"); ok {
+		t.Fatal("unregistered algorithm still found")
+	}
+}
+
+// TestConcurrentWriters picks while the peers are added, removed,
+// cleared and inspected, run it with -race.
+func TestConcurrentWriters(t *testing.T) {
+	for _, algorithm := range []string{lb2.Random, lb2.RoundRobin, lb2.WeightedRoundRobin, lb2.ConsistentHash, lb2.LeastConnections} {
+		t.Run(algorithm, func(t *testing.T) {
+			lb := lb2.New(algorithm)
+			peers := make([]lbapi.Peer, 16)
+			for i := range peers {
+				peers[i] = &exP{"172.16.0." + strconv.Itoa(i) + ":3500", i%3 + 1}
+			}
+			lb.Add(peers[:8]...)
+
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			for x := 0; x < 4; x++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						if p, _ := lb.Next(lbapi.FactorString("k")); p != nil {
+							if ca, ok := lb.(lbapi.ConnAware); ok {
+								ca.Acquire(p)
+								ca.Release(p)
+							}
+						}
+						lbapi.Inspect(lb)
+					}
+				}()
+			}
+
+			for i := 0; i < 200; i++ {
+				p := peers[i%len(peers)]
+				lb.Add(p)
+				lb.Remove(peers[(i+5)%len(peers)])
+				if i%50 == 49 {
+					lb.Clear()
+				}
+			}
+			close(done)
+			wg.Wait()
+
+			if n := lb.Count(); n < 0 || n > len(peers) {
+				t.Fatalf("bad count: %v", n)
+			}
+		})
+	}
+}
+
+type keyedP struct {
+	exP
+	zone string
+}
+
+func (s *keyedP) Key() string { return s.addr }
+
+// TestKeyedIdentity checks all algorithms find a peer by its key.
+func TestKeyedIdentity(t *testing.T) {
+	for _, algorithm := range []string{lb2.Random, lb2.RoundRobin, lb2.WeightedRoundRobin, lb2.ConsistentHash, lb2.LeastConnections} {
+		t.Run(algorithm, func(t *testing.T) {
+			lb := lb2.New(algorithm)
+			peers := make([]lbapi.Peer, 5000)
+			for i := range peers {
+				peers[i] = &keyedP{exP{"10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256) + ":80", 1}, "a"}
+			}
+			lb.Add(peers...)
+
+			lb.Add(&keyedP{exP{"10.0.0.7:80", 1}, "b"})
+			if lb.Count() != 5000 {
+				t.Fatalf("a peer with the same key should be ignored, count = %v", lb.Count())
+			}
+			lb.Add(&exP{"10.0.0.7:80", 1})
+			if lb.Count() != 5001 {
+				t.Fatalf("a peer without key is not the same as a keyed one, count = %v", lb.Count())
+			}
+
+			lb.Remove(&keyedP{exP{"10.0.0.7:80", 2}, "c"})
+			lb.Remove(&exP{"10.0.0.7:80", 1})
+			if lb.Count() != 4999 {
+				t.Fatalf("wrong Remove: count = %v", lb.Count())
+			}
+		})
+	}
+}
+
+// tagP is comparable by type, but not when its tags hold a slice.
+type tagP struct {
+	addr string
+	tags interface{}
+}
+
+func (s tagP) String() string { return s.addr }
+
+// TestUnhashableIdentity checks a peer which can't be a map key is
+// found by DeepEqual.
+func TestUnhashableIdentity(t *testing.T) {
+	for _, algorithm := range []string{lb2.Random, lb2.RoundRobin, lb2.WeightedRoundRobin, lb2.ConsistentHash, lb2.LeastConnections} {
+		t.Run(algorithm, func(t *testing.T) {
+			lb := lb2.New(algorithm)
+			lb.Add(tagP{"10.0.0.1:80", []string{"a"}}, tagP{"10.0.0.1:80", []string{"a"}}, tagP{"10.0.0.1:80", []string{"b"}})
+			if lb.Count() != 2 {
+				t.Fatalf("the DeepEqual peer should be ignored, count = %v", lb.Count())
+			}
+			lb.Remove(tagP{"10.0.0.1:80", []string{"a"}})
+			if lb.Count() != 1 {
+				t.Fatalf("wrong Remove: count = %v", lb.Count())
+			}
+		})
+	}
+}
+
+// TestReplace swaps two peer sets while picking, a pick must never
+// miss, and a pick made while no Replace is in flight must be a peer
+// of the set published last.
+func TestReplace(t *testing.T) {
+	for _, algorithm := range []string{lb2.Random, lb2.RoundRobin, lb2.WeightedRoundRobin, lb2.ConsistentHash, lb2.LeastConnections} {
+		t.Run(algorithm, func(t *testing.T) {
+			sets := make([][]lbapi.Peer, 2)
+			owner := make(map[string]int)
+			for i := 0; i < 8; i++ {
+				p := &keyedP{exP{"10.0.0." + strconv.Itoa(i) + ":80", 1}, ""}
+				sets[i%2] = append(sets[i%2], p)
+				owner[p.addr] = i % 2
+			}
+			lb := lb2.New(algorithm)
+			lb.(lbapi.Updater).Replace(sets[0]...)
+
+			var events []lbapi.Event
+			lb.(lbapi.Observable).Subscribe(func(e lbapi.Event) {
+				if e.Type != lbapi.Picked {
+					events = append(events, e)
+				}
+			})
+
+			// seq is odd while a Replace is in flight, seq/2 is the
+			// number of the Replace calls done
+			var seq int64
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			errs := make(chan string, 1)
+			fail := func(msg string) {
+				select {
+				case errs <- msg:
+				default:
+				}
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					before := atomic.LoadInt64(&seq)
+					p, _ := lb.Next(lbapi.FactorString("k"))
+					if p == nil {
+						fail("missed")
+						return
+					}
+					if after := atomic.LoadInt64(&seq); before == after && before%2 == 0 && owner[p.String()] != int(before/2%2) {
+						fail("a peer of the replaced set is picked: " + p.String())
+						return
+					}
+				}
+			}()
+			for i := 1; i <= 100; i++ {
+				atomic.AddInt64(&seq, 1)
+				lb.(lbapi.Updater).Replace(sets[i%2]...)
+				atomic.AddInt64(&seq, 1)
+			}
+			close(done)
+			wg.Wait()
+			select {
+			case err := <-errs:
+				t.Fatal(err)
+			default:
+			}
+
+			if lb.Count() != 4 {
+				t.Fatalf("bad count: %v", lb.Count())
+			}
+			for _, p := range lb.(lbapi.PeerLister).Peers() {
+				if owner[p.String()] != 0 {
+					t.Fatalf("a mix of both sets: %v", lb.(lbapi.PeerLister).Peers())
+				}
+			}
+			if len(events) != 800 || events[0].Type != lbapi.PeerRemoved || events[4].Type != lbapi.PeerAdded {
+				t.Fatalf("bad events: %v", len(events))
+			}
+
+			lb.(lbapi.Updater).Update(sets[1][:1], sets[0][:2])
+			if lb.Count() != 3 {
+				t.Fatalf("bad count after Update: %v", lb.Count())
+			}
+		})
+	}
 }
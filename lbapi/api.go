@@ -2,7 +2,12 @@
 
 package lbapi
 
-import "reflect"
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"time"
+)
 
 // Peer is a backend object, such as a host+port, a
 // http/https url, or a constraint expression, and so on.
@@ -26,6 +31,11 @@ type WeightedPeer interface {
 	Weighted
 }
 
+// Labeled object, such as a peer with zone or tier labels.
+type Labeled interface {
+	Labels() map[string]string
+}
+
 // Factor is a factor parameter for BalancerLite.Next.
 //
 // If you won't known what should be passed into
@@ -87,6 +97,24 @@ func (s FactorString) Factor() string { return string(s) }
 // what on earth should be passed into BalancerLite.Next(factor).
 const DummyFactor FactorString = ""
 
+type factorKey struct{}
+
+// ContextWithFactor returns a copy of ctx carrying factor, so that
+// a factor can be passed through APIs which only take a context,
+// such as http.RoundTripper or a DialContext function.
+func ContextWithFactor(ctx context.Context, factor Factor) context.Context {
+	return context.WithValue(ctx, factorKey{}, factor)
+}
+
+// FactorFromContext returns the factor carried by ctx, or
+// DummyFactor if there is none.
+func FactorFromContext(ctx context.Context) Factor {
+	if f, ok := ctx.Value(factorKey{}).(Factor); ok {
+		return f
+	}
+	return DummyFactor
+}
+
 // Constrainable is an object who can be applied onto a factor ( BalancerLite.Next(factor) )
 type Constrainable interface {
 	CanConstrain(o interface{}) (yes bool)
@@ -100,6 +128,251 @@ type WeightedConstrainable interface {
 	Weighted
 }
 
+// PeerLister could be concreted by a Balancer which can list its
+// peers, in the order it keeps them. All stock balancers do.
+type PeerLister interface {
+	Peers() []Peer
+}
+
+// Updater could be concreted by a Balancer which applies a whole
+// membership change at once, so that Next never sees a half applied
+// one. All stock balancers do.
+type Updater interface {
+	// Update removes the peers of remove, and then adds the peers of
+	// add. A peer removed and added again is replaced, with a fresh
+	// state.
+	Update(add, remove []Peer)
+	// Replace makes peers the peers of the balancer. The peers there
+	// already are kept with their state.
+	Replace(peers ...Peer)
+}
+
+// Update applies a membership change to b, at once if b is an
+// Updater, else by Remove and Add.
+func Update(b Balancer, add, remove []Peer) {
+	if u, ok := b.(Updater); ok {
+		u.Update(add, remove)
+		return
+	}
+	for _, p := range remove {
+		b.Remove(p)
+	}
+	b.Add(add...)
+}
+
+// Replace makes peers the peers of b, at once if b is an Updater.
+// Else the peers not in peers are removed if b is a PeerLister, or
+// b is cleared, before peers are added.
+func Replace(b Balancer, peers ...Peer) {
+	if u, ok := b.(Updater); ok {
+		u.Replace(peers...)
+		return
+	}
+	pl, ok := b.(PeerLister)
+	if !ok {
+		b.Clear()
+		b.Add(peers...)
+		return
+	}
+	for _, old := range pl.Peers() {
+		wanted := false
+		for _, p := range peers {
+			if wanted = Same(old, p); wanted {
+				break
+			}
+		}
+		if !wanted {
+			b.Remove(old)
+		}
+	}
+	b.Add(peers...)
+}
+
+// Wrapper could be concreted by a Balancer which wraps another one
+// to add a feature, such as health.New or metrics.Collector.Wrap,
+// so that the tooling can find the features of the wrapped one.
+type Wrapper interface {
+	Unwrap() Balancer
+}
+
+// Inspectable could be concreted by a Balancer which can report
+// its state. All stock balancers do.
+type Inspectable interface {
+	// Inspect returns a snapshot, it's not changed by the balancer
+	// afterwards.
+	Inspect() Snapshot
+}
+
+// Snapshot is the state of a balancer at a moment.
+type Snapshot struct {
+	// Algorithm is the registered name of the algorithm, such as
+	// "round-robin".
+	Algorithm string
+	// Peers are in the order kept by the balancer.
+	Peers []PeerState
+	// Picks is the number of picks of the current peers, see
+	// WithPickCounts.
+	Picks int64
+	// RingSize is the number of virtual nodes of a consistent-hash
+	// ring.
+	RingSize int
+}
+
+// PeerState is the state of a peer in a Snapshot.
+type PeerState struct {
+	Peer Peer
+	// Picks is the number of times the peer was picked, see
+	// WithPickCounts.
+	Picks int64
+	// Weight, Effective and Current are the weights of a weighted
+	// round-robin balancer.
+	Weight, Effective, Current int
+	// VirtualNodes is the number of points of the peer on a
+	// consistent-hash ring.
+	VirtualNodes int
+	// Connections is the number of open connections of a
+	// least-connections balancer.
+	Connections int64
+	// Children is the snapshot of a nested balancer, or nil.
+	Children *Snapshot
+}
+
+// Inspect returns the snapshot of b, looking through the
+// lbapi.Wrapper chain.
+func Inspect(b interface{}) (s Snapshot, ok bool) {
+	for b != nil {
+		if i, yes := b.(Inspectable); yes {
+			return i.Inspect(), true
+		}
+		w, yes := b.(Wrapper)
+		if !yes {
+			break
+		}
+		b = w.Unwrap()
+	}
+	return
+}
+
+// PickCounter could be concreted by a Balancer which can count the
+// picks of its peers for Inspect. All stock balancers do, see
+// WithPickCounts.
+type PickCounter interface {
+	CountPicks(on bool)
+}
+
+// WithPickCounts makes a balancer count the picks of its peers,
+// looking through the lbapi.Wrapper chain. The stock balancers
+// don't count them by default: a count is an atomic add on each
+// Next, which the concurrent picks of a peer contend for. The
+// picks of the wrapped balancers of metrics.Collector are counted
+// by it anyway.
+func WithPickCounts() Opt {
+	return func(balancer Balancer) {
+		for b := interface{}(balancer); b != nil; {
+			if pc, ok := b.(PickCounter); ok {
+				pc.CountPicks(true)
+				return
+			}
+			w, ok := b.(Wrapper)
+			if !ok {
+				return
+			}
+			b = w.Unwrap()
+		}
+	}
+}
+
+// Children returns the snapshot of a peer which is a nested
+// balancer, or nil.
+func Children(peer Peer) *Snapshot {
+	if s, ok := Inspect(peer); ok {
+		return &s
+	}
+	return nil
+}
+
+// HealthAware could be concreted by a Balancer (or any peer
+// registry) which knows whether a peer is eligible for traffic.
+// Healthy is a query, it must not change the health of the peer.
+type HealthAware interface {
+	Healthy(peer Peer) bool
+}
+
+// FeedbackAware could be concreted by a Balancer which learns from
+// the outcome of the requests sent to the peers it picked, such as
+// a latency-aware or an outlier-ejecting balancer.
+//
+// err is nil for a successful request.
+type FeedbackAware interface {
+	Feedback(peer Peer, latency time.Duration, err error)
+}
+
+// ConnAware could be concreted by a Balancer which tracks the open
+// connections of each peer, such as a least-connections balancer.
+// Acquire is called once a connection to the peer is established,
+// or a request is sent to it, and Release once it is closed or the
+// response is done.
+type ConnAware interface {
+	Acquire(peer Peer)
+	Release(peer Peer)
+}
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// PeerAdded is sent once a peer is added.
+	PeerAdded EventType = iota + 1
+	// PeerRemoved is sent once a peer is removed.
+	PeerRemoved
+	// WeightChanged is sent once the weight of a peer is changed,
+	// Event.Weight is the new one.
+	WeightChanged
+	// Picked is sent for each peer returned by Next, with the factor
+	// and the constraint.
+	Picked
+	// Cleared is sent once all peers are cleared.
+	Cleared
+	// HealthChanged is sent once a peer becomes healthy or
+	// unhealthy, see Event.Healthy.
+	HealthChanged
+	// Unsatisfied is sent by a versioning balancer when no backend
+	// satisfies the picked constraint (Event.Constraint), before it
+	// falls back.
+	Unsatisfied
+)
+
+var eventTypeNames = [...]string{"", "PeerAdded", "PeerRemoved", "WeightChanged", "Picked", "Cleared", "HealthChanged", "Unsatisfied"}
+
+func (t EventType) String() string {
+	if t > 0 && int(t) < len(eventTypeNames) {
+		return eventTypeNames[t]
+	}
+	return "EventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// Event is a peer lifecycle event of a balancer.
+type Event struct {
+	Type       EventType
+	Peer       Peer // nil for Cleared and Unsatisfied
+	Factor     Factor
+	Constraint Constrainable
+	Weight     int
+	Healthy    bool
+	Time       time.Time
+}
+
+// Observer receives the events. It is called synchronously by the
+// balancer, so it must be fast and must not block.
+type Observer func(e Event)
+
+// Observable could be concreted by a Balancer which sends its
+// events to the subscribed observers. All stock balancers do.
+type Observable interface {
+	// Subscribe adds an observer, the returned func removes it.
+	Subscribe(fn Observer) (unsubscribe func())
+}
+
 // DeepEqualAware could be concreted by a Peer so you could
 // customize how to compare two peers, avoid reflect.DeepEqual
 // bypass.
@@ -110,7 +383,8 @@ type DeepEqualAware interface {
 // DeepEqual will be used in Balancer, and a Peer can bypass
 // reflect.DeepEqual by implementing DeepEqualAware interface.
 func DeepEqual(a, b Peer) (yes bool) {
-	if a == b {
+	// == panics for a struct holding an incomparable value
+	if reflect.ValueOf(a).Comparable() && a == b {
 		return true
 	}
 
@@ -121,6 +395,28 @@ func DeepEqual(a, b Peer) (yes bool) {
 	return reflect.DeepEqual(a, b)
 }
 
+// Keyed could be concreted by a Peer which has an identity key,
+// such as its address. The stock balancers index the Keyed peers
+// by their keys, so that adding, removing and finding one takes
+// O(1); the other peers are indexed by String(), and the peers of
+// the same string are compared by DeepEqual.
+type Keyed interface {
+	Key() string
+}
+
+// Same tells whether a and b are the same peer for a balancer. A
+// Keyed peer is only the same as a Keyed peer with the same key,
+// the other peers are compared by DeepEqual. Two DeepEqual peers
+// must have the same String(), which the stock balancers index.
+func Same(a, b Peer) bool {
+	ka, aok := a.(Keyed)
+	kb, bok := b.(Keyed)
+	if aok || bok {
+		return aok && bok && ka.Key() == kb.Key()
+	}
+	return DeepEqual(a, b)
+}
+
 //// Sum sum
 //func Sum(a []int, fn func(it int)) {
 //	for _, it := range a {
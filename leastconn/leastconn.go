@@ -0,0 +1,165 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package leastconn
+
+import (
+	"sync/atomic"
+
+	"github.com/hedzr/lb/internal/observer"
+	"github.com/hedzr/lb/internal/peerset"
+	"github.com/hedzr/lb/lbapi"
+)
+
+// New make a new load-balancer instance with Least-Connections.
+//
+// The open connections are counted through lbapi.ConnAware, so the
+// balancer must be fed by Acquire/Release, such as dialer.New does.
+// The ties are broken in round-robin order.
+func New(opts ...lbapi.Opt) lbapi.Balancer {
+	return (&lcS{}).init(opts...)
+}
+
+type lcS struct {
+	peers peerset.List
+	count int64
+	obs   observer.Set
+}
+
+func (s *lcS) init(opts ...lbapi.Opt) *lcS {
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *lcS) Next(factor lbapi.Factor) (next lbapi.Peer, c lbapi.Constrainable) {
+	next = s.miniNext()
+	if fc, ok := factor.(lbapi.FactorComparable); ok {
+		next, c, _ = fc.ConstrainedBy(next)
+	} else if nested, ok := next.(lbapi.BalancerLite); ok {
+		next, c = nested.Next(factor)
+	}
+	if next != nil && s.obs.Active() {
+		s.obs.Emit(lbapi.Event{Type: lbapi.Picked, Peer: next, Factor: factor, Constraint: c})
+	}
+	return
+}
+
+// Subscribe implements lbapi.Observable.
+func (s *lcS) Subscribe(fn lbapi.Observer) (unsubscribe func()) { return s.obs.Subscribe(fn) }
+
+func (s *lcS) miniNext() (next lbapi.Peer) {
+	set := s.peers.Load()
+	if set.Len() == 0 {
+		return
+	}
+
+	// the fewest connections and its ties, the counters may move
+	// meanwhile, so the ties are found again by the second pass
+	var ties, fewest int64
+	for i := range set.Peers {
+		n := atomic.LoadInt64(&set.Stats[i].Conns)
+		if ties == 0 || n < fewest {
+			ties, fewest = 1, n
+		} else if n == fewest {
+			ties++
+		}
+	}
+
+	nth := (atomic.AddInt64(&s.count, 1) - 1) % ties
+	pick := 0 // if all the counters have moved up meanwhile
+	for i := range set.Peers {
+		if atomic.LoadInt64(&set.Stats[i].Conns) <= fewest {
+			pick = i
+			if nth--; nth < 0 {
+				break
+			}
+		}
+	}
+	next = set.Peers[pick]
+	s.peers.Picked(set, pick)
+	return
+}
+
+// Acquire implements lbapi.ConnAware.
+func (s *lcS) Acquire(peer lbapi.Peer) {
+	if st := s.peers.StatsOf(peer); st != nil {
+		atomic.AddInt64(&st.Conns, 1)
+	}
+}
+
+// Release implements lbapi.ConnAware. The count never goes below
+// zero, as for a peer removed and added again with its connections
+// open: it starts over.
+func (s *lcS) Release(peer lbapi.Peer) {
+	st := s.peers.StatsOf(peer)
+	if st == nil {
+		return
+	}
+	for {
+		n := atomic.LoadInt64(&st.Conns)
+		if n <= 0 || atomic.CompareAndSwapInt64(&st.Conns, n, n-1) {
+			return
+		}
+	}
+}
+
+// Peers implements lbapi.PeerLister.
+func (s *lcS) Peers() []lbapi.Peer {
+	return append([]lbapi.Peer(nil), s.peers.Load().Peers...)
+}
+
+// CountPicks implements lbapi.PickCounter.
+func (s *lcS) CountPicks(on bool) { s.peers.CountPicks(on) }
+
+// Inspect implements lbapi.Inspectable.
+func (s *lcS) Inspect() (snapshot lbapi.Snapshot) {
+	set := s.peers.Load()
+	snapshot.Algorithm = "least-connections"
+	for i, p := range set.Peers {
+		n := atomic.LoadInt64(&set.Stats[i].Picks)
+		snapshot.Peers = append(snapshot.Peers, lbapi.PeerState{
+			Peer:        p,
+			Picks:       n,
+			Connections: atomic.LoadInt64(&set.Stats[i].Conns),
+			Children:    lbapi.Children(p),
+		})
+		snapshot.Picks += n
+	}
+	return
+}
+
+func (s *lcS) Count() int {
+	return s.peers.Load().Len()
+}
+
+func (s *lcS) Add(peers ...lbapi.Peer) {
+	s.Update(peers, nil)
+}
+
+func (s *lcS) AddOne(peer lbapi.Peer) {
+	if s.peers.Add(peer) {
+		s.obs.Emit(lbapi.Event{Type: lbapi.PeerAdded, Peer: peer})
+	}
+}
+
+func (s *lcS) Remove(peer lbapi.Peer) {
+	if removed := s.peers.Remove(peer); removed != nil {
+		s.obs.Emit(lbapi.Event{Type: lbapi.PeerRemoved, Peer: removed})
+	}
+}
+
+// Update implements lbapi.Updater.
+func (s *lcS) Update(add, remove []lbapi.Peer) {
+	s.obs.Changed(s.peers.Update(add, remove))
+}
+
+// Replace implements lbapi.Updater.
+func (s *lcS) Replace(peers ...lbapi.Peer) {
+	s.obs.Changed(s.peers.Replace(peers))
+}
+
+func (s *lcS) Clear() {
+	s.peers.Clear()
+	s.obs.Emit(lbapi.Event{Type: lbapi.Cleared})
+}
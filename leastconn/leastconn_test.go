@@ -0,0 +1,119 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package leastconn_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/leastconn"
+)
+
+type exP string
+
+func (s exP) String() string { return string(s) }
+
+func TestLeastConn(t *testing.T) {
+	lb := leastconn.New()
+	p1, p2, p3 := exP("172.16.0.7:3500"), exP("172.16.0.8:3500"), exP("172.16.0.9:3500")
+	lb.Add(p1, p2, p3)
+
+	ca := lb.(lbapi.ConnAware)
+	ca.Acquire(p1)
+	ca.Acquire(p1)
+	ca.Acquire(p2)
+
+	for i := 0; i < 10; i++ {
+		if p, _ := lb.Next(lbapi.DummyFactor); p != p3 {
+			t.Fatalf("want %v, got %v", p3, p)
+		}
+	}
+
+	ca.Acquire(p3)
+	ca.Acquire(p3)
+	sum := make(map[lbapi.Peer]int)
+	for i := 0; i < 10; i++ {
+		p, _ := lb.Next(lbapi.DummyFactor)
+		sum[p]++
+	}
+	if sum[p2] != 10 {
+		t.Fatalf("want all to %v, got %v", p2, sum)
+	}
+
+	ca.Release(p1)
+	ca.Release(p1)
+	ca.Release(p3)
+	ca.Release(p3)
+	sum = make(map[lbapi.Peer]int)
+	for i := 0; i < 300; i++ {
+		p, _ := lb.Next(lbapi.DummyFactor)
+		sum[p]++
+	}
+	if sum[p1] != 150 || sum[p3] != 150 {
+		t.Fatalf("ties should be broken in round-robin order: %v", sum)
+	}
+}
+
+func TestLeastConn_AddRemove(t *testing.T) {
+	lb := leastconn.New()
+	lb.Add(exP("172.16.0.7:3500"), exP("172.16.0.8:3500"), exP("172.16.0.9:3500"))
+
+	lb.Add(exP("172.16.0.8:3500"))
+	if lb.Count() != 3 {
+		t.Fatal("wrong Add: the dup peer should be ignore")
+	}
+
+	lb.Remove(exP("172.16.0.8:3500"))
+	if lb.Count() != 2 {
+		t.Fatalf("wrong Remove: not removed? count = %v", lb.Count())
+	}
+
+	lb.(lbapi.ConnAware).Release(exP("172.16.0.8:3500"))
+	lb.Clear()
+	if p, _ := lb.Next(lbapi.DummyFactor); p != nil {
+		t.Fatalf("empty balancer returns %v", p)
+	}
+}
+
+func TestLeastConn_Inspect(t *testing.T) {
+	lb := leastconn.New(lbapi.WithPickCounts())
+	p1, p2 := exP("172.16.0.7:3500"), exP("172.16.0.8:3500")
+	lb.Add(p1, p2)
+	lb.(lbapi.ConnAware).Acquire(p2)
+	lb.Next(lbapi.DummyFactor)
+
+	s := lb.(lbapi.Inspectable).Inspect()
+	if s.Algorithm != "least-connections" || s.Picks != 1 || s.Peers[0].Picks != 1 || s.Peers[1].Connections != 1 {
+		t.Fatalf("bad snapshot: %+v", s)
+	}
+}
+
+func BenchmarkLeastConn_Next(b *testing.B) {
+	lb := leastconn.New()
+	for i := 0; i < 16; i++ {
+		lb.Add(exP("172.16.0." + strconv.Itoa(i) + ":3500"))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lb.Next(lbapi.DummyFactor)
+		}
+	})
+}
+
+func TestLeastConn_ReleaseReadded(t *testing.T) {
+	lb := leastconn.New()
+	p := exP("172.16.0.7:3500")
+	lb.Add(p)
+	lb.(lbapi.ConnAware).Acquire(p)
+
+	// removed and added again with the connection open
+	lb.Remove(p)
+	lb.Add(p)
+	lb.(lbapi.ConnAware).Release(p)
+	if s := lb.(lbapi.Inspectable).Inspect(); s.Peers[0].Connections != 0 {
+		t.Fatalf("the connections should not go negative: %v", s.Peers[0].Connections)
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package metrics counts what the balancers do, and exposes the
+// counters in the Prometheus text format without any client
+// library.
+//
+// A balancer is wrapped by Collector.Wrap, which counts the picks
+// of its Next and the outcomes, the in-flight requests and the
+// ejections reported to it through lbapi.FeedbackAware,
+// lbapi.ConnAware and the lbapi.HealthChanged events:
+//
+//	m := metrics.New()
+//	b := m.Wrap("api", health.New(wrr.New(...)))
+//	http.Handle("/", proxy.New(b))
+//	http.Handle("/metrics", m)
+//
+// The metrics are:
+//
+//	lb_peers{balancer}                                  gauge
+//	lb_picks_total{balancer,peer}                       counter
+//	lb_errors_total{balancer,peer}                      counter
+//	lb_in_flight{balancer,peer}                         gauge
+//	lb_ejections_total{balancer,peer}                   counter
+//	lb_request_duration_seconds{balancer,peer}          histogram
+//	lb_unsatisfied_total{balancer}                      counter
+//
+// lb_unsatisfied_total counts the lbapi.Unsatisfied events of a
+// versioning balancer, the picks for which no backend satisfied the
+// picked constraint.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/lb/lbapi"
+)
+
+// DefaultBuckets are the upper bounds (in seconds) of the latency
+// histogram buckets.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// New makes a Collector.
+func New(opts ...Opt) *Collector {
+	c := &Collector{
+		buckets:   DefaultBuckets,
+		balancers: make(map[string]*Balancer),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Opt is a type prototype for New Collector
+type Opt func(c *Collector)
+
+// WithBuckets sets the upper bounds (in seconds, ascending) of the
+// latency histogram buckets.
+func WithBuckets(buckets ...float64) Opt {
+	return func(c *Collector) {
+		c.buckets = buckets
+	}
+}
+
+// Collector holds the metrics of the wrapped balancers. It is an
+// http.Handler serving them in the Prometheus text format.
+type Collector struct {
+	buckets   []float64
+	mu        sync.RWMutex
+	balancers map[string]*Balancer
+}
+
+// Wrap wraps b as the balancer named name, the name is the
+// "balancer" label of its metrics. Wrapping another balancer with
+// the same name replaces it, the replaced one stops observing its
+// balancer.
+func (c *Collector) Wrap(name string, b lbapi.Balancer) *Balancer {
+	w := &Balancer{Balancer: b, name: name, c: c, peers: make(map[string]*peerStats), unsubscribe: func() {}}
+	if o, ok := b.(lbapi.Observable); ok {
+		w.unsubscribe = o.Subscribe(w.observe)
+	}
+	c.mu.Lock()
+	old := c.balancers[name]
+	c.balancers[name] = w
+	c.mu.Unlock()
+	if old != nil {
+		old.unsubscribe()
+	}
+	return w
+}
+
+// Balancer is a balancer with metrics. It passes the feedback,
+// connection and health calls on to the wrapped balancer.
+type Balancer struct {
+	lbapi.Balancer
+	name  string
+	c     *Collector
+	mu    sync.RWMutex
+	peers map[string]*peerStats
+
+	unsatisfied int64
+	unsubscribe func() // from the events of the wrapped balancer
+}
+
+type peerStats struct {
+	picks, errors, inFlight, ejections int64
+	buckets                            []int64 // non-cumulative
+	count, sumNanos                    int64
+}
+
+func (w *Balancer) stats(peer lbapi.Peer) *peerStats {
+	key := peer.String()
+	w.mu.RLock()
+	st, ok := w.peers[key]
+	w.mu.RUnlock()
+	if ok {
+		return st
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if st, ok = w.peers[key]; !ok {
+		st = &peerStats{buckets: make([]int64, len(w.c.buckets))}
+		w.peers[key] = st
+	}
+	return st
+}
+
+// Next picks a peer from the wrapped balancer, and counts it.
+func (w *Balancer) Next(factor lbapi.Factor) (next lbapi.Peer, c lbapi.Constrainable) {
+	if next, c = w.Balancer.Next(factor); next != nil {
+		atomic.AddInt64(&w.stats(next).picks, 1)
+	}
+	return
+}
+
+// Feedback implements lbapi.FeedbackAware.
+func (w *Balancer) Feedback(peer lbapi.Peer, latency time.Duration, err error) {
+	if fa, ok := w.Balancer.(lbapi.FeedbackAware); ok {
+		fa.Feedback(peer, latency, err)
+	}
+
+	st := w.stats(peer)
+	if err != nil {
+		atomic.AddInt64(&st.errors, 1)
+	}
+	seconds := latency.Seconds()
+	for i, le := range w.c.buckets {
+		if seconds <= le {
+			atomic.AddInt64(&st.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddInt64(&st.sumNanos, int64(latency))
+	atomic.AddInt64(&st.count, 1)
+}
+
+// Unwrap implements lbapi.Wrapper.
+func (w *Balancer) Unwrap() lbapi.Balancer { return w.Balancer }
+
+// Acquire implements lbapi.ConnAware.
+func (w *Balancer) Acquire(peer lbapi.Peer) {
+	if ca, ok := w.Balancer.(lbapi.ConnAware); ok {
+		ca.Acquire(peer)
+	}
+	atomic.AddInt64(&w.stats(peer).inFlight, 1)
+}
+
+// Release implements lbapi.ConnAware.
+func (w *Balancer) Release(peer lbapi.Peer) {
+	if ca, ok := w.Balancer.(lbapi.ConnAware); ok {
+		ca.Release(peer)
+	}
+	// a removed peer is forgotten, don't bring it back
+	w.mu.RLock()
+	st, ok := w.peers[peer.String()]
+	w.mu.RUnlock()
+	if ok {
+		atomic.AddInt64(&st.inFlight, -1)
+	}
+}
+
+// Healthy implements lbapi.HealthAware for the wrapped balancer.
+func (w *Balancer) Healthy(peer lbapi.Peer) bool {
+	if ha, ok := w.Balancer.(lbapi.HealthAware); ok {
+		return ha.Healthy(peer)
+	}
+	return true
+}
+
+// Subscribe implements lbapi.Observable for the wrapped balancer.
+func (w *Balancer) Subscribe(fn lbapi.Observer) (unsubscribe func()) {
+	if o, ok := w.Balancer.(lbapi.Observable); ok {
+		return o.Subscribe(fn)
+	}
+	return func() {}
+}
+
+// Update implements lbapi.Updater for the wrapped balancer.
+func (w *Balancer) Update(add, remove []lbapi.Peer) { lbapi.Update(w.Balancer, add, remove) }
+
+// Replace implements lbapi.Updater for the wrapped balancer.
+func (w *Balancer) Replace(peers ...lbapi.Peer) { lbapi.Replace(w.Balancer, peers...) }
+
+func (w *Balancer) observe(e lbapi.Event) {
+	switch e.Type {
+	case lbapi.HealthChanged:
+		if !e.Healthy {
+			atomic.AddInt64(&w.stats(e.Peer).ejections, 1)
+		}
+	case lbapi.Unsatisfied:
+		atomic.AddInt64(&w.unsatisfied, 1)
+	case lbapi.PeerRemoved:
+		w.mu.Lock()
+		delete(w.peers, e.Peer.String())
+		w.mu.Unlock()
+	case lbapi.Cleared:
+		w.mu.Lock()
+		w.peers = make(map[string]*peerStats)
+		w.mu.Unlock()
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (c *Collector) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = c.Write(rw)
+}
+
+// sample is a snapshot of the stats of a peer.
+type sample struct {
+	balancer, peer string
+	st             peerStats
+}
+
+// Write writes the metrics in the Prometheus text format.
+func (c *Collector) Write(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	c.mu.RLock()
+	var names []string
+	for name := range c.balancers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var balancers []*Balancer
+	for _, name := range names {
+		balancers = append(balancers, c.balancers[name])
+	}
+	c.mu.RUnlock()
+
+	var samples []sample
+	for _, b := range balancers {
+		b.mu.RLock()
+		var keys []string
+		for key := range b.peers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			st := b.peers[key]
+			s := sample{balancer: b.name, peer: key, st: peerStats{
+				picks:     atomic.LoadInt64(&st.picks),
+				errors:    atomic.LoadInt64(&st.errors),
+				inFlight:  atomic.LoadInt64(&st.inFlight),
+				ejections: atomic.LoadInt64(&st.ejections),
+				count:     atomic.LoadInt64(&st.count),
+				sumNanos:  atomic.LoadInt64(&st.sumNanos),
+				buckets:   make([]int64, len(st.buckets)),
+			}}
+			for i := range st.buckets {
+				s.st.buckets[i] = atomic.LoadInt64(&st.buckets[i])
+			}
+			samples = append(samples, s)
+		}
+		b.mu.RUnlock()
+	}
+
+	header(w, "lb_peers", "gauge", "The number of peers of the balancer.")
+	for _, b := range balancers {
+		fmt.Fprintf(w, "lb_peers{balancer=\"%s\"} %d\n", escape(b.name), b.Count())
+	}
+
+	counters := []struct {
+		name, kind, help string
+		value            func(st *peerStats) int64
+	}{
+		{"lb_picks_total", "counter", "The peers picked by the balancer.", func(st *peerStats) int64 { return st.picks }},
+		{"lb_errors_total", "counter", "The failed requests reported to the balancer.", func(st *peerStats) int64 { return st.errors }},
+		{"lb_in_flight", "gauge", "The requests or connections in flight.", func(st *peerStats) int64 { return st.inFlight }},
+		{"lb_ejections_total", "counter", "The times the peer became unhealthy.", func(st *peerStats) int64 { return st.ejections }},
+	}
+	for _, m := range counters {
+		header(w, m.name, m.kind, m.help)
+		for i := range samples {
+			s := &samples[i]
+			fmt.Fprintf(w, "%s{%s} %d\n", m.name, s.labels(), m.value(&s.st))
+		}
+	}
+
+	header(w, "lb_request_duration_seconds", "histogram", "The latency of the requests reported to the balancer.")
+	for i := range samples {
+		s := &samples[i]
+		var cum int64
+		for j, le := range c.buckets {
+			cum += s.st.buckets[j]
+			fmt.Fprintf(w, "lb_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", s.labels(), strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "lb_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", s.labels(), s.st.count)
+		fmt.Fprintf(w, "lb_request_duration_seconds_sum{%s} %s\n", s.labels(), strconv.FormatFloat(time.Duration(s.st.sumNanos).Seconds(), 'g', -1, 64))
+		fmt.Fprintf(w, "lb_request_duration_seconds_count{%s} %d\n", s.labels(), s.st.count)
+	}
+
+	header(w, "lb_unsatisfied_total", "counter", "The picks for which no backend satisfied the picked version constraint.")
+	for _, b := range balancers {
+		fmt.Fprintf(w, "lb_unsatisfied_total{balancer=\"%s\"} %d\n", escape(b.name), atomic.LoadInt64(&b.unsatisfied))
+	}
+	return w.Flush()
+}
+
+func (s *sample) labels() string {
+	return fmt.Sprintf("balancer=\"%s\",peer=\"%s\"", escape(s.balancer), escape(s.peer))
+}
+
+func header(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string { return escaper.Replace(s) }
@@ -0,0 +1,144 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package metrics_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb/health"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/metrics"
+	"github.com/hedzr/lb/proxy"
+	"github.com/hedzr/lb/rr"
+	"github.com/hedzr/lb/version"
+)
+
+type exP string
+
+func (s exP) String() string { return string(s) }
+
+func scrape(t *testing.T, h http.Handler) string {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("bad content type: %v", ct)
+	}
+	return rec.Body.String()
+}
+
+func expect(t *testing.T, text string, lines ...string) {
+	for _, l := range lines {
+		if !strings.Contains(text, l+"\n") {
+			t.Fatalf("missing %q in:\n%s", l, text)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	m := metrics.New(metrics.WithBuckets(0.01, 0.1))
+	b := m.Wrap("api", health.New(rr.New(), health.WithThreshold(2)))
+	b.Add(exP("a"), exP(`b"1`))
+
+	for i := 0; i < 4; i++ {
+		b.Next(lbapi.DummyFactor)
+	}
+	b.Acquire(exP("a"))
+	b.Feedback(exP("a"), 5*time.Millisecond, nil)
+	b.Feedback(exP("a"), 50*time.Millisecond, errors.New("boom"))
+	b.Feedback(exP("a"), 2*time.Second, errors.New("boom"))
+
+	text := scrape(t, m)
+	expect(t, text,
+		"# TYPE lb_picks_total counter",
+		`lb_peers{balancer="api"} 2`,
+		`lb_picks_total{balancer="api",peer="a"} 2`,
+		`lb_picks_total{balancer="api",peer="b\"1"} 2`,
+		`lb_errors_total{balancer="api",peer="a"} 2`,
+		`lb_in_flight{balancer="api",peer="a"} 1`,
+		`lb_ejections_total{balancer="api",peer="a"} 1`,
+		"# TYPE lb_request_duration_seconds histogram",
+		`lb_request_duration_seconds_bucket{balancer="api",peer="a",le="0.01"} 1`,
+		`lb_request_duration_seconds_bucket{balancer="api",peer="a",le="0.1"} 2`,
+		`lb_request_duration_seconds_bucket{balancer="api",peer="a",le="+Inf"} 3`,
+		`lb_request_duration_seconds_sum{balancer="api",peer="a"} 2.055`,
+		`lb_request_duration_seconds_count{balancer="api",peer="a"} 3`,
+	)
+
+	// a removed peer is forgotten
+	b.Remove(exP("a"))
+	b.Release(exP("a"))
+	if text = scrape(t, m); strings.Contains(text, `peer="a"`) {
+		t.Fatalf("the removed peer is still there:\n%s", text)
+	}
+}
+
+func TestCollectorProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	m := metrics.New()
+	peer, _ := proxy.NewPeer(backend.URL, 1)
+	b := m.Wrap("web", rr.New())
+	b.Add(peer)
+	srv := httptest.NewServer(proxy.New(b))
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	label := `{balancer="web",peer="` + backend.URL + `"}`
+	expect(t, scrape(t, m),
+		"lb_picks_total"+label+" 3",
+		"lb_errors_total"+label+" 0",
+		"lb_in_flight"+label+" 0",
+		"lb_request_duration_seconds_count"+label+" 3",
+	)
+}
+
+func TestCollectorUnsatisfied(t *testing.T) {
+	bf := version.NewBackendsFactor(rr.New)
+	bf.AddPeers(version.NewBackendFactor("1.0", "172.16.0.7:3500"))
+
+	m := metrics.New()
+	b := m.Wrap("versioned", version.New(version.WithConstrainedPeers(version.NewConstrainablePeer("^1.x", 1), version.NewConstrainablePeer("^2.x", 1))))
+	for i := 0; i < 4; i++ {
+		b.Next(bf)
+	}
+	expect(t, scrape(t, m),
+		"# TYPE lb_unsatisfied_total counter",
+		`lb_unsatisfied_total{balancer="versioned"} 2`,
+	)
+}
+
+// observed counts its observers.
+type observed struct {
+	lbapi.Balancer
+	observers int
+}
+
+func (o *observed) Subscribe(lbapi.Observer) (unsubscribe func()) {
+	o.observers++
+	return func() { o.observers-- }
+}
+
+func TestCollectorRewrap(t *testing.T) {
+	m := metrics.New()
+	b := &observed{Balancer: rr.New()}
+	m.Wrap("api", b)
+	m.Wrap("api", b)
+	if b.observers != 1 {
+		t.Fatalf("the replaced wrapper should stop observing, %v observers", b.observers)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// NewPeer parses target as an upstream URL peer with weight.
+// target must be an absolute URL such as "http://10.0.0.1:8111".
+func NewPeer(target string, weight int) (*Peer, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("proxy: %q is not an absolute url", target)
+	}
+	return &Peer{url: u, weight: weight}, nil
+}
+
+// Peer is an upstream URL, it's a lbapi.WeightedPeer keyed by the
+// URL.
+type Peer struct {
+	url    *url.URL
+	weight int
+}
+
+func (p *Peer) String() string { return p.url.String() }
+func (p *Peer) Key() string    { return p.url.String() }
+func (p *Peer) Weight() int    { return p.weight }
+func (p *Peer) URL() *url.URL  { return p.url }
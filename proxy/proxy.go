@@ -0,0 +1,208 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package proxy provides a load-balanced reverse proxy handler.
+//
+// The peers of the balancer are the upstream URLs, either made by
+// NewPeer or any lbapi.Peer whose String() is an absolute URL.
+//
+// Example:
+//
+//	b := lb.New(lb.WeightedRoundRobin)
+//	for _, target := range []string{"http://10.0.0.1:8111", "http://10.0.0.2:8111"} {
+//	    peer, err := proxy.NewPeer(target, 1)
+//	    if err != nil {
+//	        log.Fatal(err)
+//	    }
+//	    b.Add(peer)
+//	}
+//	log.Fatal(http.ListenAndServe(":8103", proxy.New(b)))
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/hedzr/lb/httpfactor"
+	"github.com/hedzr/lb/internal/urlpeer"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+)
+
+// New makes a reverse proxy handler which forwards each request to
+// the peer picked from b.
+//
+// Transport errors are reported to b if it implements
+// lbapi.FeedbackAware, together with the latency of every request.
+// The requests in flight are reported if b implements
+// lbapi.ConnAware.
+// An idempotent request without body is retried on another peer
+// if the transport failed before a response was received.
+func New(b lbapi.Balancer, opts ...Opt) *Proxy {
+	p := &Proxy{
+		lb:      b,
+		retries: 1,
+		factor:  func(*http.Request) lbapi.Factor { return lbapi.DummyFactor },
+	}
+	p.rp = &httputil.ReverseProxy{
+		Rewrite:      p.rewrite,
+		ErrorHandler: p.errorHandler,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Opt is a type prototype for New Proxy
+type Opt func(p *Proxy)
+
+// WithFactor sets how the factor for lbapi.Balancer.Next is
+// built from a request. The default is lbapi.DummyFactor.
+func WithFactor(factor func(r *http.Request) lbapi.Factor) Opt {
+	return func(p *Proxy) {
+		p.factor = factor
+	}
+}
+
+// WithExtractor builds the factor with a httpfactor.Extractor.
+func WithExtractor(e httpfactor.Extractor) Opt {
+	return func(p *Proxy) {
+		p.factor = func(r *http.Request) lbapi.Factor { return e.Factor(r) }
+	}
+}
+
+// WithRetries sets how many times an idempotent request may be
+// retried on another peer. The default is 1; 0 disables retrying.
+func WithRetries(retries int) Opt {
+	return func(p *Proxy) {
+		p.retries = retries
+	}
+}
+
+// WithTransport sets the transport to the upstreams. The default
+// is http.DefaultTransport.
+func WithTransport(rt http.RoundTripper) Opt {
+	return func(p *Proxy) {
+		p.rp.Transport = rt
+	}
+}
+
+// WithModifyResponse sets httputil.ReverseProxy.ModifyResponse.
+func WithModifyResponse(fn func(*http.Response) error) Opt {
+	return func(p *Proxy) {
+		p.rp.ModifyResponse = fn
+	}
+}
+
+// Proxy is a http.Handler forwarding requests to balanced peers.
+type Proxy struct {
+	lb       lbapi.Balancer
+	rp       *httputil.ReverseProxy
+	retries  int
+	factor   func(r *http.Request) lbapi.Factor
+	resolver urlpeer.Resolver
+}
+
+// ErrNoPeer is reported when no peer could be picked.
+var ErrNoPeer = errors.New("proxy: no available peer")
+
+type attemptKey struct{}
+
+// attempt holds the state of forwarding a request to one peer.
+type attempt struct {
+	target *url.URL
+	err    error
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	factor := p.factor(r)
+	retryable := isIdempotent(r.Method) && (r.Body == nil || r.Body == http.NoBody)
+
+	var tried map[string]bool
+	var lastErr = ErrNoPeer
+	for i := 0; i <= p.retries; i++ {
+		peer := p.pick(factor, tried)
+		if peer == nil {
+			break
+		}
+
+		target, err := p.resolver.Resolve(peer)
+		if err != nil {
+			logger.Errorf("[proxy] %v", err)
+			lastErr = err
+		} else {
+			a := &attempt{target: target}
+			start := time.Now()
+			p.forward(w, r.WithContext(context.WithValue(r.Context(), attemptKey{}, a)), peer)
+			if fa, ok := p.lb.(lbapi.FeedbackAware); ok {
+				fa.Feedback(peer, time.Since(start), a.err)
+			}
+			if a.err == nil {
+				return
+			}
+			logger.Warnf("[proxy] forwarding to %v failed: %v", peer, a.err)
+			lastErr = a.err
+		}
+
+		if !retryable {
+			break
+		}
+		if tried == nil {
+			tried = make(map[string]bool)
+		}
+		tried[peer.String()] = true
+	}
+
+	status := http.StatusBadGateway
+	if errors.Is(lastErr, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// forward sends r to peer, the connection is released even though
+// the reverse proxy panics with http.ErrAbortHandler on a broken
+// response body.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, peer lbapi.Peer) {
+	if ca, ok := p.lb.(lbapi.ConnAware); ok {
+		ca.Acquire(peer)
+		defer ca.Release(peer)
+	}
+	p.rp.ServeHTTP(w, r)
+}
+
+// pick returns the next peer which has not been tried yet.
+func (p *Proxy) pick(factor lbapi.Factor, tried map[string]bool) (peer lbapi.Peer) {
+	for i, n := 0, p.lb.Count(); i < n; i++ {
+		if peer, _ = p.lb.Next(factor); peer == nil || !tried[peer.String()] {
+			return
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	a := pr.In.Context().Value(attemptKey{}).(*attempt)
+	pr.SetURL(a.target)
+	pr.SetXForwarded()
+}
+
+// errorHandler records the error for ServeHTTP, which decides
+// whether to retry or to answer with an error status.
+func (p *Proxy) errorHandler(_ http.ResponseWriter, r *http.Request, err error) {
+	if a, ok := r.Context().Value(attemptKey{}).(*attempt); ok {
+		a.err = err
+	}
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
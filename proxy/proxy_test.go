@@ -0,0 +1,222 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package proxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/leastconn"
+	"github.com/hedzr/lb/proxy"
+	"github.com/hedzr/lb/rr"
+)
+
+// fbBalancer records the feedback reported by the proxy.
+type fbBalancer struct {
+	lbapi.Balancer
+	mu     sync.Mutex
+	errors map[string]int
+	oks    map[string]int
+}
+
+func newFB() *fbBalancer {
+	return &fbBalancer{Balancer: rr.New(), errors: map[string]int{}, oks: map[string]int{}}
+}
+
+func (b *fbBalancer) Feedback(peer lbapi.Peer, latency time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.errors[peer.String()]++
+	} else {
+		b.oks[peer.String()]++
+	}
+}
+
+func mustPeer(t *testing.T, target string) *proxy.Peer {
+	p, err := proxy.NewPeer(target, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func deadURL(t *testing.T) string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+func get(t *testing.T, method, url string) (int, string) {
+	req, _ := http.NewRequest(method, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestProxy(t *testing.T) {
+	var backends []*httptest.Server
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("backend-%d", i)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s %s %s", name, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host"))
+		}))
+		defer srv.Close()
+		backends = append(backends, srv)
+	}
+
+	b := rr.New()
+	for _, srv := range backends {
+		b.Add(mustPeer(t, srv.URL))
+	}
+	front := httptest.NewServer(proxy.New(b))
+	defer front.Close()
+
+	hits := map[string]int{}
+	for i := 0; i < 10; i++ {
+		code, body := get(t, "GET", front.URL+"/hello")
+		if code != http.StatusOK {
+			t.Fatalf("bad status %v", code)
+		}
+		fields := strings.Fields(body)
+		if len(fields) != 4 || fields[1] != "127.0.0.1" || fields[2] != "http" || fields[3] != strings.TrimPrefix(front.URL, "http://") {
+			t.Fatalf("bad X-Forwarded-* headers: %q", body)
+		}
+		hits[fields[0]]++
+	}
+	if hits["backend-0"] != 5 || hits["backend-1"] != 5 {
+		t.Fatalf("bad distribution: %v", hits)
+	}
+}
+
+func TestProxyRetry(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "good")
+	}))
+	defer good.Close()
+	dead := deadURL(t)
+
+	b := newFB()
+	b.Add(mustPeer(t, dead), mustPeer(t, good.URL))
+	front := httptest.NewServer(proxy.New(b))
+	defer front.Close()
+
+	for i := 0; i < 4; i++ {
+		if code, body := get(t, "GET", front.URL); code != http.StatusOK || body != "good" {
+			t.Fatalf("GET should be retried on the good peer: %v %q", code, body)
+		}
+	}
+	if b.errors[dead] == 0 || b.oks[good.URL] != 4 {
+		t.Fatalf("bad feedback: errors = %v, oks = %v", b.errors, b.oks)
+	}
+
+	var failed int
+	for i := 0; i < 4; i++ {
+		if code, _ := get(t, "POST", front.URL); code == http.StatusBadGateway {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Fatalf("POST should not be retried, %d of 4 failed", failed)
+	}
+
+	single := proxy.New(rr.New(), proxy.WithRetries(0))
+	w := httptest.NewRecorder()
+	single.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("empty balancer should answer 502, got %v", w.Code)
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		_ = brw.Flush()
+		line, _ := brw.ReadString('\n')
+		_, _ = brw.WriteString("echo: " + line)
+		_ = brw.Flush()
+	}))
+	defer echo.Close()
+
+	b := rr.New()
+	b.Add(mustPeer(t, echo.URL))
+	front := httptest.NewServer(proxy.New(b))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("bad status %v", resp.StatusCode)
+	}
+	_, _ = io.WriteString(conn, "hello\n")
+	if line, _ := br.ReadString('\n'); line != "echo: hello\n" {
+		t.Fatalf("bad echo %q", line)
+	}
+}
+
+// TestProxyAbortRelease checks a connection is released when the
+// response body breaks and the reverse proxy aborts the handler.
+func TestProxyAbortRelease(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		_, _ = io.WriteString(w, "short")
+		http.NewResponseController(w).Flush()
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}))
+	defer backend.Close()
+
+	b := leastconn.New()
+	b.Add(mustPeer(t, backend.URL))
+	front := httptest.NewServer(proxy.New(b))
+	defer front.Close()
+
+	if resp, err := http.Get(front.URL); err == nil {
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s, _ := lbapi.Inspect(b)
+		if s.Peers[0].Connections == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the connection is not released: %v", s.Peers[0].Connections)
+		}
+	}
+}
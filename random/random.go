@@ -8,16 +8,25 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/hedzr/lb/internal/observer"
+	"github.com/hedzr/lb/internal/peerset"
 	"github.com/hedzr/lb/lbapi"
 )
 
-var seededRand = mrand.New(mrand.NewSource(time.Now().UnixNano()))
-var seedmu sync.Mutex
+// rands are the generators of the pickers, a *mrand.Rand is not
+// safe for concurrent use and a global one would be contended.
+var rands = sync.Pool{
+	New: func() interface{} {
+		return mrand.New(mrand.NewSource(time.Now().UnixNano() + atomic.AddInt64(&seeds, 1)))
+	},
+}
+
+var seeds int64
 
 func inRange(min, max int64) int64 {
-	seedmu.Lock()
-	defer seedmu.Unlock()
-	return seededRand.Int63n(max-min) + min
+	r := rands.Get().(*mrand.Rand)
+	defer rands.Put(r)
+	return r.Int63n(max-min) + min
 }
 
 // New make a new load-balancer instance with Round-Robin
@@ -26,9 +35,8 @@ func New(opts ...lbapi.Opt) lbapi.Balancer {
 }
 
 type randomS struct {
-	peers []lbapi.Peer
-	count int64
-	rw    sync.RWMutex
+	peers peerset.List
+	obs   observer.Set
 }
 
 func (s *randomS) init(opts ...lbapi.Opt) *randomS {
@@ -47,66 +55,76 @@ func (s *randomS) Next(factor lbapi.Factor) (next lbapi.Peer, c lbapi.Constraina
 	} else if nested, ok := next.(lbapi.BalancerLite); ok {
 		next, c = nested.Next(factor)
 	}
+	if next != nil && s.obs.Active() {
+		s.obs.Emit(lbapi.Event{Type: lbapi.Picked, Peer: next, Factor: factor, Constraint: c})
+	}
 	return
 }
 
+// Subscribe implements lbapi.Observable.
+func (s *randomS) Subscribe(fn lbapi.Observer) (unsubscribe func()) { return s.obs.Subscribe(fn) }
+
 func (s *randomS) miniNext() (next lbapi.Peer) {
-	s.rw.RLock()
-	defer s.rw.RUnlock()
+	set := s.peers.Load()
+	if l := set.Len(); l > 0 {
+		ni := inRange(0, int64(l))
+		next = set.Peers[ni]
+		s.peers.Picked(set, int(ni))
+	}
+	return
+}
+
+// Peers implements lbapi.PeerLister.
+func (s *randomS) Peers() []lbapi.Peer {
+	return append([]lbapi.Peer(nil), s.peers.Load().Peers...)
+}
 
-	if l := len(s.peers); l > 0 {
-		ni := atomic.AddInt64(&s.count, inRange(0, int64(l))) % int64(l)
-		next = s.peers[ni]
+// CountPicks implements lbapi.PickCounter.
+func (s *randomS) CountPicks(on bool) { s.peers.CountPicks(on) }
+
+// Inspect implements lbapi.Inspectable.
+func (s *randomS) Inspect() (snapshot lbapi.Snapshot) {
+	set := s.peers.Load()
+	snapshot.Algorithm = "random"
+	for i, p := range set.Peers {
+		n := atomic.LoadInt64(&set.Stats[i].Picks)
+		snapshot.Peers = append(snapshot.Peers, lbapi.PeerState{Peer: p, Picks: n, Children: lbapi.Children(p)})
+		snapshot.Picks += n
 	}
 	return
 }
 
 func (s *randomS) Count() int {
-	s.rw.RLock()
-	defer s.rw.RUnlock()
-	return len(s.peers)
+	return s.peers.Load().Len()
 }
 
 func (s *randomS) Add(peers ...lbapi.Peer) {
-	for _, p := range peers {
-		s.AddOne(p)
-	}
+	s.Update(peers, nil)
 }
 
 func (s *randomS) AddOne(peer lbapi.Peer) {
-	if s.find(peer) {
-		return
+	if s.peers.Add(peer) {
+		s.obs.Emit(lbapi.Event{Type: lbapi.PeerAdded, Peer: peer})
 	}
-
-	s.rw.Lock()
-	defer s.rw.Unlock()
-	s.peers = append(s.peers, peer)
 }
 
-func (s *randomS) find(peer lbapi.Peer) (found bool) {
-	s.rw.RLock()
-	defer s.rw.RUnlock()
-	for _, p := range s.peers {
-		if lbapi.DeepEqual(p, peer) {
-			return true
-		}
+func (s *randomS) Remove(peer lbapi.Peer) {
+	if removed := s.peers.Remove(peer); removed != nil {
+		s.obs.Emit(lbapi.Event{Type: lbapi.PeerRemoved, Peer: removed})
 	}
-	return
 }
 
-func (s *randomS) Remove(peer lbapi.Peer) {
-	s.rw.Lock()
-	defer s.rw.Unlock()
-	for i, p := range s.peers {
-		if lbapi.DeepEqual(p, peer) {
-			s.peers = append(s.peers[0:i], s.peers[i+1:]...)
-			return
-		}
-	}
+// Update implements lbapi.Updater.
+func (s *randomS) Update(add, remove []lbapi.Peer) {
+	s.obs.Changed(s.peers.Update(add, remove))
+}
+
+// Replace implements lbapi.Updater.
+func (s *randomS) Replace(peers ...lbapi.Peer) {
+	s.obs.Changed(s.peers.Replace(peers))
 }
 
 func (s *randomS) Clear() {
-	s.rw.Lock()
-	defer s.rw.Unlock()
-	s.peers = nil
+	s.peers.Clear()
+	s.obs.Emit(lbapi.Event{Type: lbapi.Cleared})
 }
@@ -3,6 +3,7 @@
 package random_test
 
 import (
+	"strconv"
 	"sync"
 	"testing"
 
@@ -80,3 +81,17 @@ func TestRandom_M1(t *testing.T) {
 
 	lb.Clear()
 }
+
+func BenchmarkRandom_Next(b *testing.B) {
+	lb := random.New()
+	for i := 0; i < 16; i++ {
+		lb.Add(exP("172.16.0." + strconv.Itoa(i) + ":3500"))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lb.Next(lbapi.DummyFactor)
+		}
+	})
+}
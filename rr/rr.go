@@ -3,9 +3,10 @@
 package rr
 
 import (
-	"sync"
 	"sync/atomic"
 
+	"github.com/hedzr/lb/internal/observer"
+	"github.com/hedzr/lb/internal/peerset"
 	"github.com/hedzr/lb/lbapi"
 )
 
@@ -15,9 +16,9 @@ func New(opts ...lbapi.Opt) lbapi.Balancer {
 }
 
 type rrS struct {
-	peers []lbapi.Peer
+	peers peerset.List
 	count int64
-	rw    sync.RWMutex
+	obs   observer.Set
 }
 
 func (s *rrS) init(opts ...lbapi.Opt) *rrS {
@@ -34,68 +35,80 @@ func (s *rrS) Next(factor lbapi.Factor) (next lbapi.Peer, c lbapi.Constrainable)
 	} else if nested, ok := next.(lbapi.BalancerLite); ok {
 		next, c = nested.Next(factor)
 	}
+	if next != nil && s.obs.Active() {
+		s.obs.Emit(lbapi.Event{Type: lbapi.Picked, Peer: next, Factor: factor, Constraint: c})
+	}
 	return
 }
 
+// Subscribe implements lbapi.Observable.
+func (s *rrS) Subscribe(fn lbapi.Observer) (unsubscribe func()) { return s.obs.Subscribe(fn) }
+
 func (s *rrS) miniNext() (next lbapi.Peer) {
 	ni := atomic.AddInt64(&s.count, 1)
 
 	ni--
 
-	s.rw.RLock()
-	defer s.rw.RUnlock()
-	if len(s.peers) > 0 {
-		ni %= int64(len(s.peers))
-		next = s.peers[ni]
+	set := s.peers.Load()
+	if l := set.Len(); l > 0 {
+		ni %= int64(l)
+		next = set.Peers[ni]
+		s.peers.Picked(set, int(ni))
+	}
+	return
+}
+
+// Peers implements lbapi.PeerLister.
+func (s *rrS) Peers() []lbapi.Peer {
+	return append([]lbapi.Peer(nil), s.peers.Load().Peers...)
+}
+
+// CountPicks implements lbapi.PickCounter.
+func (s *rrS) CountPicks(on bool) { s.peers.CountPicks(on) }
+
+// Inspect implements lbapi.Inspectable.
+func (s *rrS) Inspect() (snapshot lbapi.Snapshot) {
+	set := s.peers.Load()
+	snapshot.Algorithm = "round-robin"
+	for i, p := range set.Peers {
+		n := atomic.LoadInt64(&set.Stats[i].Picks)
+		snapshot.Peers = append(snapshot.Peers, lbapi.PeerState{Peer: p, Picks: n, Children: lbapi.Children(p)})
+		snapshot.Picks += n
 	}
 	return
 }
 
 func (s *rrS) Count() int {
-	s.rw.RLock()
-	defer s.rw.RUnlock()
-	return len(s.peers)
+	return s.peers.Load().Len()
 }
 
 func (s *rrS) Add(peers ...lbapi.Peer) {
-	for _, p := range peers {
-		s.AddOne(p)
-	}
+	s.Update(peers, nil)
 }
 
 func (s *rrS) AddOne(peer lbapi.Peer) {
-	if s.find(peer) {
-		return
+	if s.peers.Add(peer) {
+		s.obs.Emit(lbapi.Event{Type: lbapi.PeerAdded, Peer: peer})
 	}
-	s.rw.Lock()
-	defer s.rw.Unlock()
-	s.peers = append(s.peers, peer)
 }
 
-func (s *rrS) find(peer lbapi.Peer) (found bool) {
-	s.rw.RLock()
-	defer s.rw.RUnlock()
-	for _, p := range s.peers {
-		if lbapi.DeepEqual(p, peer) {
-			return true
-		}
+func (s *rrS) Remove(peer lbapi.Peer) {
+	if removed := s.peers.Remove(peer); removed != nil {
+		s.obs.Emit(lbapi.Event{Type: lbapi.PeerRemoved, Peer: removed})
 	}
-	return
 }
 
-func (s *rrS) Remove(peer lbapi.Peer) {
-	s.rw.Lock()
-	defer s.rw.Unlock()
-	for i, p := range s.peers {
-		if lbapi.DeepEqual(p, peer) {
-			s.peers = append(s.peers[0:i], s.peers[i+1:]...)
-			return
-		}
-	}
+// Update implements lbapi.Updater.
+func (s *rrS) Update(add, remove []lbapi.Peer) {
+	s.obs.Changed(s.peers.Update(add, remove))
+}
+
+// Replace implements lbapi.Updater.
+func (s *rrS) Replace(peers ...lbapi.Peer) {
+	s.obs.Changed(s.peers.Replace(peers))
 }
 
 func (s *rrS) Clear() {
-	s.rw.Lock()
-	defer s.rw.Unlock()
-	s.peers = nil
+	s.peers.Clear()
+	s.obs.Emit(lbapi.Event{Type: lbapi.Cleared})
 }
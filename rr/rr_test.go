@@ -3,6 +3,9 @@
 package rr_test
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 
@@ -81,3 +84,62 @@ func TestRR_M1(t *testing.T) {
 
 	lb.Clear()
 }
+
+func TestRR_Events(t *testing.T) {
+	lb := rr.New()
+	var events []string
+	cancel := lb.(lbapi.Observable).Subscribe(func(e lbapi.Event) {
+		events = append(events, fmt.Sprintf("%v %v", e.Type, e.Peer))
+	})
+
+	lb.Add(exP("a"), exP("b"), exP("a"))
+	lb.Next(lbapi.DummyFactor)
+	lb.Remove(exP("b"))
+	lb.Remove(exP("b"))
+	lb.Clear()
+	cancel()
+	lb.Add(exP("c"))
+
+	want := "PeerAdded a,PeerAdded b,Picked a,PeerRemoved b,Cleared <nil>"
+	if got := strings.Join(events, ","); got != want {
+		t.Fatalf("bad events:\n got: %v\nwant: %v", got, want)
+	}
+}
+
+func TestRR_Inspect(t *testing.T) {
+	lb := rr.New(lbapi.WithPickCounts())
+	lb.Add(exP("a"), exP("b"), exP("c"))
+	for i := 0; i < 7; i++ {
+		lb.Next(lbapi.DummyFactor)
+	}
+	lb.Remove(exP("b"))
+
+	s := lb.(lbapi.Inspectable).Inspect()
+	if s.Algorithm != "round-robin" || len(s.Peers) != 2 || s.Picks != 5 {
+		t.Fatalf("bad snapshot: %+v", s)
+	}
+	if s.Peers[0].Peer != exP("a") || s.Peers[0].Picks != 3 || s.Peers[1].Peer != exP("c") || s.Peers[1].Picks != 2 {
+		t.Fatalf("bad peer states: %+v", s.Peers)
+	}
+
+	lb = rr.New()
+	lb.Add(exP("a"))
+	lb.Next(lbapi.DummyFactor)
+	if s = lb.(lbapi.Inspectable).Inspect(); s.Picks != 0 {
+		t.Fatalf("the picks should not be counted by default: %+v", s)
+	}
+}
+
+func BenchmarkRR_Next(b *testing.B) {
+	lb := rr.New()
+	for i := 0; i < 16; i++ {
+		lb.Add(exP("172.16.0." + strconv.Itoa(i) + ":3500"))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lb.Next(lbapi.DummyFactor)
+		}
+	})
+}
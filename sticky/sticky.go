@@ -0,0 +1,254 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package sticky provides cookie-based session affinity on top of
+// any lbapi.Balancer.
+//
+// The first request of a client is balanced as usual, and the
+// chosen peer is written into a signed (HMAC-SHA256) cookie. The
+// following requests carrying that cookie are routed to the same
+// peer as long as it is still present and healthy, no matter how
+// far a round-robin or weighted round-robin balancer has rotated.
+//
+// Example:
+//
+//	b := sticky.New(rr.New(), []byte("secret"))
+//	b.Add(peers...)
+//	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+//	    peer, _ := b.Pick(w, r, lbapi.DummyFactor)
+//	    ...
+//	})
+package sticky
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/hedzr/lb/lbapi"
+)
+
+// DefaultCookieName is the name of the affinity cookie if
+// WithCookieName is not specified.
+const DefaultCookieName = "lb_sticky"
+
+// New wraps a balancer with a sticky-session layer. secret is the
+// HMAC key to sign the affinity cookie.
+//
+// The peers added through the returned Balancer are found at once.
+// The peers of nested balancers, such as groups, and the backends of
+// a factor listing them, such as a version.BackendsFactor, are found
+// through lbapi.PeerLister, which takes a walk over them.
+func New(b lbapi.Balancer, secret []byte, opts ...Opt) *Balancer {
+	s := &Balancer{
+		lb:     b,
+		secret: secret,
+		cookie: http.Cookie{Name: DefaultCookieName, Path: "/", HttpOnly: true},
+		peers:  make(map[string]lbapi.Peer),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Opt is a type prototype for New sticky Balancer
+type Opt func(s *Balancer)
+
+// WithCookieName sets the name of the affinity cookie.
+func WithCookieName(name string) Opt {
+	return func(s *Balancer) {
+		s.cookie.Name = name
+	}
+}
+
+// WithCookie sets the template of the affinity cookie. Its Value
+// will be replaced with the signed peer identity.
+func WithCookie(template http.Cookie) Opt {
+	return func(s *Balancer) {
+		s.cookie = template
+	}
+}
+
+// WithHealthCheck adds a health predicate. An unhealthy peer in the
+// cookie causes a re-pick. If the wrapped balancer implements
+// lbapi.HealthAware it is consulted as well.
+func WithHealthCheck(healthy func(peer lbapi.Peer) bool) Opt {
+	return func(s *Balancer) {
+		s.healthy = healthy
+	}
+}
+
+// Balancer is a lbapi.Balancer with cookie-based affinity.
+type Balancer struct {
+	lb      lbapi.Balancer
+	secret  []byte
+	cookie  http.Cookie
+	healthy func(peer lbapi.Peer) bool
+	peers   map[string]lbapi.Peer
+	rw      sync.RWMutex
+}
+
+// Pick returns the peer for request r. The affinity cookie is
+// (re)written into w when the peer is newly chosen. There is no
+// peer, and no cookie, when all peers are unhealthy.
+func (s *Balancer) Pick(w http.ResponseWriter, r *http.Request, factor lbapi.Factor) (peer lbapi.Peer, c lbapi.Constrainable) {
+	if ck, err := r.Cookie(s.cookie.Name); err == nil {
+		if id, ok := s.verify(ck.Value); ok {
+			if peer = s.lookup(id, factor); peer != nil {
+				return
+			}
+		}
+	}
+
+	// re-pick, skipping the unhealthy peers
+	for i, n := 0, s.lb.Count(); i < n || i == 0; i++ {
+		if peer, c = s.lb.Next(factor); peer == nil || s.isHealthy(peer) {
+			break
+		}
+	}
+	if peer != nil && !s.isHealthy(peer) {
+		return nil, nil
+	}
+	if peer != nil {
+		ck := s.cookie
+		ck.Value = s.sign(peer.String())
+		http.SetCookie(w, &ck)
+	}
+	return
+}
+
+func (s *Balancer) lookup(id string, factor lbapi.Factor) (peer lbapi.Peer) {
+	s.rw.RLock()
+	peer = s.peers[id]
+	s.rw.RUnlock()
+
+	if peer == nil {
+		if peer = resolve(s.lb, id); peer == nil {
+			peer = resolve(factor, id)
+		}
+	}
+	if peer != nil && !s.isHealthy(peer) {
+		peer = nil
+	}
+	return
+}
+
+// resolve finds the leaf peer of id among the peers of x and of the
+// balancers nested in it, x is looked through lbapi.Wrapper.
+func resolve(x interface{}, id string) lbapi.Peer {
+	for x != nil {
+		if pl, ok := x.(lbapi.PeerLister); ok {
+			for _, p := range pl.Peers() {
+				if _, nested := p.(lbapi.BalancerLite); nested {
+					if leaf := resolve(p, id); leaf != nil {
+						return leaf
+					}
+				} else if p.String() == id {
+					return p
+				}
+			}
+			return nil
+		}
+		w, ok := x.(lbapi.Wrapper)
+		if !ok {
+			break
+		}
+		x = w.Unwrap()
+	}
+	return nil
+}
+
+func (s *Balancer) isHealthy(peer lbapi.Peer) bool {
+	if ha, ok := s.lb.(lbapi.HealthAware); ok && !ha.Healthy(peer) {
+		return false
+	}
+	return s.healthy == nil || s.healthy(peer)
+}
+
+func (s *Balancer) sign(id string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString([]byte(id)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Balancer) verify(value string) (id string, ok bool) {
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		return
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return
+	}
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(raw)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return
+	}
+	return string(raw), true
+}
+
+// Next picks a peer without affinity, see Pick.
+func (s *Balancer) Next(factor lbapi.Factor) (next lbapi.Peer, c lbapi.Constrainable) {
+	return s.lb.Next(factor)
+}
+
+func (s *Balancer) Count() int { return s.lb.Count() }
+
+// Unwrap implements lbapi.Wrapper.
+func (s *Balancer) Unwrap() lbapi.Balancer { return s.lb }
+
+func (s *Balancer) Add(peers ...lbapi.Peer) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	for _, p := range peers {
+		s.peers[p.String()] = p
+	}
+	s.lb.Add(peers...)
+}
+
+func (s *Balancer) Remove(peer lbapi.Peer) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	delete(s.peers, peer.String())
+	s.lb.Remove(peer)
+}
+
+// Update implements lbapi.Updater.
+func (s *Balancer) Update(add, remove []lbapi.Peer) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	for _, p := range remove {
+		delete(s.peers, p.String())
+	}
+	for _, p := range add {
+		s.peers[p.String()] = p
+	}
+	lbapi.Update(s.lb, add, remove)
+}
+
+// Replace implements lbapi.Updater.
+func (s *Balancer) Replace(peers ...lbapi.Peer) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.peers = make(map[string]lbapi.Peer, len(peers))
+	for _, p := range peers {
+		s.peers[p.String()] = p
+	}
+	lbapi.Replace(s.lb, peers...)
+}
+
+func (s *Balancer) Clear() {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.peers = make(map[string]lbapi.Peer)
+	s.lb.Clear()
+}
@@ -0,0 +1,153 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package sticky_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hedzr/lb"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/rr"
+	"github.com/hedzr/lb/sticky"
+	"github.com/hedzr/lb/version"
+	"github.com/hedzr/lb/wrandom"
+	"github.com/hedzr/lb/wrr"
+)
+
+type exP struct {
+	addr   string
+	weight int
+}
+
+func (s *exP) String() string { return s.addr }
+func (s *exP) Weight() int    { return s.weight }
+
+func pick(b *sticky.Balancer, ck *http.Cookie) (lbapi.Peer, *http.Cookie) {
+	return pickBy(b, ck, lbapi.DummyFactor)
+}
+
+func pickBy(b *sticky.Balancer, ck *http.Cookie, factor lbapi.Factor) (lbapi.Peer, *http.Cookie) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if ck != nil {
+		r.AddCookie(ck)
+	}
+	w := httptest.NewRecorder()
+	p, _ := b.Pick(w, r, factor)
+	cookies := w.Result().Cookies()
+	if len(cookies) > 0 {
+		return p, cookies[0]
+	}
+	return p, nil
+}
+
+func TestSticky(t *testing.T) {
+	p1, p2, p3 := &exP{"172.16.0.7:3500", 5}, &exP{"172.16.0.8:3500", 3}, &exP{"172.16.0.9:3500", 2}
+	for name, inner := range map[string]lbapi.Balancer{"rr": rr.New(), "wrr": wrr.New()} {
+		b := sticky.New(inner, []byte("secret"))
+		b.Add(p1, p2, p3)
+
+		first, ck := pick(b, nil)
+		if ck == nil || ck.Name != sticky.DefaultCookieName {
+			t.Fatalf("%s: affinity cookie should be set", name)
+		}
+		for i := 0; i < 20; i++ {
+			p, set := pick(b, ck)
+			if p != first {
+				t.Fatalf("%s: sticky session broken: want %v, got %v", name, first, p)
+			}
+			if set != nil {
+				t.Fatalf("%s: cookie should not be rewritten for a sticky hit", name)
+			}
+		}
+
+		b.Remove(first)
+		p, set := pick(b, ck)
+		if p == first || p == nil {
+			t.Fatalf("%s: removed peer %v should not be picked", name, first)
+		}
+		if set == nil {
+			t.Fatalf("%s: cookie should be rewritten after re-picking", name)
+		}
+	}
+}
+
+func TestStickyTampered(t *testing.T) {
+	p1, p2 := &exP{"172.16.0.7:3500", 1}, &exP{"172.16.0.8:3500", 1}
+	b := sticky.New(rr.New(), []byte("secret"))
+	b.Add(p1, p2)
+
+	_, ck := pick(b, nil)
+	forged := sticky.New(rr.New(), []byte("another"))
+	forged.Add(p1, p2)
+	_, bad := pick(forged, nil)
+
+	for _, c := range []*http.Cookie{
+		{Name: ck.Name, Value: bad.Value},
+		{Name: ck.Name, Value: "garbage"},
+		{Name: ck.Name, Value: ck.Value + "x"},
+	} {
+		if _, set := pick(b, c); set == nil {
+			t.Fatalf("cookie %q should be rejected", c.Value)
+		}
+	}
+}
+
+func TestStickyHealth(t *testing.T) {
+	p1, p2 := &exP{"172.16.0.7:3500", 1}, &exP{"172.16.0.8:3500", 1}
+	down := map[lbapi.Peer]bool{}
+	b := sticky.New(rr.New(), []byte("secret"),
+		sticky.WithCookieName("aff"),
+		sticky.WithHealthCheck(func(peer lbapi.Peer) bool { return !down[peer] }))
+	b.Add(p1, p2)
+
+	first, ck := pick(b, nil)
+	if ck.Name != "aff" {
+		t.Fatalf("bad cookie name %q", ck.Name)
+	}
+	down[first] = true
+	if p, set := pick(b, ck); p == first || set == nil {
+		t.Fatalf("unhealthy peer %v should be re-picked", first)
+	}
+
+	down[p1], down[p2] = true, true
+	if p, set := pick(b, ck); p != nil || set != nil {
+		t.Fatalf("no peer should be picked when all are unhealthy: %v, %v", p, set)
+	}
+}
+
+func TestStickyNested(t *testing.T) {
+	p1, p2, p3 := &exP{"172.16.0.7:3500", 1}, &exP{"172.16.0.8:3500", 1}, &exP{"172.16.0.9:3500", 1}
+	g1 := wrandom.NewPeer(1, rr.New, lb.WithPeers(p1, p2))
+	b := sticky.New(wrandom.New(wrandom.WithWeightedBalancedPeers(g1, wrandom.NewPeer(1, rr.New, lb.WithPeers(p3)))), []byte("secret"))
+
+	first, ck := pick(b, nil)
+	for i := 0; i < 10; i++ {
+		if p, set := pick(b, ck); p != first || set != nil {
+			t.Fatalf("the leaf of a group should stick: want %v, got %v", first, p)
+		}
+	}
+	if first != p3 {
+		g1.Remove(first)
+		if p, set := pick(b, ck); p == first || set == nil {
+			t.Fatalf("the leaf removed from its group should be re-picked: %v", p)
+		}
+	}
+}
+
+func TestStickyVersioned(t *testing.T) {
+	bf := version.NewBackendsFactor(rr.New)
+	bf.AddPeers(version.NewBackendFactor("1.0", "172.16.0.7:3500"), version.NewBackendFactor("1.1", "172.16.0.8:3500"))
+	b := sticky.New(version.New(version.WithConstrainedPeers(version.NewConstrainablePeer("^1.x", 1))), []byte("secret"))
+
+	first, ck := pickBy(b, nil, bf)
+	if first == nil || ck == nil {
+		t.Fatalf("bad pick: %v", first)
+	}
+	for i := 0; i < 10; i++ {
+		if p, set := pickBy(b, ck, bf); p != first || set != nil {
+			t.Fatalf("the backend should stick: want %v, got %v", first, p)
+		}
+	}
+}
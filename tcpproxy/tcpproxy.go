@@ -0,0 +1,335 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package tcpproxy provides a layer-4 TCP proxy which splices
+// client connections to the peers ("host:port") of a balancer.
+//
+// Example:
+//
+//	b := lb.New(lb.ConsistentHash, lb.WithPeers(backends...))
+//	p := tcpproxy.New(b, tcpproxy.WithMaxConns(1000), tcpproxy.WithIdleTimeout(5*time.Minute))
+//	ln, _ := net.Listen("tcp", ":6380")
+//	go p.Serve(ln)
+//	...
+//	_ = p.Shutdown(ctx) // stop accepting and drain the live connections
+package tcpproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/lb/dialer"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+)
+
+// New makes a TCP proxy to the peers of b. The factor of each
+// connection is the client IP by default, so lb.ConsistentHash
+// keeps a client on the same backend.
+func New(b lbapi.Balancer, opts ...Opt) *Proxy {
+	p := &Proxy{
+		factor:    ClientIP,
+		netDialer: &net.Dialer{Timeout: 10 * time.Second},
+		conns:     make(map[net.Conn]struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.dialer = dialer.New(b, dialer.WithDialer(p.netDialer))
+	if p.maxConns > 0 {
+		p.sem = make(chan struct{}, p.maxConns)
+	}
+	return p
+}
+
+// Opt is a type prototype for New Proxy
+type Opt func(p *Proxy)
+
+// WithMaxConns limits the concurrent client connections. When the
+// limit is reached, the proxy stops accepting until a connection
+// is closed. 0 means no limit.
+func WithMaxConns(n int) Opt {
+	return func(p *Proxy) {
+		p.maxConns = n
+	}
+}
+
+// WithIdleTimeout closes a connection pair when no byte has been
+// transferred in either direction for d. 0 means no timeout.
+func WithIdleTimeout(d time.Duration) Opt {
+	return func(p *Proxy) {
+		p.idleTimeout = d
+	}
+}
+
+// WithDialTimeout sets the timeout of connecting a backend.
+func WithDialTimeout(d time.Duration) Opt {
+	return func(p *Proxy) {
+		p.netDialer.Timeout = d
+	}
+}
+
+// WithFactor sets how the factor is built from a client connection.
+func WithFactor(factor func(c net.Conn) lbapi.Factor) Opt {
+	return func(p *Proxy) {
+		p.factor = factor
+	}
+}
+
+// ClientIP is the default factor: the IP of the client.
+func ClientIP(c net.Conn) lbapi.Factor {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return lbapi.FactorString(addr)
+}
+
+// Proxy is a TCP proxy.
+type Proxy struct {
+	dialer      *dialer.Dialer
+	netDialer   *net.Dialer
+	factor      func(c net.Conn) lbapi.Factor
+	maxConns    int
+	idleTimeout time.Duration
+	sem         chan struct{}
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	clients   int
+	wg        sync.WaitGroup
+	closing   int32
+	done      chan struct{}
+}
+
+// ErrProxyClosed is returned by Serve after Shutdown or Close.
+var ErrProxyClosed = errors.New("tcpproxy: proxy closed")
+
+// Serve accepts the connections of ln and proxies them until
+// Shutdown or Close is called.
+func (p *Proxy) Serve(ln net.Listener) error {
+	if !p.trackListener(ln) {
+		return ErrProxyClosed
+	}
+
+	var delay time.Duration
+	for {
+		if p.sem != nil {
+			select {
+			case p.sem <- struct{}{}:
+			case <-p.done:
+				return ErrProxyClosed
+			}
+		}
+
+		c, err := ln.Accept()
+		if err != nil {
+			p.releaseSlot()
+			if atomic.LoadInt32(&p.closing) != 0 {
+				return ErrProxyClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if delay = delay*2 + 5*time.Millisecond; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		if !p.trackClient(c) {
+			p.releaseSlot()
+			_ = c.Close()
+			continue
+		}
+		go p.handle(c)
+	}
+}
+
+func (p *Proxy) releaseSlot() {
+	if p.sem != nil {
+		<-p.sem
+	}
+}
+
+func (p *Proxy) trackListener(ln net.Listener) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if atomic.LoadInt32(&p.closing) != 0 {
+		return false
+	}
+	p.listeners = append(p.listeners, ln)
+	return true
+}
+
+// trackConn registers a live backend connection so that it can be
+// closed by Close, or unregisters it.
+func (p *Proxy) trackConn(c net.Conn, add bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if add {
+		p.conns[c] = struct{}{}
+	} else {
+		delete(p.conns, c)
+	}
+}
+
+// trackClient registers a client connection. It is counted in the
+// wait group under the same lock which Shutdown takes, so that
+// Shutdown never misses it.
+func (p *Proxy) trackClient(c net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if atomic.LoadInt32(&p.closing) != 0 {
+		return false
+	}
+	p.conns[c] = struct{}{}
+	p.clients++
+	p.wg.Add(1)
+	return true
+}
+
+func (p *Proxy) untrackClient(c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, c)
+	p.clients--
+}
+
+// Active returns the number of live client connections.
+func (p *Proxy) Active() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.clients
+}
+
+func (p *Proxy) handle(client net.Conn) {
+	defer p.wg.Done()
+	defer p.releaseSlot()
+	defer p.untrackClient(client)
+	defer client.Close()
+
+	ctx := lbapi.ContextWithFactor(context.Background(), p.factor(client))
+	backend, err := p.dialer.DialContext(ctx, "tcp", "")
+	if err != nil {
+		logger.Errorf("[tcpproxy] %v: no backend: %v", client.RemoteAddr(), err)
+		return
+	}
+	defer backend.Close()
+
+	p.trackConn(backend, true)
+	defer p.trackConn(backend, false)
+
+	var last int64 = time.Now().UnixNano()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.pipe(backend, client, &last)
+	}()
+	go func() {
+		defer wg.Done()
+		p.pipe(client, backend, &last)
+	}()
+	wg.Wait()
+}
+
+// pipe copies src to dst. last is the time of the last activity
+// of both directions, so that a quiet direction is not timed out
+// while the other one is busy.
+func (p *Proxy) pipe(dst, src net.Conn, last *int64) {
+	buf := make([]byte, 32*1024)
+	for {
+		if p.idleTimeout > 0 {
+			_ = src.SetReadDeadline(time.Unix(0, atomic.LoadInt64(last)).Add(p.idleTimeout))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(last, time.Now().UnixNano())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				_ = dst.Close()
+				_ = src.Close()
+				return
+			}
+		}
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() &&
+				time.Since(time.Unix(0, atomic.LoadInt64(last))) < p.idleTimeout {
+				continue // the other direction is still active
+			}
+			if err != io.EOF {
+				_ = dst.Close()
+				_ = src.Close()
+				return
+			}
+			break
+		}
+	}
+
+	// half-close: pass the EOF on, let the other direction finish
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+}
+
+// Shutdown stops accepting new connections and waits until the
+// live connections are closed by their peers, or until ctx is done,
+// in which case the remaining connections are closed forcibly.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.closeListeners()
+
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		p.closeConns()
+		<-drained
+		return ctx.Err()
+	}
+}
+
+// Close closes the listeners and all live connections immediately.
+func (p *Proxy) Close() error {
+	p.closeListeners()
+	p.closeConns()
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Proxy) closeListeners() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if atomic.CompareAndSwapInt32(&p.closing, 0, 1) {
+		close(p.done)
+	}
+	for _, ln := range p.listeners {
+		_ = ln.Close()
+	}
+	p.listeners = nil
+}
+
+func (p *Proxy) closeConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		_ = c.Close()
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package tcpproxy_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb/hash"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/rr"
+	"github.com/hedzr/lb/tcpproxy"
+)
+
+type exP string
+
+func (s exP) String() string { return string(s) }
+
+// echoServer greets with name and echoes the lines it reads.
+func echoServer(t *testing.T, name string) (exP, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.WriteString(c, name+"\n")
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return exP(ln.Addr().String()), func() { _ = ln.Close() }
+}
+
+func startProxy(t *testing.T, b lbapi.Balancer, opts ...tcpproxy.Opt) (*tcpproxy.Proxy, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := tcpproxy.New(b, opts...)
+	go func() { _ = p.Serve(ln) }()
+	return p, ln.Addr().String()
+}
+
+type client struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *client) line(t *testing.T) string {
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s[:len(s)-1]
+}
+
+func TestProxy(t *testing.T) {
+	a1, c1 := echoServer(t, "s1")
+	defer c1()
+	a2, c2 := echoServer(t, "s2")
+	defer c2()
+
+	p, addr := startProxy(t, rr.New(func(b lbapi.Balancer) { b.Add(a1, a2) }))
+	defer p.Close()
+
+	sum := map[string]int{}
+	for i := 0; i < 4; i++ {
+		c := dial(t, addr)
+		sum[c.line(t)]++
+		_, _ = io.WriteString(c, "hello\n")
+		if got := c.line(t); got != "hello" {
+			t.Fatalf("bad echo %q", got)
+		}
+		_ = c.Close()
+	}
+	if sum["s1"] != 2 || sum["s2"] != 2 {
+		t.Fatalf("bad distribution: %v", sum)
+	}
+
+	// half-close: the client stops writing but still reads the echo
+	c := dial(t, addr)
+	c.line(t)
+	_, _ = io.WriteString(c, "bye\n")
+	_ = c.Conn.(*net.TCPConn).CloseWrite()
+	if got := c.line(t); got != "bye" {
+		t.Fatalf("bad echo after half-close %q", got)
+	}
+	_ = c.Close()
+}
+
+func TestProxyHash(t *testing.T) {
+	a1, c1 := echoServer(t, "s1")
+	defer c1()
+	a2, c2 := echoServer(t, "s2")
+	defer c2()
+	a3, c3 := echoServer(t, "s3")
+	defer c3()
+
+	p, addr := startProxy(t, hash.New(func(b lbapi.Balancer) { b.Add(a1, a2, a3) }))
+	defer p.Close()
+
+	first := dial(t, addr)
+	want := first.line(t)
+	_ = first.Close()
+	for i := 0; i < 5; i++ {
+		c := dial(t, addr)
+		if got := c.line(t); got != want {
+			t.Fatalf("a client ip should stick to %v, got %v", want, got)
+		}
+		_ = c.Close()
+	}
+}
+
+func TestProxyLimits(t *testing.T) {
+	a1, c1 := echoServer(t, "s1")
+	defer c1()
+
+	p, addr := startProxy(t, rr.New(func(b lbapi.Balancer) { b.Add(a1) }),
+		tcpproxy.WithMaxConns(1), tcpproxy.WithIdleTimeout(200*time.Millisecond))
+	defer p.Close()
+
+	first := dial(t, addr)
+	first.line(t)
+
+	second := dial(t, addr)
+	_ = second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := second.r.ReadString('\n'); err == nil {
+		t.Fatal("the second connection should wait for a free slot")
+	}
+
+	// the first one is closed when idle, then the second gets served
+	if got := second.line(t); got != "s1" {
+		t.Fatalf("bad greeting %q", got)
+	}
+	_ = first.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := first.r.ReadString('\n'); err == nil {
+		t.Fatal("the idle connection should be closed")
+	}
+	_ = second.Close()
+}
+
+func TestProxyShutdown(t *testing.T) {
+	a1, c1 := echoServer(t, "s1")
+	defer c1()
+
+	p, addr := startProxy(t, rr.New(func(b lbapi.Balancer) { b.Add(a1) }))
+	c := dial(t, addr)
+	c.line(t)
+
+	done := make(chan error)
+	go func() { done <- p.Shutdown(context.Background()) }()
+
+	// a live connection keeps working while draining
+	time.Sleep(50 * time.Millisecond)
+	_, _ = io.WriteString(c, "still\n")
+	if got := c.line(t); got != "still" {
+		t.Fatalf("bad echo while draining %q", got)
+	}
+	if _, err := net.DialTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+		t.Fatal("new connections should be refused while draining")
+	}
+	select {
+	case <-done:
+		t.Fatal("Shutdown should wait for the live connection")
+	default:
+	}
+
+	_ = c.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// forced shutdown
+	p, addr = startProxy(t, rr.New(func(b lbapi.Balancer) { b.Add(a1) }))
+	c = dial(t, addr)
+	c.line(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+	if p.Active() != 0 {
+		t.Fatalf("all connections should be closed, %v left", p.Active())
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package transport provides a load-balancing http.RoundTripper
+// for outbound clients.
+//
+// Each outgoing request gets its scheme and host rewritten to a
+// peer picked from the balancer, so any *http.Client spreads its
+// requests over the instances of a service transparently.
+//
+// Example:
+//
+//	b := lb.New(lb.RoundRobin)
+//	b.Add(peer1, peer2) // proxy.NewPeer("http://10.0.0.1:8111", 1), ...
+//	client := &http.Client{Transport: transport.New(b)}
+//	ctx := lbapi.ContextWithFactor(context.Background(), lbapi.FactorString("user-1"))
+//	req, _ := http.NewRequestWithContext(ctx, "GET", "http://my-service/api/users", nil)
+//	resp, err := client.Do(req)
+package transport
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hedzr/lb/internal/urlpeer"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+)
+
+// New makes a http.RoundTripper which sends each request to the
+// peer picked from b. The factor is taken from the request context,
+// see lbapi.ContextWithFactor.
+//
+// A request failing at connection level (the peer could not be
+// dialed, so nothing was sent) is retried on a different peer.
+// The latency and the error of each attempt are reported to b if
+// it implements lbapi.FeedbackAware, and each attempt is acquired
+// and released (until the response header) if it implements
+// lbapi.ConnAware.
+func New(b lbapi.Balancer, opts ...Opt) *Transport {
+	t := &Transport{
+		lb:      b,
+		base:    http.DefaultTransport,
+		retries: 2,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Opt is a type prototype for New Transport
+type Opt func(t *Transport)
+
+// WithBase sets the underlying transport, the default is
+// http.DefaultTransport.
+func WithBase(rt http.RoundTripper) Opt {
+	return func(t *Transport) {
+		t.base = rt
+	}
+}
+
+// WithRetries sets how many times a request failing at connection
+// level may be retried on another peer. The default is 2.
+func WithRetries(retries int) Opt {
+	return func(t *Transport) {
+		t.retries = retries
+	}
+}
+
+// Transport is a load-balancing http.RoundTripper.
+type Transport struct {
+	lb       lbapi.Balancer
+	base     http.RoundTripper
+	retries  int
+	resolver urlpeer.Resolver
+}
+
+// ErrNoPeer is returned when no peer could be picked.
+var ErrNoPeer = errors.New("transport: no available peer")
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	factor := lbapi.FactorFromContext(req.Context())
+	rewindable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	var tried map[string]bool
+	err = ErrNoPeer
+	for i := 0; i <= t.retries; i++ {
+		peer := t.pick(factor, tried)
+		if peer == nil {
+			break
+		}
+
+		var out *http.Request
+		if out, err = t.rewrite(req, peer, i > 0); err != nil {
+			break
+		}
+
+		start := time.Now()
+		ca, _ := t.lb.(lbapi.ConnAware)
+		if ca != nil {
+			ca.Acquire(peer)
+		}
+		resp, err = t.base.RoundTrip(out)
+		if ca != nil {
+			ca.Release(peer)
+		}
+		if fa, ok := t.lb.(lbapi.FeedbackAware); ok {
+			fa.Feedback(peer, time.Since(start), err)
+		}
+		if err == nil || !isConnError(err) || !rewindable {
+			return
+		}
+
+		logger.Warnf("[transport] connecting to %v failed: %v", peer, err)
+		if tried == nil {
+			tried = make(map[string]bool)
+		}
+		tried[peer.String()] = true
+	}
+	// the request was not sent, its body is closed all the same, as
+	// http.RoundTripper says
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+	return
+}
+
+// pick returns the next peer which has not been tried yet.
+func (t *Transport) pick(factor lbapi.Factor, tried map[string]bool) (peer lbapi.Peer) {
+	for i, n := 0, t.lb.Count(); i < n; i++ {
+		if peer, _ = t.lb.Next(factor); peer == nil || !tried[peer.String()] {
+			return
+		}
+	}
+	return nil
+}
+
+func (t *Transport) rewrite(req *http.Request, peer lbapi.Peer, retrying bool) (out *http.Request, err error) {
+	target, err := t.resolver.Resolve(peer)
+	if err != nil {
+		return
+	}
+
+	out = req.Clone(req.Context())
+	out.URL.Scheme = target.Scheme
+	out.URL.Host = target.Host
+	if p := strings.TrimRight(target.Path, "/"); p != "" {
+		out.URL.Path = p + "/" + strings.TrimLeft(out.URL.Path, "/")
+		out.URL.RawPath = ""
+	}
+	out.Host = ""
+
+	if retrying && req.GetBody != nil {
+		out.Body, err = req.GetBody()
+	}
+	return
+}
+
+// isConnError tells whether err happened before the request was
+// sent, so that it is safe to retry with any method.
+func isConnError(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
@@ -0,0 +1,150 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package transport_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb/hash"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/rr"
+	"github.com/hedzr/lb/transport"
+)
+
+type exP string
+
+func (s exP) String() string { return string(s) }
+
+type fbBalancer struct {
+	lbapi.Balancer
+	mu     sync.Mutex
+	errors map[string]int
+	oks    map[string]int
+}
+
+func (b *fbBalancer) Feedback(peer lbapi.Peer, latency time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.errors[peer.String()]++
+	} else {
+		b.oks[peer.String()]++
+	}
+}
+
+func newServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = io.WriteString(w, name+" "+r.URL.Path+" "+string(body))
+	}))
+}
+
+func do(t *testing.T, c *http.Client, ctx context.Context, method, body string) string {
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	req, _ := http.NewRequestWithContext(ctx, method, "http://my-service/api/users", rd)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return string(b)
+}
+
+func TestTransport(t *testing.T) {
+	s1, s2 := newServer("s1"), newServer("s2")
+	defer s1.Close()
+	defer s2.Close()
+
+	c := &http.Client{Transport: transport.New(rr.New(lbapiPeers(s1.URL, s2.URL+"/prefix")...))}
+	hits := map[string]int{}
+	for i := 0; i < 10; i++ {
+		hits[do(t, c, context.Background(), "GET", "")]++
+	}
+	if hits["s1 /api/users "] != 5 || hits["s2 /prefix/api/users "] != 5 {
+		t.Fatalf("bad distribution: %v", hits)
+	}
+}
+
+func lbapiPeers(urls ...string) []lbapi.Opt {
+	return []lbapi.Opt{func(b lbapi.Balancer) {
+		for _, u := range urls {
+			b.Add(exP(u))
+		}
+	}}
+}
+
+func TestTransportFactor(t *testing.T) {
+	s1, s2, s3 := newServer("s1"), newServer("s2"), newServer("s3")
+	defer s1.Close()
+	defer s2.Close()
+	defer s3.Close()
+
+	c := &http.Client{Transport: transport.New(hash.New(lbapiPeers(s1.URL, s2.URL, s3.URL)...))}
+	ctx := lbapi.ContextWithFactor(context.Background(), lbapi.FactorString("user-1"))
+	first := do(t, c, ctx, "GET", "")
+	for i := 0; i < 10; i++ {
+		if got := do(t, c, ctx, "GET", ""); got != first {
+			t.Fatalf("same factor should stick: %q vs %q", got, first)
+		}
+	}
+}
+
+func TestTransportRetry(t *testing.T) {
+	good := newServer("good")
+	defer good.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	b := &fbBalancer{Balancer: rr.New(lbapiPeers(dead.URL, good.URL)...), errors: map[string]int{}, oks: map[string]int{}}
+	c := &http.Client{Transport: transport.New(b)}
+	for i := 0; i < 4; i++ {
+		if got := do(t, c, context.Background(), "POST", "payload"); got != "good /api/users payload" {
+			t.Fatalf("request should be retried on the good peer, got %q", got)
+		}
+	}
+	if b.errors[dead.URL] != 4 || b.oks[good.URL] != 4 {
+		t.Fatalf("bad feedback: errors = %v, oks = %v", b.errors, b.oks)
+	}
+
+	c = &http.Client{Transport: transport.New(rr.New(lbapiPeers(dead.URL)...), transport.WithRetries(0))}
+	req, _ := http.NewRequest("GET", "http://my-service/", nil)
+	if _, err := c.Do(req); err == nil {
+		t.Fatal("the only dead peer should fail")
+	}
+}
+
+// body records whether it's closed.
+type body struct {
+	io.Reader
+	closed bool
+}
+
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestTransportCloseBody(t *testing.T) {
+	for name, b := range map[string]lbapi.Balancer{
+		"no peer":  rr.New(),
+		"bad peer": rr.New(lbapiPeers("not-a-url")...),
+	} {
+		req, _ := http.NewRequest("POST", "http://my-service/", nil)
+		rb := &body{Reader: strings.NewReader("payload")}
+		req.Body = rb
+		if _, err := transport.New(b).RoundTrip(req); err == nil || !rb.closed {
+			t.Fatalf("%s: the body should be closed on an error: %v, closed = %v", name, err, rb.closed)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright © 2021 Hedzr Yeh.
+
+// Package udpproxy provides a UDP forwarder which keeps the packets
+// of a flow on the same backend.
+//
+// A flow is identified by its 5-tuple (protocol, client address and
+// the local address it was sent to). The first packet of a flow
+// picks a peer ("host:port") with the flow key as factor, so with
+// hash.New the mapping is stable; the following packets go to the
+// same backend through the flow table, and the replies of the
+// backend are relayed back to the client. Idle flows expire after
+// the flow timeout.
+//
+// A new flow is picked, resolved and dialed in its own goroutine, so
+// that a slow one doesn't hold up the other flows of the socket; its
+// datagrams are queued meanwhile, up to MaxPending.
+//
+// Example:
+//
+//	b := hash.New(lb.WithPeers(dnsServers...))
+//	p := udpproxy.New(b, udpproxy.WithFlowTimeout(30*time.Second))
+//	pc, _ := net.ListenPacket("udp", ":53")
+//	go p.Serve(pc)
+package udpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+)
+
+// New makes a UDP forwarder to the peers of b.
+func New(b lbapi.Balancer, opts ...Opt) *Proxy {
+	p := &Proxy{
+		lb:          b,
+		flowTimeout: time.Minute,
+		flows:       make(map[string]*flow),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.flowTimeout <= 0 {
+		p.flowTimeout = time.Minute
+	}
+	return p
+}
+
+// Opt is a type prototype for New Proxy
+type Opt func(p *Proxy)
+
+// WithFlowTimeout sets how long a flow without traffic is kept in
+// the flow table. The default is one minute.
+func WithFlowTimeout(d time.Duration) Opt {
+	return func(p *Proxy) {
+		p.flowTimeout = d
+	}
+}
+
+// Proxy is a UDP forwarder with flow affinity.
+type Proxy struct {
+	lb          lbapi.Balancer
+	flowTimeout time.Duration
+
+	mu     sync.Mutex
+	flows  map[string]*flow
+	pcs    []net.PacketConn
+	closed bool
+	ctx    context.Context // done once closed
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// MaxPending is the number of datagrams of a flow queued while its
+// backend is being dialed, the following ones are dropped.
+const MaxPending = 64
+
+// flow is guarded by Proxy.mu, but backend and peer, which are set
+// once the flow is ready.
+type flow struct {
+	client  net.Addr
+	peer    lbapi.Peer
+	backend net.Conn
+	ready   bool
+	pending [][]byte // the datagrams before ready
+	seen    int64    // unix nano
+}
+
+func (f *flow) close() {
+	if f.backend != nil {
+		_ = f.backend.Close()
+	}
+}
+
+// ErrProxyClosed is returned by Serve after Close.
+var ErrProxyClosed = errors.New("udpproxy: proxy closed")
+
+// Serve reads the datagrams of pc and forwards them until Close
+// is called.
+func (p *Proxy) Serve(pc net.PacketConn) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrProxyClosed
+	}
+	p.pcs = append(p.pcs, pc)
+	if len(p.pcs) == 1 {
+		p.wg.Add(1)
+		go p.janitor()
+	}
+	p.mu.Unlock()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if p.isClosed() {
+				return ErrProxyClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		f, err := p.flowOf(pc, client, buf[:n])
+		if err != nil {
+			logger.Warnf("[udpproxy] %v: %v", client, err)
+			continue
+		}
+		if f == nil {
+			continue // queued
+		}
+		if _, err = f.backend.Write(buf[:n]); err != nil {
+			logger.Warnf("[udpproxy] %v -> %v: %v", client, f.peer, err)
+		}
+	}
+}
+
+// Key returns the flow key of a datagram from client to local.
+func Key(client, local net.Addr) string {
+	return client.Network() + "|" + client.String() + "|" + local.String()
+}
+
+// flowOf returns the ready flow of a datagram from client, or nil
+// if the datagram is queued for a flow being dialed.
+func (p *Proxy) flowOf(pc net.PacketConn, client net.Addr, datagram []byte) (f *flow, err error) {
+	key := Key(client, pc.LocalAddr())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrProxyClosed
+	}
+	if f = p.flows[key]; f == nil {
+		f = &flow{client: client}
+		p.flows[key] = f
+		p.wg.Add(1)
+		go p.open(pc, key, f)
+	}
+	f.seen = time.Now().UnixNano()
+	if f.ready {
+		return f, nil
+	}
+	if len(f.pending) < MaxPending {
+		f.pending = append(f.pending, append([]byte(nil), datagram...))
+	}
+	return nil, nil
+}
+
+// open picks the peer of a new flow and dials it, sends the queued
+// datagrams, and then relays the replies.
+func (p *Proxy) open(pc net.PacketConn, key string, f *flow) {
+	defer p.wg.Done()
+	peer, _ := p.lb.Next(lbapi.FactorString(key))
+	if peer == nil {
+		logger.Warnf("[udpproxy] %v: no available peer", f.client)
+		p.evict(key, f)
+		return
+	}
+	var d net.Dialer
+	backend, err := d.DialContext(p.ctx, "udp", peer.String())
+	if err != nil {
+		logger.Warnf("[udpproxy] %v -> %v: %v", f.client, peer, err)
+		p.evict(key, f)
+		return
+	}
+
+	p.mu.Lock()
+	if p.closed || p.flows[key] != f {
+		// closed or expired meanwhile
+		p.mu.Unlock()
+		_ = backend.Close()
+		return
+	}
+	f.peer, f.backend = peer, backend
+	for {
+		// the datagrams queued while sending keep their order
+		pending := f.pending
+		f.pending = nil
+		if len(pending) == 0 {
+			f.ready = true
+			break
+		}
+		p.mu.Unlock()
+		for _, datagram := range pending {
+			if _, err = backend.Write(datagram); err != nil {
+				logger.Warnf("[udpproxy] %v -> %v: %v", f.client, peer, err)
+			}
+		}
+		p.mu.Lock()
+	}
+	p.mu.Unlock()
+
+	p.relay(pc, key, f)
+}
+
+// relay sends the replies of the backend back to the client.
+func (p *Proxy) relay(pc net.PacketConn, key string, f *flow) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.backend.Read(buf)
+		if err != nil {
+			// closed by janitor/Close, or an ICMP error from the backend
+			p.evict(key, f)
+			return
+		}
+
+		p.mu.Lock()
+		f.seen = time.Now().UnixNano()
+		p.mu.Unlock()
+		if _, err = pc.WriteTo(buf[:n], f.client); err != nil {
+			logger.Warnf("[udpproxy] %v <- %v: %v", f.client, f.peer, err)
+		}
+	}
+}
+
+func (p *Proxy) evict(key string, f *flow) {
+	p.mu.Lock()
+	if p.flows[key] == f {
+		delete(p.flows, key)
+	}
+	p.mu.Unlock()
+	f.close()
+}
+
+// janitor expires the idle flows.
+func (p *Proxy) janitor() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.flowTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			for key, f := range p.flows {
+				if now.Sub(time.Unix(0, f.seen)) >= p.flowTimeout {
+					delete(p.flows, key)
+					f.close()
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// Flows returns the number of live flows.
+func (p *Proxy) Flows() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.flows)
+}
+
+func (p *Proxy) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// Close closes the packet conns being served and all flows.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.cancel()
+	for _, pc := range p.pcs {
+		_ = pc.Close()
+	}
+	for key, f := range p.flows {
+		delete(p.flows, key)
+		f.close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return nil
+}
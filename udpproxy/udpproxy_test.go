@@ -0,0 +1,165 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package udpproxy_test
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hedzr/lb/hash"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/udpproxy"
+)
+
+type exP string
+
+func (s exP) String() string { return string(s) }
+
+// udpEcho answers each datagram with "name: payload".
+func udpEcho(t *testing.T, name string) (exP, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo([]byte(name+": "+string(buf[:n])), addr)
+		}
+	}()
+	return exP(pc.LocalAddr().String()), func() { _ = pc.Close() }
+}
+
+func ask(t *testing.T, c net.Conn, msg string) string {
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestUDPProxy(t *testing.T) {
+	var peers []lbapi.Peer
+	for _, name := range []string{"s1", "s2", "s3"} {
+		addr, closer := udpEcho(t, name)
+		defer closer()
+		peers = append(peers, addr)
+	}
+
+	p := udpproxy.New(hash.New(func(b lbapi.Balancer) { b.Add(peers...) }),
+		udpproxy.WithFlowTimeout(200*time.Millisecond))
+	defer p.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = p.Serve(pc) }()
+
+	used := map[string]bool{}
+	for i := 0; i < 8; i++ {
+		c, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := ask(t, c, "q0")
+		name := strings.SplitN(first, ":", 2)[0]
+		used[name] = true
+		for j := 1; j < 5; j++ {
+			if got := ask(t, c, "q"); got != name+": q" {
+				t.Fatalf("a flow should stick to %v, got %q", name, got)
+			}
+		}
+		_ = c.Close()
+	}
+	if len(used) < 2 {
+		t.Logf("flows were not spread: %v", used)
+	}
+	if p.Flows() != 8 {
+		t.Fatalf("want 8 flows, got %v", p.Flows())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Flows() > 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if p.Flows() != 0 {
+		t.Fatalf("idle flows should expire, %v left", p.Flows())
+	}
+
+	_ = p.Close()
+	if err := p.Serve(pc); err != udpproxy.ErrProxyClosed {
+		t.Fatalf("want ErrProxyClosed, got %v", err)
+	}
+}
+
+// slowB blocks the first pick until release is closed.
+type slowB struct {
+	lbapi.Balancer
+	picks   int32
+	release chan struct{}
+}
+
+func (b *slowB) Next(factor lbapi.Factor) (lbapi.Peer, lbapi.Constrainable) {
+	if atomic.AddInt32(&b.picks, 1) == 1 {
+		<-b.release
+	}
+	return b.Balancer.Next(factor)
+}
+
+// TestUDPProxySlowFlow checks a flow being set up holds up no other
+// flow, and gets its datagrams in order once ready.
+func TestUDPProxySlowFlow(t *testing.T) {
+	addr, closer := udpEcho(t, "s1")
+	defer closer()
+	b := &slowB{Balancer: hash.New(func(b lbapi.Balancer) { b.Add(addr) }), release: make(chan struct{})}
+	p := udpproxy.New(b)
+	defer p.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = p.Serve(pc) }()
+
+	slow, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"a", "b"} {
+		if _, err = slow.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for atomic.LoadInt32(&b.picks) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	fast, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ask(t, fast, "q"); got != "s1: q" {
+		t.Fatalf("bad reply: %q", got)
+	}
+
+	close(b.release)
+	_ = slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	for _, want := range []string{"s1: a", "s1: b"} {
+		n, err := slow.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("want %q, got %q, %v", want, buf[:n], err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ package version
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/hedzr/lb/lbapi"
@@ -20,10 +21,21 @@ type VersioningBackendFactor interface {
 // NewBackendFactor make a instance with (backend address, version) pair.
 // version can be 'v1.2.3' or '1.2.3', 'v' will be striped.
 // address is like 'host:port' typically, but you can use any forms you like.
+//
+// The backend is a lbapi.WeightedPeer of weight 1, see
+// NewWeightedBackendFactor.
 func NewBackendFactor(version string, addr string) VersioningBackendFactor {
+	return NewWeightedBackendFactor(version, addr, 1)
+}
+
+// NewWeightedBackendFactor make a instance with (backend address, version) pair
+// and a weight, which is honored by a weighted sub-balancer such as wrr. The
+// weight can be changed by BackendsFactor.SetWeight.
+func NewWeightedBackendFactor(version string, addr string, weight int) VersioningBackendFactor {
 	f := &backendFactor{
 		version: verCleanup(version),
 		addr:    addr,
+		weight:  int64(weight),
 	}
 
 	var err error
@@ -39,6 +51,7 @@ type backendFactor struct {
 	version    string
 	addr       string
 	versionObj *semver.Version
+	weight     int64 // atomic, see SetWeight
 }
 
 func verCleanup(v string) string {
@@ -50,6 +63,12 @@ func verCleanup(v string) string {
 
 func (f *backendFactor) Factor() string { return f.version }
 func (f *backendFactor) String() string { return fmt.Sprintf("%v - %v", f.addr, f.version) }
+func (f *backendFactor) Addr() string   { return f.addr }
+func (f *backendFactor) Weight() int    { return int(atomic.LoadInt64(&f.weight)) }
+
+// SetWeight changes the weight in place, a balancer holding the
+// backend must be told too, see BackendsFactor.SetWeight.
+func (f *backendFactor) SetWeight(weight int) { atomic.StoreInt64(&f.weight, int64(weight)) }
 func (f *backendFactor) Version() *semver.Version {
 	if f.versionObj == nil {
 		f.versionObj, _ = semver.NewVersion(f.version)
@@ -3,9 +3,12 @@
 package version
 
 import (
+	"strconv"
 	"testing"
 
+	"github.com/hedzr/lb/lbapi"
 	"github.com/hedzr/lb/rr"
+	"github.com/hedzr/lb/wrr"
 )
 
 func TestBackendFactor(t *testing.T) {
@@ -29,3 +32,124 @@ func TestBackendsFactor(t *testing.T) {
 	bef.AddPeers(bf)
 	t.Logf("bef: %v, factor = %v", bef, bef.Factor())
 }
+
+func TestBackendsFactorEvents(t *testing.T) {
+	bf := NewBackendsFactor(rr.New)
+	bf.AddPeers(NewBackendFactor("1.3", "172.16.0.7:3500"), NewBackendFactor("2.0", "172.16.0.8:3500"))
+	c := NewConstrainablePeer("^2.x", 1)
+	b := New(WithConstrainedPeers(c))
+
+	var picked []lbapi.Event
+	b.(lbapi.Observable).Subscribe(func(e lbapi.Event) {
+		if e.Type == lbapi.Picked {
+			picked = append(picked, e)
+		}
+	})
+	b.Next(bf)
+	if len(picked) != 1 || picked[0].Constraint != c || picked[0].Peer.String() != "172.16.0.8:3500 - 2.0" {
+		t.Fatalf("bad pick events: %+v", picked)
+	}
+}
+
+func TestBackendsFactorRotates(t *testing.T) {
+	b1, b2, b3 := NewBackendFactor("2.0", "172.16.0.7:3500"), NewBackendFactor("2.1", "172.16.0.8:3500"), NewBackendFactor("1.0", "172.16.0.9:3500")
+	bf := NewBackendsFactor(rr.New)
+	bf.AddPeers(b1, b2, b3)
+	c := NewConstrainablePeer("^2.x", 1)
+
+	sum := make(map[lbapi.Peer]int)
+	for i := 0; i < 10; i++ {
+		p, cc, satisfied := bf.ConstrainedBy(c)
+		if !satisfied || cc != c {
+			t.Fatalf("bad pick: %v, %v, %v", p, cc, satisfied)
+		}
+		sum[p]++
+	}
+	if sum[b1] != 5 || sum[b2] != 5 {
+		t.Fatalf("the inner rr should rotate: %v", sum)
+	}
+
+	// AddPeers invalidates the cached sub-balancer
+	b4 := NewBackendFactor("2.2", "172.16.0.10:3500")
+	bf.AddPeers(b4)
+	sum = make(map[lbapi.Peer]int)
+	for i := 0; i < 9; i++ {
+		p, _, _ := bf.ConstrainedBy(c)
+		sum[p]++
+	}
+	if sum[b1] != 3 || sum[b2] != 3 || sum[b4] != 3 {
+		t.Fatalf("the new backend is not picked: %v", sum)
+	}
+
+	if p, _, satisfied := bf.ConstrainedBy(NewConstrainablePeer("^3.x", 1)); satisfied || p != nil {
+		t.Fatalf("nothing should satisfy ^3.x: %v", p)
+	}
+}
+
+func BenchmarkBackendsFactor_ConstrainedBy(b *testing.B) {
+	bf := NewBackendsFactor(rr.New)
+	for i := 0; i < 64; i++ {
+		bf.AddPeers(NewBackendFactor("2."+strconv.Itoa(i%8), "172.16.0."+strconv.Itoa(i)+":3500"))
+	}
+	c := NewConstrainablePeer("^2.x", 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			bf.ConstrainedBy(c)
+		}
+	})
+}
+
+func TestBackendsFactorLive(t *testing.T) {
+	var opts int
+	gen := func(o ...lbapi.Opt) lbapi.Balancer {
+		opts = len(o)
+		return wrr.New(o...)
+	}
+	b1, b2, b3 := NewBackendFactor("2.0", "172.16.0.7:3500"), NewBackendFactor("2.1", "172.16.0.8:3500"), NewWeightedBackendFactor("2.2", "172.16.0.9:3500", 2)
+	bf := NewBackendsFactor(gen, func(lbapi.Balancer) {})
+	bf.AddPeers(b1, b2, b3, b1)
+	c := NewConstrainablePeer("^2.x", 1)
+
+	picks := func(n int) map[lbapi.Peer]int {
+		sum := make(map[lbapi.Peer]int)
+		for i := 0; i < n; i++ {
+			p, _, _ := bf.ConstrainedBy(c)
+			sum[p]++
+		}
+		return sum
+	}
+
+	if sum := picks(8); opts != 1 || sum[b1] != 2 || sum[b2] != 2 || sum[b3] != 4 {
+		t.Fatalf("bad weighted picks: %v, opts = %v", sum, opts)
+	}
+
+	bf.SetWeight(b1, 3)
+	if sum := picks(12); sum[b1] != 6 || sum[b2] != 2 || sum[b3] != 4 {
+		t.Fatalf("the new weight is not honored: %v", sum)
+	}
+
+	bf.SetHealthy(b1, false)
+	if sum := picks(6); sum[b1] != 0 || sum[b2] != 2 || sum[b3] != 4 {
+		t.Fatalf("a down backend is picked: %v", sum)
+	}
+	bf.SetHealthy(b1, true)
+	if sum := picks(12); sum[b1] != 6 {
+		t.Fatalf("an up backend is not picked: %v", sum)
+	}
+
+	bf.RemovePeers(b3)
+	if sum := picks(8); sum[b3] != 0 || sum[b1] != 6 || sum[b2] != 2 {
+		t.Fatalf("a removed backend is picked: %v", sum)
+	}
+
+	b4 := NewBackendFactor("3.0", "172.16.0.10:3500")
+	bf.SetPeers(b2, b4)
+	if sum := picks(4); sum[b2] != 4 {
+		t.Fatalf("bad picks after SetPeers: %v", sum)
+	}
+	if p, _, satisfied := bf.ConstrainedBy(NewConstrainablePeer("^3.x", 1)); !satisfied || p != b4 {
+		t.Fatalf("the new backend is not picked: %v", p)
+	}
+}
@@ -4,22 +4,44 @@ package version
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/hedzr/lb/lbapi"
 )
 
 // BackendsFactor interface
+//
+// The backends are identified by lbapi.Same. All methods are safe
+// for concurrent use.
 type BackendsFactor interface {
 	lbapi.FactorComparable
+	// AddPeers adds the backends which are not there yet.
 	AddPeers(peers ...VersioningBackendFactor)
+	// RemovePeers removes the backends.
+	RemovePeers(peers ...VersioningBackendFactor)
+	// SetPeers makes peers the backends, the kept ones keep their
+	// state in the sub-balancers. It suits a discovery source which
+	// sends the full list.
+	SetPeers(peers ...VersioningBackendFactor)
+	// SetWeight changes the weight of a backend in place, for a
+	// sub-balancer honoring the weights such as wrr. The backend
+	// must have a SetWeight(int) method, as NewBackendFactor makes.
+	SetWeight(peer VersioningBackendFactor, weight int)
+	// SetHealthy marks a backend up or down, a down backend is left
+	// out of the picks until it's up again.
+	SetHealthy(peer VersioningBackendFactor, healthy bool)
+	// Backends returns the backends, including the down ones.
+	Backends() []VersioningBackendFactor
 }
 
 // NewBackendsFactor bundle a balancer generator and its opts into a BackendsFactor.
 //
 // A BackendsFactor holds a set of VersioningBackendFactor. These backends can be
-// added with BackendsFactor.AddPeers(...).
+// added with BackendsFactor.AddPeers(...), and changed live by RemovePeers,
+// SetPeers, SetWeight and SetHealthy.
 //
-// The bundled balancer will be used as a second-level balancer following up the parent.
+// The bundled balancer will be used as a second-level balancer following up the parent,
+// it's made by gen with opts for each constraint.
 //
 // Example:
 //
@@ -42,58 +64,213 @@ type BackendsFactor interface {
 //	peer, c := lb.Next(factor)
 func NewBackendsFactor(gen func(opts ...lbapi.Opt) lbapi.Balancer, opts ...lbapi.Opt) BackendsFactor {
 	return &backendsFactor{
-		generator:   gen,
-		opts:        opts,
-		constraints: make(map[lbapi.Constrainable]lbapi.Balancer),
+		generator: gen,
+		opts:      opts,
 	}
 }
 
+// backendsFactor publishes the backends as an immutable set, and
+// caches a sub-balancer of the satisfying backends for each
+// constraint. A sub-balancer built from an older set is brought up
+// to date on its next use, so a pick costs no rebuilding while the
+// backends are unchanged.
 type backendsFactor struct {
-	backends    []VersioningBackendFactor
-	constraints map[lbapi.Constrainable]lbapi.Balancer
-	crw         sync.RWMutex
-	generator   func(opts ...lbapi.Opt) lbapi.Balancer
-	opts        []lbapi.Opt
+	backends  atomic.Pointer[backendSet]
+	subs      sync.Map   // lbapi.Constrainable -> *sub
+	mu        sync.Mutex // for the writers of backends and subs
+	generator func(opts ...lbapi.Opt) lbapi.Balancer
+	opts      []lbapi.Opt
+}
+
+type backendSet struct {
+	backends []VersioningBackendFactor
+	down     map[string]bool // the keys of the unhealthy backends
+}
+
+// sub is a sub-balancer up to date with the set of.
+type sub struct {
+	lb        lbapi.Balancer
+	of        *backendSet
+	satisfied bool
+}
+
+var noBackends = &backendSet{}
+
+func (fa *backendsFactor) load() *backendSet {
+	if set := fa.backends.Load(); set != nil {
+		return set
+	}
+	return noBackends
+}
+
+// update publishes the set made by fn from a copy of the current one.
+func (fa *backendsFactor) update(fn func(set *backendSet)) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	old := fa.load()
+	set := &backendSet{
+		backends: append([]VersioningBackendFactor(nil), old.backends...),
+		down:     make(map[string]bool, len(old.down)),
+	}
+	for k := range old.down {
+		set.down[k] = true
+	}
+	fn(set)
+	fa.backends.Store(set)
+}
+
+// backendKey identifies a backend in the down set.
+func backendKey(peer lbapi.Peer) string {
+	if k, ok := peer.(lbapi.Keyed); ok {
+		return k.Key()
+	}
+	return peer.String()
+}
+
+func (set *backendSet) find(peer lbapi.Peer) int {
+	for i, b := range set.backends {
+		if lbapi.Same(b, peer) {
+			return i
+		}
+	}
+	return -1
 }
 
 func (fa *backendsFactor) AddPeers(peers ...VersioningBackendFactor) {
-	fa.backends = append(fa.backends, peers...)
+	fa.update(func(set *backendSet) {
+		for _, p := range peers {
+			if set.find(p) < 0 {
+				set.backends = append(set.backends, p)
+			}
+		}
+	})
+}
+
+func (fa *backendsFactor) RemovePeers(peers ...VersioningBackendFactor) {
+	fa.update(func(set *backendSet) {
+		for _, p := range peers {
+			if i := set.find(p); i >= 0 {
+				set.backends = append(set.backends[:i], set.backends[i+1:]...)
+				delete(set.down, backendKey(p))
+			}
+		}
+	})
+}
+
+func (fa *backendsFactor) SetPeers(peers ...VersioningBackendFactor) {
+	fa.update(func(set *backendSet) {
+		wanted := make(map[string]bool, len(peers))
+		set.backends = set.backends[:0]
+		for _, p := range peers {
+			if set.find(p) < 0 {
+				set.backends = append(set.backends, p)
+				wanted[backendKey(p)] = true
+			}
+		}
+		for k := range set.down {
+			if !wanted[k] {
+				delete(set.down, k)
+			}
+		}
+	})
+}
+
+func (fa *backendsFactor) SetHealthy(peer VersioningBackendFactor, healthy bool) {
+	fa.update(func(set *backendSet) {
+		if healthy {
+			delete(set.down, backendKey(peer))
+		} else if set.find(peer) >= 0 {
+			set.down[backendKey(peer)] = true
+		}
+	})
+}
+
+func (fa *backendsFactor) SetWeight(peer VersioningBackendFactor, weight int) {
+	set := fa.load()
+	i := set.find(peer)
+	if i < 0 {
+		return
+	}
+	b := set.backends[i]
+	if ws, ok := b.(interface{ SetWeight(weight int) }); ok {
+		ws.SetWeight(weight)
+	}
+	wp, ok := b.(lbapi.WeightedPeer)
+	if !ok {
+		return
+	}
+	fa.subs.Range(func(_, v interface{}) bool {
+		if wb, ok := v.(*sub).lb.(interface {
+			SetNodeWeight(node lbapi.WeightedPeer, newWeight int)
+		}); ok {
+			wb.SetNodeWeight(wp, weight)
+		}
+		return true
+	})
+}
+
+func (fa *backendsFactor) Backends() []VersioningBackendFactor {
+	return append([]VersioningBackendFactor(nil), fa.load().backends...)
+}
+
+// Peers implements lbapi.PeerLister, the peers are the backends.
+func (fa *backendsFactor) Peers() (peers []lbapi.Peer) {
+	for _, b := range fa.load().backends {
+		peers = append(peers, b)
+	}
+	return
 }
 
 func (fa *backendsFactor) String() string { return "" }
 func (fa *backendsFactor) Factor() string { return "" }
 func (fa *backendsFactor) ConstrainedBy(constraints interface{}) (peer lbapi.Peer, c lbapi.Constrainable, satisfied bool) {
 	if cc, ok := constraints.(lbapi.Constrainable); ok {
-		var lb lbapi.Balancer
-
-		// for this object cc, build a lb and associate with it
-		fa.crw.RLock()
-		if _, ok := fa.constraints[cc]; !ok {
-			fa.crw.RUnlock()
-
-			lb = fa.generator()
-			fa.crw.Lock()
-			fa.constraints[cc] = lb
-			fa.crw.Unlock()
-		} else {
-			lb = fa.constraints[cc]
-			fa.crw.RUnlock()
-			lb.Clear()
-		}
-
-		// find all satisfied backends/peers and add them into lb
-		for _, f := range fa.backends {
-			if cc.Check(f) {
-				satisfied = true
-				lb.Add(f)
-			}
+		set := fa.load()
+		v, ok := fa.subs.Load(cc)
+		if !ok || v.(*sub).of != set {
+			v = fa.refresh(cc)
 		}
+		s := v.(*sub)
 
 		// now, pick up the next peer of them
-		peer, c = lb.Next(lbapi.DummyFactor)
+		satisfied = s.satisfied
+		peer, c = s.lb.Next(lbapi.DummyFactor)
 		if c == nil {
 			c = cc
 		}
 	}
 	return
 }
+
+// refresh brings the sub-balancer of cc up to date with the current
+// backends, or builds it at first.
+func (fa *backendsFactor) refresh(cc lbapi.Constrainable) *sub {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	set := fa.load()
+	old := &sub{}
+	if v, ok := fa.subs.Load(cc); ok {
+		if old = v.(*sub); old.of == set {
+			return old // refreshed meanwhile
+		}
+	}
+
+	// find all satisfied backends/peers
+	var peers []lbapi.Peer
+	for _, f := range set.backends {
+		if !set.down[backendKey(f)] && cc.Check(f) {
+			peers = append(peers, f)
+		}
+	}
+
+	s := &sub{lb: old.lb, of: set, satisfied: len(peers) > 0}
+	if s.lb == nil {
+		s.lb = fa.generator(fa.opts...)
+		s.lb.Add(peers...)
+	} else {
+		lbapi.Replace(s.lb, peers...) // the kept backends keep their state
+	}
+	fa.subs.Store(cc, s)
+	return s
+}
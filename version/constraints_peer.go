@@ -75,10 +75,15 @@ func (s *constrainablePeer) Check(factor interface{}) (satisfied bool) {
 		}
 	}
 
-	if v, ok := factor.(*semver.Version); ok {
+	var v *semver.Version
+	if vv, ok := factor.(*semver.Version); ok {
+		v = vv
+	} else if vf, ok := factor.(interface{ Version() *semver.Version }); ok {
+		v = vf.Version()
+	}
+	// an unversioned or illegal one satisfies nothing
+	if v != nil && s.constraintsObj != nil {
 		satisfied = s.constraintsObj.Check(v)
-	} else if v, ok := factor.(interface{ Version() *semver.Version }); ok {
-		satisfied = s.constraintsObj.Check(v.Version())
 	}
 	return
 }
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/Masterminds/semver/v3"
+	"github.com/hedzr/lb/wrr"
 )
 
 func TestNewConstraintsPeer(t *testing.T) {
@@ -36,3 +37,16 @@ func (s *xS) Version() *semver.Version {
 	vs, _ := semver.NewVersion(s.ver)
 	return vs
 }
+
+func TestCheckNoVersion(t *testing.T) {
+	peer := NewConstrainablePeer("<= 1.1.x", 2)
+	if peer.Check(&xS{ver: "latest"}) || peer.Check((*semver.Version)(nil)) {
+		t.Fatal("an illegal version should satisfy nothing")
+	}
+
+	bf := NewBackendsFactor(wrr.New)
+	bf.AddPeers(NewBackendFactor("latest", "172.16.0.7:3500"))
+	if p, _ := New(WithConstrainedPeers(peer)).Next(bf); p != nil {
+		t.Fatalf("an illegal version is picked: %v", p)
+	}
+}
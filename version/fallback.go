@@ -0,0 +1,284 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package version
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/hedzr/lb/internal/observer"
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/pkg/logger"
+)
+
+// Fallback is what a versioning balancer does when no backend
+// satisfies the constraint picked by weight, see WithFallback.
+type Fallback int
+
+const (
+	// FallbackError picks nothing, Pick returns an *UnsatisfiedError.
+	// It's the default.
+	FallbackError Fallback = iota
+	// FallbackRepick tries the other constraints, the heavier first.
+	// A constraint of weight 0 is never tried.
+	FallbackRepick
+	// FallbackNearest picks the backends of the version nearest to
+	// the first version of the constraint, within the same major
+	// version. For "^1.2.x", a 1.1.0 backend is nearer than a 1.5.0
+	// one, and a 2.0.0 one is never picked.
+	FallbackNearest
+	// FallbackDefault picks the backends of the default constraint,
+	// see WithDefaultConstraint.
+	FallbackDefault
+)
+
+var fallbackNames = [...]string{"error", "repick", "nearest", "default"}
+
+func (f Fallback) String() string {
+	if f >= 0 && int(f) < len(fallbackNames) {
+		return fallbackNames[f]
+	}
+	return "Fallback(" + strconv.Itoa(int(f)) + ")"
+}
+
+// ErrNoConstraint is returned by Pick for a balancer without
+// constraints.
+var ErrNoConstraint = errors.New("version: no constraints")
+
+// UnsatisfiedError is returned by Pick when no backend satisfies
+// the picked constraint, and the fallback found none either.
+type UnsatisfiedError struct {
+	Constraint lbapi.Constrainable
+	Fallback   Fallback
+}
+
+func (e *UnsatisfiedError) Error() string {
+	return fmt.Sprintf("version: no backend satisfies %q (fallback: %v)", e.Constraint.String(), e.Fallback)
+}
+
+// WithFallback sets the fallback policy of a balancer made by New.
+func WithFallback(f Fallback) lbapi.Opt {
+	return func(balancer lbapi.Balancer) {
+		if s, ok := balancer.(*Balancer); ok {
+			s.fallback = f
+		}
+	}
+}
+
+// WithDefaultConstraint sets the constraint picked by FallbackDefault,
+// it needs not be one of the peers of the balancer.
+func WithDefaultConstraint(c lbapi.Constrainable) lbapi.Opt {
+	return func(balancer lbapi.Balancer) {
+		if s, ok := balancer.(*Balancer); ok {
+			s.def = c
+		}
+	}
+}
+
+// Balancer is the versioning balancer made by New. It picks a
+// constraint by weight and then a backend satisfying it out of the
+// factor, usually a BackendsFactor, and falls back as configured
+// when there is none.
+//
+// An unsatisfied constraint is sent as an lbapi.Unsatisfied event,
+// which metrics counts, and is logged once.
+type Balancer struct {
+	lbapi.Balancer // the wrr of the constraints
+	fallback       Fallback
+	def            lbapi.Constrainable
+	exact          sync.Map // version string -> lbapi.Constrainable, for FallbackNearest
+	warned         sync.Map // lbapi.Constrainable -> bool
+	obs            observer.Set
+}
+
+// Next implements lbapi.BalancerLite, see Pick.
+func (s *Balancer) Next(factor lbapi.Factor) (peer lbapi.Peer, c lbapi.Constrainable) {
+	peer, c, _ = s.Pick(factor)
+	return
+}
+
+// Pick picks a backend as Next does, and tells why there is none.
+// The err is an *UnsatisfiedError, or ErrNoConstraint.
+//
+// c is the constraint satisfied by the peer, it's the failed one
+// along with an error.
+func (s *Balancer) Pick(factor lbapi.Factor) (peer lbapi.Peer, c lbapi.Constrainable, err error) {
+	if peer, c = s.Balancer.Next(factor); peer != nil {
+		return
+	}
+	fc, ok := factor.(lbapi.FactorComparable)
+	if !ok || c == nil {
+		return nil, nil, ErrNoConstraint
+	}
+
+	s.unsatisfied(factor, c)
+	var fb lbapi.Constrainable
+	switch s.fallback {
+	case FallbackRepick:
+		peer, fb = s.repick(fc, c)
+	case FallbackNearest:
+		peer, fb = s.nearest(fc, c)
+	case FallbackDefault:
+		if s.def != nil {
+			peer, _, _ = fc.ConstrainedBy(s.def)
+			fb = s.def
+		}
+	}
+	if peer == nil {
+		return nil, c, &UnsatisfiedError{Constraint: c, Fallback: s.fallback}
+	}
+	if s.obs.Active() {
+		s.obs.Emit(lbapi.Event{Type: lbapi.Picked, Peer: peer, Factor: factor, Constraint: fb})
+	}
+	return peer, fb, nil
+}
+
+func (s *Balancer) unsatisfied(factor lbapi.Factor, c lbapi.Constrainable) {
+	if _, warned := s.warned.LoadOrStore(c, true); !warned {
+		logger.Warnf("[version] no backend satisfies %q, falling back to %v", c.String(), s.fallback)
+	}
+	if s.obs.Active() {
+		s.obs.Emit(lbapi.Event{Type: lbapi.Unsatisfied, Factor: factor, Constraint: c})
+	}
+}
+
+// repick tries the constraints other than tried, by their current
+// weights in the wrr.
+func (s *Balancer) repick(fc lbapi.FactorComparable, tried lbapi.Constrainable) (peer lbapi.Peer, c lbapi.Constrainable) {
+	snapshot, _ := lbapi.Inspect(s.Balancer)
+	states := snapshot.Peers
+	sort.SliceStable(states, func(i, j int) bool { return states[i].Weight > states[j].Weight })
+	for _, ps := range states {
+		cc, ok := ps.Peer.(lbapi.Constrainable)
+		if !ok || ps.Weight <= 0 || cc == tried {
+			continue
+		}
+		if peer, _, _ = fc.ConstrainedBy(cc); peer != nil {
+			return peer, cc
+		}
+	}
+	return nil, nil
+}
+
+// versionRE matches the first version of a constraint, such as
+// "1.2" of "^1.2.x" or ">= 1.2, < 3".
+var versionRE = regexp.MustCompile(`(\d+)(?:\.(\d+|[xX*]))?(?:\.(\d+|[xX*]))?`)
+
+// nearest tries the versions of the backends of fc by their
+// distance to the first version of c, within its major version.
+func (s *Balancer) nearest(fc lbapi.FactorComparable, c lbapi.Constrainable) (peer lbapi.Peer, cc lbapi.Constrainable) {
+	bl, ok := fc.(interface {
+		Backends() []VersioningBackendFactor
+	})
+	m := versionRE.FindStringSubmatch(c.String())
+	if !ok || m == nil {
+		return
+	}
+	num := func(s string) int64 {
+		n, _ := strconv.ParseInt(s, 10, 64) // 0 for x and *
+		return n
+	}
+	major, minor, patch := num(m[1]), num(m[2]), num(m[3])
+	abs := func(n int64) int64 {
+		if n < 0 {
+			return -n
+		}
+		return n
+	}
+
+	var versions []*semver.Version
+	seen := make(map[string]bool)
+	for _, b := range bl.Backends() {
+		v := b.Version()
+		if v == nil || int64(v.Major()) != major || seen[v.String()] {
+			continue
+		}
+		seen[v.String()] = true
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		da, db := abs(int64(a.Minor())-minor), abs(int64(b.Minor())-minor)
+		if da != db {
+			return da < db
+		}
+		if da, db = abs(int64(a.Patch())-patch), abs(int64(b.Patch())-patch); da != db {
+			return da < db
+		}
+		return b.LessThan(a) // the higher one on a tie
+	})
+
+	for _, v := range versions {
+		cc = s.exactly(v)
+		if peer, _, _ = fc.ConstrainedBy(cc); peer != nil {
+			return
+		}
+	}
+	return nil, nil
+}
+
+// exactly returns the constraint of v alone, the same one for the
+// same version so that the sub-balancer of a BackendsFactor is kept.
+func (s *Balancer) exactly(v *semver.Version) lbapi.Constrainable {
+	if c, ok := s.exact.Load(v.String()); ok {
+		return c.(lbapi.Constrainable)
+	}
+	c, _ := s.exact.LoadOrStore(v.String(), NewConstrainablePeer("="+v.String(), 0))
+	return c.(lbapi.Constrainable)
+}
+
+// Subscribe implements lbapi.Observable, the observer gets the
+// events of the wrr of the constraints too, each once: they are
+// passed on by the Balancer, see New.
+func (s *Balancer) Subscribe(fn lbapi.Observer) (unsubscribe func()) {
+	return s.obs.Subscribe(fn)
+}
+
+// forward passes the events of the wrr of the constraints on.
+func (s *Balancer) forward(e lbapi.Event) {
+	if s.obs.Active() {
+		s.obs.Emit(e)
+	}
+}
+
+// Unwrap implements lbapi.Wrapper.
+func (s *Balancer) Unwrap() lbapi.Balancer { return s.Balancer }
+
+// Peers implements lbapi.PeerLister, the peers are the constraints.
+func (s *Balancer) Peers() (peers []lbapi.Peer) {
+	if pl, ok := s.Balancer.(lbapi.PeerLister); ok {
+		peers = pl.Peers()
+	}
+	return
+}
+
+// Update implements lbapi.Updater for the constraints.
+func (s *Balancer) Update(add, remove []lbapi.Peer) { lbapi.Update(s.Balancer, add, remove) }
+
+// Replace implements lbapi.Updater for the constraints.
+func (s *Balancer) Replace(peers ...lbapi.Peer) { lbapi.Replace(s.Balancer, peers...) }
+
+// SetNodeWeight changes the weight of a constraint in place, see
+// wrr.
+func (s *Balancer) SetNodeWeight(node lbapi.WeightedPeer, newWeight int) {
+	if wb, ok := s.Balancer.(interface {
+		SetNodeWeight(node lbapi.WeightedPeer, newWeight int)
+	}); ok {
+		wb.SetNodeWeight(node, newWeight)
+	}
+}
+
+// SetNodeWeights changes the weights of several constraints at once,
+// see wrr.
+func (s *Balancer) SetNodeWeights(nodes []lbapi.WeightedPeer, weights []int) {
+	if wb, ok := s.Balancer.(interface {
+		SetNodeWeights(nodes []lbapi.WeightedPeer, weights []int)
+	}); ok {
+		wb.SetNodeWeights(nodes, weights)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package version_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/rr"
+	"github.com/hedzr/lb/version"
+	"github.com/hedzr/lb/wrr"
+)
+
+func TestFallback(t *testing.T) {
+	b11, b15, b20 := version.NewBackendFactor("1.1.0", "172.16.0.7:3500"), version.NewBackendFactor("1.5.0", "172.16.0.8:3500"), version.NewBackendFactor("2.0.0", "172.16.0.9:3500")
+	bf := version.NewBackendsFactor(rr.New)
+	bf.AddPeers(b11, b15, b20)
+
+	none := version.NewConstrainablePeer("^3.x", 10)
+	cases := []struct {
+		name string
+		opts []lbapi.Opt
+		want map[lbapi.Peer]int // of 16 picks
+	}{
+		{"error", []lbapi.Opt{version.WithConstrainedPeers(none)}, map[lbapi.Peer]int{}},
+		{"repick", []lbapi.Opt{version.WithFallback(version.FallbackRepick), version.WithConstrainedPeers(none,
+			version.NewConstrainablePeer("~1.1", 5), version.NewConstrainablePeer("^2.x", 1), version.NewConstrainablePeer("^9.x", 0))},
+			map[lbapi.Peer]int{b11: 15, b20: 1}},
+		{"nearest", []lbapi.Opt{version.WithFallback(version.FallbackNearest), version.WithConstrainedPeers(version.NewConstrainablePeer("~1.2", 1))},
+			map[lbapi.Peer]int{b11: 16}},
+		{"default", []lbapi.Opt{version.WithFallback(version.FallbackDefault), version.WithConstrainedPeers(none),
+			version.WithDefaultConstraint(version.NewConstrainablePeer("^2.x", 1))},
+			map[lbapi.Peer]int{b20: 16}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			lb := version.New(tc.opts...).(*version.Balancer)
+			var unsatisfied int
+			lb.Subscribe(func(e lbapi.Event) {
+				if e.Type == lbapi.Unsatisfied {
+					unsatisfied++
+				}
+			})
+
+			sum := make(map[lbapi.Peer]int)
+			for i := 0; i < 16; i++ {
+				peer, c, err := lb.Pick(bf)
+				if peer == nil {
+					var ue *version.UnsatisfiedError
+					if !errors.As(err, &ue) || ue.Constraint != c || ue.Fallback.String() != tc.name {
+						t.Fatalf("expecting an UnsatisfiedError, got %v", err)
+					}
+					continue
+				}
+				if err != nil || !c.Check(peer) {
+					t.Fatalf("bad pick: %v, %v, %v", peer, c, err)
+				}
+				sum[peer]++
+			}
+			if len(sum) != len(tc.want) {
+				t.Fatalf("expecting %v, got %v", tc.want, sum)
+			}
+			for p, n := range tc.want {
+				if sum[p] != n {
+					t.Fatalf("expecting %v, got %v", tc.want, sum)
+				}
+			}
+			if unsatisfied == 0 {
+				t.Fatal("no Unsatisfied events")
+			}
+		})
+	}
+
+	lb := version.New(version.WithFallback(version.FallbackNearest), version.WithConstrainedPeers(version.NewConstrainablePeer("^4.x", 1))).(*version.Balancer)
+	if peer, _, err := lb.Pick(bf); peer != nil || err == nil {
+		t.Fatalf("a backend of another major version is not compatible: %v", peer)
+	}
+	if _, _, err := version.New().(*version.Balancer).Pick(bf); err != version.ErrNoConstraint {
+		t.Fatalf("expecting ErrNoConstraint, got %v", err)
+	}
+}
+
+func TestNewOpts(t *testing.T) {
+	var applied int
+	c := version.NewConstrainablePeer("^1.x", 2)
+	lb := version.New(func(lbapi.Balancer) { applied++ }, wrr.WithWeightedPeers(c.(lbapi.WeightedPeer)))
+	if applied != 1 || lb.Count() != 1 {
+		t.Fatalf("an opt should be applied once: %v, count = %v", applied, lb.Count())
+	}
+
+	bf := version.NewBackendsFactor(rr.New)
+	bf.AddPeers(version.NewBackendFactor("1.0", "172.16.0.7:3500"))
+	var picked int
+	lb.(lbapi.Observable).Subscribe(func(e lbapi.Event) {
+		if e.Type == lbapi.Picked {
+			picked++
+		}
+	})
+	lb.Next(bf)
+	if picked != 1 {
+		t.Fatalf("a pick should be sent once, got %v", picked)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package version
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hedzr/lb/lbapi"
+)
+
+// Lint checks a set of constraints of a versioning balancer against
+// the backends of a BackendsFactor, and works out the traffic share
+// of each backend.
+//
+// A constraint is picked by its weight, and its backends share its
+// picks by their weights, as a weighted sub-balancer such as wrr
+// does. NewBackendFactor makes the backends of weight 1, so the
+// shares are even for an unweighted sub-balancer too.
+//
+// Example:
+//
+//	r := version.Lint(testConstraints, bf.Backends())
+//	if !r.OK() {
+//	    log.Print(r)
+//	}
+func Lint(cs []lbapi.Constrainable, backends []VersioningBackendFactor) *Report {
+	r := &Report{Shares: make([]Share, len(backends))}
+	matched := make([][]lbapi.Constrainable, len(backends))
+	for i, b := range backends {
+		r.Shares[i].Backend = b
+	}
+
+	var total int
+	for _, c := range cs {
+		total += weightOf(c)
+	}
+
+	for _, c := range cs {
+		var group []int
+		var sum int
+		for i, b := range backends {
+			if c.Check(b) {
+				matched[i] = append(matched[i], c)
+				group = append(group, i)
+				sum += weightOf(b)
+			}
+		}
+		if len(group) == 0 {
+			r.Empty = append(r.Empty, c)
+		}
+		if total == 0 || weightOf(c) == 0 {
+			continue
+		}
+		share := float64(weightOf(c)) / float64(total)
+		if sum == 0 {
+			r.Lost += share
+			continue
+		}
+		for _, i := range group {
+			r.Shares[i].Share += share * float64(weightOf(backends[i])) / float64(sum)
+		}
+	}
+
+	for i, b := range backends {
+		switch len(matched[i]) {
+		case 0:
+			r.Gaps = append(r.Gaps, b)
+		case 1:
+		default:
+			r.Overlaps = append(r.Overlaps, Overlap{Backend: b, Constraints: matched[i]})
+		}
+	}
+	return r
+}
+
+// weightOf returns the weight of a lbapi.WeightedPeer, or 1, a
+// negative weight is 0.
+func weightOf(p lbapi.Peer) int {
+	w := 1
+	if wp, ok := p.(lbapi.WeightedPeer); ok {
+		w = wp.Weight()
+	}
+	if w < 0 {
+		return 0
+	}
+	return w
+}
+
+// Report is the result of Lint.
+type Report struct {
+	// Overlaps are the backends matched by more than one constraint,
+	// they get the traffic of all of them.
+	Overlaps []Overlap
+	// Gaps are the backends matched by no constraint, they get no
+	// traffic.
+	Gaps []VersioningBackendFactor
+	// Empty are the constraints matching no backend, their picks
+	// are unsatisfied, see WithFallback.
+	Empty []lbapi.Constrainable
+	// Shares are the traffic shares of all backends in order, they
+	// add up to 1 - Lost.
+	Shares []Share
+	// Lost is the share of the picks of the Empty constraints,
+	// before any fallback.
+	Lost float64
+}
+
+// Overlap is a backend matched by more than one constraint.
+type Overlap struct {
+	Backend     VersioningBackendFactor
+	Constraints []lbapi.Constrainable
+}
+
+// Share is the share of the traffic a backend gets, from 0 to 1.
+type Share struct {
+	Backend VersioningBackendFactor
+	Share   float64
+}
+
+// OK tells whether there is neither overlap, gap nor empty
+// constraint.
+func (r *Report) OK() bool {
+	return len(r.Overlaps) == 0 && len(r.Gaps) == 0 && len(r.Empty) == 0
+}
+
+// String returns the problems and the shares, one per line.
+func (r *Report) String() string {
+	var sb strings.Builder
+	for _, o := range r.Overlaps {
+		var cs []string
+		for _, c := range o.Constraints {
+			cs = append(cs, fmt.Sprintf("%q", c.String()))
+		}
+		fmt.Fprintf(&sb, "overlap: %v is matched by %v\n", o.Backend, strings.Join(cs, ", "))
+	}
+	for _, b := range r.Gaps {
+		fmt.Fprintf(&sb, "gap: %v is matched by no constraint\n", b)
+	}
+	for _, c := range r.Empty {
+		fmt.Fprintf(&sb, "empty: %q matches no backend\n", c.String())
+	}
+	if r.Lost > 0 {
+		fmt.Fprintf(&sb, "lost: %.2f%% of the picks are unsatisfied\n", r.Lost*100)
+	}
+	for _, s := range r.Shares {
+		fmt.Fprintf(&sb, "share: %v gets %.2f%%\n", s.Backend, s.Share*100)
+	}
+	return sb.String()
+}
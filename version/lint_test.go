@@ -0,0 +1,47 @@
+// Copyright © 2021 Hedzr Yeh.
+
+package version_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/hedzr/lb/lbapi"
+	"github.com/hedzr/lb/version"
+)
+
+func TestLint(t *testing.T) {
+	a, b, c := version.NewConstrainablePeer("<= 1.1.x", 2), version.NewConstrainablePeer("^1.1.x", 2), version.NewConstrainablePeer("^3.x", 1)
+	b1, b2, b3 := version.NewBackendFactor("1.1.5", "172.16.0.7:3500"), version.NewBackendFactor("1.4.0", "172.16.0.8:3500"), version.NewBackendFactor("2.0.0", "172.16.0.9:3500")
+
+	r := version.Lint([]lbapi.Constrainable{a, b, c}, []version.VersioningBackendFactor{b1, b2, b3})
+	if r.OK() {
+		t.Fatal("the problems are not found")
+	}
+	if len(r.Overlaps) != 1 || r.Overlaps[0].Backend != b1 || len(r.Overlaps[0].Constraints) != 2 {
+		t.Fatalf("bad overlaps: %v", r.Overlaps)
+	}
+	if len(r.Gaps) != 1 || r.Gaps[0] != b3 {
+		t.Fatalf("bad gaps: %v", r.Gaps)
+	}
+	if len(r.Empty) != 1 || r.Empty[0] != c {
+		t.Fatalf("bad empty constraints: %v", r.Empty)
+	}
+	for i, want := range []float64{.6, .2, 0} {
+		if math.Abs(r.Shares[i].Share-want) > 1e-9 {
+			t.Fatalf("bad share of %v: %v", r.Shares[i].Backend, r.Shares[i].Share)
+		}
+	}
+	if math.Abs(r.Lost-.2) > 1e-9 {
+		t.Fatalf("bad lost: %v", r.Lost)
+	}
+	if s := r.String(); !strings.Contains(s, `overlap: 172.16.0.7:3500 - 1.1.5 is matched by "<=1.1.x", "^1.1.x"`) ||
+		!strings.Contains(s, "share: 172.16.0.7:3500 - 1.1.5 gets 60.00%") {
+		t.Fatalf("bad report:\n%s", s)
+	}
+
+	if r = version.Lint([]lbapi.Constrainable{a, version.NewConstrainablePeer("^1.2.x", 4)}, []version.VersioningBackendFactor{b1, b2}); !r.OK() {
+		t.Fatalf("expecting no problems:\n%v", r)
+	}
+}
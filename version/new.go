@@ -28,7 +28,19 @@ import (
 //	lb := version.New(version.WithConstrainedPeers(testConstraints...))
 //	factor := bf
 //	peer, c := lb.Next(factor)
-func New(opts ...lbapi.Opt) lbapi.Balancer { return wrr.New(opts...) }
+//
+// The balancer is a *Balancer, see WithFallback for what it does
+// when no backend satisfies the picked constraint. Each opt is
+// applied once to the *Balancer, which adds the constraints to the
+// wrr it wraps; the wrr options find the wrr through Unwrap.
+func New(opts ...lbapi.Opt) lbapi.Balancer {
+	s := &Balancer{Balancer: wrr.New()}
+	s.Balancer.(lbapi.Observable).Subscribe(s.forward)
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
 
 // WithConstrainedPeers fills a set of lbapi.Constrainable as peers.
 //
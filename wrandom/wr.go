@@ -63,3 +63,7 @@ func (w *wpPeer) Count() int              { return w.lb.Count() }
 func (w *wpPeer) Add(peers ...lbapi.Peer) { w.lb.Add(peers...) }
 func (w *wpPeer) Remove(peer lbapi.Peer)  { w.lb.Remove(peer) }
 func (w *wpPeer) Clear()                  { w.lb.Clear() }
+
+// Unwrap implements lbapi.Wrapper, so that the nested balancer can
+// be inspected.
+func (w *wpPeer) Unwrap() lbapi.Balancer { return w.lb }
@@ -45,3 +45,25 @@ func TestWR1(t *testing.T) {
 		t.Logf("%v: %v", k, v)
 	}
 }
+
+func TestWR_Inspect(t *testing.T) {
+	lb := wrandom.New(
+		wrandom.WithWeightedBalancedPeers(
+			wrandom.NewPeer(3, random.New, withPeers(exP("172.16.0.7:3500"), exP("172.16.0.8:3500")), lbapi.WithPickCounts()),
+			wrandom.NewPeer(1, random.New, withPeers(exP("172.16.0.2:3500")), lbapi.WithPickCounts()),
+		),
+		lbapi.WithPickCounts(),
+	)
+	for i := 0; i < 8; i++ {
+		lb.Next(lbapi.DummyFactor)
+	}
+
+	s, _ := lbapi.Inspect(lb)
+	if len(s.Peers) != 2 || s.Peers[0].Picks != 6 || s.Peers[1].Picks != 2 {
+		t.Fatalf("bad snapshot: %+v", s)
+	}
+	child := s.Peers[0].Children
+	if child == nil || child.Algorithm != "random" || len(child.Peers) != 2 || child.Picks != 6 {
+		t.Fatalf("bad nested snapshot: %+v", child)
+	}
+}
@@ -4,22 +4,23 @@ package wrr
 
 import (
 	"sync"
+	"sync/atomic"
 
+	"github.com/hedzr/lb/internal/observer"
+	"github.com/hedzr/lb/internal/peerset"
 	"github.com/hedzr/lb/lbapi"
 )
 
 // New make a new load-balancer instance with Weighted Round-Robin
 func New(opts ...lbapi.Opt) lbapi.Balancer {
-	return (&wrrS{
-		m: make(map[lbapi.Peer]*weightS),
-	}).init(opts...)
+	return (&wrrS{}).init(opts...)
 }
 
 // WithPeersAndWeights allows passing a simple peer array and
 // corresponding weight array separately.
 func WithPeersAndWeights(peers []lbapi.Peer, weights []int) lbapi.Opt {
 	return func(balancer lbapi.Balancer) {
-		if wrr, ok := balancer.(*wrrS); ok {
+		if wrr, ok := unwrap(balancer); ok {
 			wrr.addWeights(peers, weights)
 		}
 	}
@@ -28,23 +29,54 @@ func WithPeersAndWeights(peers []lbapi.Peer, weights []int) lbapi.Opt {
 // WithWeightedPeers allows passing a weighted-peers array.
 func WithWeightedPeers(peers ...lbapi.WeightedPeer) lbapi.Opt {
 	return func(balancer lbapi.Balancer) {
-		if wrr, ok := balancer.(*wrrS); ok {
+		if wrr, ok := unwrap(balancer); ok {
 			wrr.addPeers(peers)
 		}
 	}
 }
 
+// unwrap finds the wrr balancer through the lbapi.Wrapper chain, so
+// that the options work for a wrapping balancer such as version.New.
+func unwrap(balancer lbapi.Balancer) (*wrrS, bool) {
+	for balancer != nil {
+		if wrr, ok := balancer.(*wrrS); ok {
+			return wrr, true
+		}
+		w, ok := balancer.(lbapi.Wrapper)
+		if !ok {
+			break
+		}
+		balancer = w.Unwrap()
+	}
+	return nil, false
+}
+
+// wrrS publishes the nodes as an immutable slice, the writers
+// (mu) copy it. The nodes themselves are shared by the slices, so
+// that a node keeps its smooth state across Add and Remove; the
+// state is guarded by sm, which is locked once per pick.
+//
+// So wrr is excluded from the wait-free picks of the stock
+// balancers: its picks are serialized, and wait for SetNodeWeight.
 type wrrS struct {
-	peers []lbapi.Peer
-	m     map[lbapi.Peer]*weightS
-	prw   sync.RWMutex // for peers
-	mrw   sync.RWMutex // for m
+	nodes    atomic.Pointer[[]*weightS]
+	index    peerset.Index[*weightS]
+	mu       sync.Mutex // for the writers of nodes and index
+	sm       sync.Mutex // for the weights of the nodes, and counting
+	counting bool
+	obs      observer.Set
 }
 
 type weightS struct {
+	peer      lbapi.Peer
 	weight    int
 	effective int
 	current   int
+	picks     int64
+}
+
+func newNode(peer lbapi.Peer, weight int) *weightS {
+	return &weightS{peer: peer, weight: weight, effective: weight}
 }
 
 func (s *wrrS) init(opts ...lbapi.Opt) *wrrS {
@@ -54,6 +86,13 @@ func (s *wrrS) init(opts ...lbapi.Opt) *wrrS {
 	return s
 }
 
+func (s *wrrS) load() []*weightS {
+	if nodes := s.nodes.Load(); nodes != nil {
+		return *nodes
+	}
+	return nil
+}
+
 // Next implements a smooth weighted round-robin lb with algorithm coming from nginx:
 // https://github.com/nginx/nginx/commit/52327e0627f49dbda1e8db695e63a4b0af4448b1
 func (s *wrrS) Next(factor lbapi.Factor) (best lbapi.Peer, c lbapi.Constrainable) {
@@ -64,167 +103,197 @@ func (s *wrrS) Next(factor lbapi.Factor) (best lbapi.Peer, c lbapi.Constrainable
 			best, c = nested.Next(factor)
 		}
 	}
+	if best != nil && s.obs.Active() {
+		s.obs.Emit(lbapi.Event{Type: lbapi.Picked, Peer: best, Factor: factor, Constraint: c})
+	}
 	return
 }
 
-func (s *wrrS) miniNext() (best lbapi.Peer) {
-	total := 0
+// Subscribe implements lbapi.Observable.
+func (s *wrrS) Subscribe(fn lbapi.Observer) (unsubscribe func()) { return s.obs.Subscribe(fn) }
 
-	s.prw.RLock()
-	defer s.prw.RUnlock()
+func (s *wrrS) miniNext() (best lbapi.Peer) {
+	nodes := s.load()
+	if len(nodes) == 0 {
+		return
+	}
 
-	for _, node := range s.peers {
-		if node == nil {
-			continue
-		}
+	s.sm.Lock()
+	defer s.sm.Unlock()
 
-		total += s.mUpdate(node, 0, false)
-		if s.mTest(best, node) {
-			best = node
+	total := 0
+	var node *weightS
+	for _, n := range nodes {
+		n.current += n.effective
+		total += n.effective
+		if node == nil || n.current > node.current {
+			node = n
 		}
 	}
 
-	if best != nil {
-		s.mUpdate(best, -total, true)
+	node.current -= total
+	if s.counting {
+		node.picks++
 	}
-	return
+	return node.peer
 }
 
-func (s *wrrS) mUpdate(node lbapi.Peer, delta int, success bool) (total int) {
-	s.mrw.Lock()
-	defer s.mrw.Unlock()
-	if delta == 0 {
-		delta = s.m[node].effective
-	}
-	s.m[node].current += delta
-	//if success {
-	//	s.m[node].effective++
-	//}
-	return s.m[node].effective
+// CountPicks implements lbapi.PickCounter.
+func (s *wrrS) CountPicks(on bool) {
+	s.sm.Lock()
+	s.counting = on
+	s.sm.Unlock()
 }
 
-func (s *wrrS) mTest(best, node lbapi.Peer) bool {
-	s.mrw.RLock()
-	defer s.mrw.RUnlock()
-	return best == nil || s.m[node].current > s.m[best].current
+// update publishes the nodes returned by fn, which must not modify
+// the current ones.
+func (s *wrrS) update(fn func(nodes []*weightS) []*weightS) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nodes := fn(s.load())
+	s.nodes.Store(&nodes)
 }
 
-func (s *wrrS) addPeers(peers []lbapi.WeightedPeer) {
-	s.prw.RLock()
-	defer s.prw.RUnlock()
-	for _, p := range peers {
-		s.peers = append(s.peers, p)
+func nodeOf(peer lbapi.Peer) *weightS {
+	var w int
+	if wp, ok := peer.(lbapi.WeightedPeer); ok {
+		w = wp.Weight()
 	}
+	return newNode(peer, w)
+}
 
-	s.mrw.Lock()
-	defer s.mrw.Unlock()
-
+func (s *wrrS) addPeers(peers []lbapi.WeightedPeer) {
+	add := make([]lbapi.Peer, 0, len(peers))
 	for _, p := range peers {
-		var w = p.Weight()
-		s.m[p] = &weightS{current: 0, effective: w, weight: w}
+		add = append(add, p)
 	}
+	s.Update(add, nil)
 }
 
 func (s *wrrS) addWeights(peers []lbapi.Peer, weights []int) {
-	s.prw.RLock()
-	defer s.prw.RUnlock()
-	s.peers = peers
-
-	s.mrw.Lock()
-	defer s.mrw.Unlock()
-
-	for i, p := range peers {
-		var w int
-		if wp, ok := p.(lbapi.WeightedPeer); ok {
-			w = wp.Weight()
-		} else {
-			w = weights[i]
+	s.update(func([]*weightS) (nodes []*weightS) {
+		s.index.Clear()
+		for i, p := range peers {
+			if _, _, found := s.index.Get(p); found {
+				continue
+			}
+			n := nodeOf(p)
+			if _, ok := p.(lbapi.WeightedPeer); !ok {
+				n.weight, n.effective = weights[i], weights[i]
+			}
+			s.index.Put(p, n)
+			nodes = append(nodes, n)
 		}
-		s.m[p] = &weightS{current: 0, effective: w, weight: w}
-	}
+		return
+	})
 }
 
+// SetNodeWeight changes the weight of a node in place. The current
+// weights of the smooth weighted round-robin are kept, so that the
+// rotation goes on rather than being restarted.
 func (s *wrrS) SetNodeWeight(node lbapi.WeightedPeer, newWeight int) {
-	s.mAdd(node, newWeight)
+	peer, n, found := s.index.Get(node)
+	if !found {
+		return
+	}
+	s.sm.Lock()
+	n.weight, n.effective = newWeight, newWeight
+	s.sm.Unlock()
+	s.obs.Emit(lbapi.Event{Type: lbapi.WeightChanged, Peer: peer, Weight: newWeight})
 }
 
-func (s *wrrS) mAdd(node lbapi.Peer, weight int) {
-	s.mrw.Lock()
-	defer s.mrw.Unlock()
+// SetNodeWeights changes the weights of several nodes at once, the
+// i-th node gets the i-th weight. No pick sees some of the new
+// weights without the others. See SetNodeWeight.
+func (s *wrrS) SetNodeWeights(nodes []lbapi.WeightedPeer, weights []int) {
+	var events []lbapi.Event
+	var found []*weightS
+	for i, node := range nodes {
+		if peer, n, ok := s.index.Get(node); ok && i < len(weights) {
+			events = append(events, lbapi.Event{Type: lbapi.WeightChanged, Peer: peer, Weight: weights[i]})
+			found = append(found, n)
+		}
+	}
+	s.sm.Lock()
+	for i, n := range found {
+		n.weight, n.effective = events[i].Weight, events[i].Weight
+	}
+	s.sm.Unlock()
+	for _, ev := range events {
+		s.obs.Emit(ev)
+	}
+}
 
-	if wp, ok := node.(lbapi.WeightedPeer); ok {
-		weight = wp.Weight()
+// Peers implements lbapi.PeerLister.
+func (s *wrrS) Peers() (peers []lbapi.Peer) {
+	for _, n := range s.load() {
+		peers = append(peers, n.peer)
 	}
+	return
+}
 
-	if v, ok := s.m[node]; ok {
-		v.effective = weight
-		if v.weight == 0 {
-			v.weight = weight
-		}
-	} else {
-		s.m[node] = &weightS{current: 0, effective: weight, weight: weight}
+// Inspect implements lbapi.Inspectable, the weights are the state
+// of the smooth weighted round-robin.
+func (s *wrrS) Inspect() (snapshot lbapi.Snapshot) {
+	nodes := s.load()
+	snapshot.Algorithm = "weighted-round-robin"
+	s.sm.Lock()
+	for _, n := range nodes {
+		ps := lbapi.PeerState{Peer: n.peer, Weight: n.weight, Effective: n.effective, Current: n.current, Picks: n.picks}
+		snapshot.Peers = append(snapshot.Peers, ps)
+		snapshot.Picks += ps.Picks
 	}
+	s.sm.Unlock()
+	for i := range snapshot.Peers {
+		snapshot.Peers[i].Children = lbapi.Children(snapshot.Peers[i].Peer)
+	}
+	return
 }
 
 func (s *wrrS) Count() int {
-	s.prw.RLock()
-	defer s.prw.RUnlock()
-	return len(s.peers)
+	return len(s.load())
 }
 
 func (s *wrrS) Add(peers ...lbapi.Peer) {
-	for _, p := range peers {
-		s.AddOne(p)
-	}
+	s.Update(peers, nil)
 }
 
 func (s *wrrS) AddOne(peer lbapi.Peer) {
-	if s.find(peer) {
-		return
+	if peer != nil {
+		s.Update([]lbapi.Peer{peer}, nil)
 	}
+}
 
-	s.prw.Lock()
-	defer s.prw.Unlock()
-	s.peers = append(s.peers, peer)
-	if wp, ok := peer.(lbapi.WeightedPeer); ok {
-		s.SetNodeWeight(wp, wp.Weight())
-	} else if _, ok := s.m[peer]; !ok {
-		s.m[peer] = &weightS{
-			weight:    0,
-			effective: 0,
-			current:   0,
-		}
-	}
+func (s *wrrS) Remove(peer lbapi.Peer) {
+	s.Update(nil, []lbapi.Peer{peer})
 }
 
-func (s *wrrS) find(peer lbapi.Peer) (found bool) {
-	s.prw.RLock()
-	defer s.prw.RUnlock()
-	for _, p := range s.peers {
-		if lbapi.DeepEqual(p, peer) {
-			return true
-		}
-	}
-	return
+// Update implements lbapi.Updater, the kept nodes keep their smooth
+// state.
+func (s *wrrS) Update(add, remove []lbapi.Peer) {
+	var added, removed []lbapi.Peer
+	s.update(func(nodes []*weightS) []*weightS {
+		nodes, added, removed = s.index.Update(nodes, add, remove, nodeOf)
+		return nodes
+	})
+	s.obs.Changed(added, removed)
 }
 
-func (s *wrrS) Remove(peer lbapi.Peer) {
-	s.prw.Lock()
-	defer s.prw.Unlock()
-	for i, p := range s.peers {
-		if lbapi.DeepEqual(p, peer) {
-			s.peers = append(s.peers[0:i], s.peers[i+1:]...)
-			return
-		}
-	}
+// Replace implements lbapi.Updater, the kept nodes keep their smooth
+// state.
+func (s *wrrS) Replace(peers ...lbapi.Peer) {
+	var added, removed []lbapi.Peer
+	s.update(func(nodes []*weightS) []*weightS {
+		nodes, added, removed = s.index.Replace(nodes, peers, nodeOf)
+		return nodes
+	})
+	s.obs.Changed(added, removed)
 }
 
 func (s *wrrS) Clear() {
-	s.prw.Lock()
-	defer s.prw.Unlock()
-	s.peers = nil
-
-	s.mrw.Lock()
-	defer s.mrw.Unlock()
-	s.m = make(map[lbapi.Peer]*weightS)
+	s.update(func([]*weightS) []*weightS {
+		s.index.Clear()
+		return nil
+	})
+	s.obs.Emit(lbapi.Event{Type: lbapi.Cleared})
 }
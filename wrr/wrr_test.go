@@ -3,6 +3,7 @@
 package wrr_test
 
 import (
+	"strconv"
 	"sync"
 	"testing"
 
@@ -73,6 +74,66 @@ func TestWRR_AddRemove(t *testing.T) {
 	}
 }
 
+func TestWRR_SetNodeWeight(t *testing.T) {
+	p1, p2 := &exP{"172.16.0.7:3500", 1}, &exP{"172.16.0.8:3500", 1}
+	lb := wrr.New()
+	lb.Add(p1, p2)
+
+	lb.(interface {
+		SetNodeWeight(node lbapi.WeightedPeer, newWeight int)
+	}).SetNodeWeight(p1, 3)
+
+	sum := make(map[lbapi.Peer]int)
+	for i := 0; i < 400; i++ {
+		p, _ := lb.Next(lbapi.DummyFactor)
+		sum[p]++
+	}
+	if sum[p1] != 300 || sum[p2] != 100 {
+		t.Fatalf("new weight is not honored: %v/%v", sum[p1], sum[p2])
+	}
+}
+
+func TestWRR_SetNodeWeights(t *testing.T) {
+	p1, p2 := &exP{"172.16.0.7:3500", 1}, &exP{"172.16.0.8:3500", 0}
+	lb := wrr.New()
+	lb.Add(p1, p2)
+	ws := lb.(interface {
+		SetNodeWeights(nodes []lbapi.WeightedPeer, weights []int)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			ws.SetNodeWeights([]lbapi.WeightedPeer{p1, p2}, []int{i % 2, 1 - i%2})
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		var sum int
+		for _, ps := range lb.(lbapi.Inspectable).Inspect().Peers {
+			sum += ps.Weight
+		}
+		if sum != 1 {
+			t.Fatalf("the weights are seen half updated, sum = %v", sum)
+		}
+	}
+
+	ws.SetNodeWeights([]lbapi.WeightedPeer{p1, p2}, []int{1, 3})
+	sum := make(map[lbapi.Peer]int)
+	for i := 0; i < 400; i++ {
+		p, _ := lb.Next(lbapi.DummyFactor)
+		sum[p]++
+	}
+	if sum[p1] != 100 || sum[p2] != 300 {
+		t.Fatalf("new weights are not honored: %v/%v", sum[p1], sum[p2])
+	}
+}
+
 func adder(key lbapi.Peer, sum map[lbapi.Peer]int, rw *sync.RWMutex) {
 	rw.Lock()
 	defer rw.Unlock()
@@ -110,3 +171,80 @@ func TestWRR_M1(t *testing.T) {
 		t.Logf("%v: weight = %v, %v/%0.2f%%", k, k.(lbapi.WeightedPeer).Weight(), v, (float32(v)/float32(total))*100.0)
 	}
 }
+
+func TestWRR_Events(t *testing.T) {
+	p1, p2 := &exP{"172.16.0.7:3500", 1}, &exP{"172.16.0.8:3500", 1}
+	lb := wrr.New()
+	var events []lbapi.Event
+	lb.(lbapi.Observable).Subscribe(func(e lbapi.Event) { events = append(events, e) })
+
+	lb.Add(p1, p2)
+	lb.(interface {
+		SetNodeWeight(node lbapi.WeightedPeer, newWeight int)
+	}).SetNodeWeight(p2, 4)
+	p, _ := lb.Next(lbapi.FactorString("x"))
+
+	if len(events) != 4 || events[0].Type != lbapi.PeerAdded || events[1].Peer != p2 {
+		t.Fatalf("bad events: %v", events)
+	}
+	if e := events[2]; e.Type != lbapi.WeightChanged || e.Peer != p2 || e.Weight != 4 {
+		t.Fatalf("bad weight event: %+v", e)
+	}
+	if e := events[3]; e.Type != lbapi.Picked || e.Peer != p || e.Factor.Factor() != "x" || e.Time.IsZero() {
+		t.Fatalf("bad pick event: %+v", e)
+	}
+}
+
+func TestWRR_Inspect(t *testing.T) {
+	p1, p2 := &exP{"172.16.0.7:3500", 3}, &exP{"172.16.0.8:3500", 1}
+	lb := wrr.New(lbapi.WithPickCounts())
+	lb.Add(p1, p2)
+	lb.Next(lbapi.DummyFactor)
+
+	s, ok := lbapi.Inspect(lb)
+	if !ok || s.Algorithm != "weighted-round-robin" || s.Picks != 1 || len(s.Peers) != 2 {
+		t.Fatalf("bad snapshot: %+v", s)
+	}
+	// the smooth wrr: p1 goes 3-4 = -1, p2 goes 1
+	if ps := s.Peers[0]; ps.Peer != p1 || ps.Weight != 3 || ps.Effective != 3 || ps.Current != -1 || ps.Picks != 1 {
+		t.Fatalf("bad state: %+v", ps)
+	}
+	if ps := s.Peers[1]; ps.Current != 1 || ps.Picks != 0 {
+		t.Fatalf("bad state: %+v", ps)
+	}
+
+	lb.Next(lbapi.DummyFactor)
+	if s.Peers[0].Picks != 1 {
+		t.Fatal("a snapshot should not change")
+	}
+}
+
+func BenchmarkWRR_Next(b *testing.B) {
+	lb := wrr.New()
+	for i := 0; i < 16; i++ {
+		lb.Add(&exP{"172.16.0." + strconv.Itoa(i) + ":3500", i%4 + 1})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lb.Next(lbapi.DummyFactor)
+		}
+	})
+}
+
+func TestWRR_Replace(t *testing.T) {
+	p1, p2, p3 := &exP{"172.16.0.7:3500", 3}, &exP{"172.16.0.8:3500", 1}, &exP{"172.16.0.9:3500", 1}
+	lb := wrr.New(lbapi.WithPickCounts())
+	lb.Add(p1, p2)
+	lb.Next(lbapi.DummyFactor)
+
+	lb.(lbapi.Updater).Replace(p1, p3)
+	s, _ := lbapi.Inspect(lb)
+	if len(s.Peers) != 2 || s.Peers[0].Peer != p1 || s.Peers[0].Current != -1 || s.Peers[0].Picks != 1 {
+		t.Fatalf("the kept node should keep its state: %+v", s.Peers)
+	}
+	if ps := s.Peers[1]; ps.Peer != p3 || ps.Current != 0 || ps.Weight != 1 {
+		t.Fatalf("bad new node: %+v", ps)
+	}
+}